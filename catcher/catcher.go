@@ -0,0 +1,236 @@
+// Package catcher captures mail for local testing instead of delivering it.
+// A Store receives messages over SMTP through an smtpd.Server and from the
+// Mailer, for which it is a Transport, and keeps them in memory and
+// optionally on disk:
+//
+//	<dir>/<id>.eml
+//	<dir>/<id>.json
+package catcher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pranavKharche24/mail/smtpd"
+)
+
+// DefaultMaxMessages is the number of messages kept when Store.Max is not set
+const DefaultMaxMessages = 1000
+
+// Message is a captured message
+type Message struct {
+	ID       string    `json:"id"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Subject  string    `json:"subject"`
+	Received time.Time `json:"received"`
+	Size     int       `json:"size"`
+	// Raw is the message as it was received
+	Raw []byte `json:"-"`
+}
+
+// Store holds captured messages, newest first
+type Store struct {
+	// Max is the number of messages kept; older ones are dropped
+	// (default DefaultMaxMessages)
+	Max int
+
+	dir      string
+	mu       sync.RWMutex
+	messages []*Message
+}
+
+// New creates a store. When dir is not empty, messages are also written to
+// it and the messages already there are loaded.
+func New(dir string) (*Store, error) {
+	s := &Store{dir: dir}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating catcher directory: %v", err)
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the messages saved in the store's directory
+func (s *Store) load() error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("error loading captured mail: %v", err)
+		}
+		msg := &Message{}
+		if err := json.Unmarshal(data, msg); err != nil {
+			return fmt.Errorf("error loading captured mail %s: %v", name, err)
+		}
+		if msg.Raw, err = os.ReadFile(strings.TrimSuffix(name, ".json") + ".eml"); err != nil {
+			return fmt.Errorf("error loading captured mail: %v", err)
+		}
+		s.messages = append(s.messages, msg)
+	}
+	sort.Slice(s.messages, func(i, j int) bool {
+		return s.messages[i].Received.After(s.messages[j].Received)
+	})
+	return nil
+}
+
+// Add captures a message and returns it
+func (s *Store) Add(from string, to []string, raw []byte) (*Message, error) {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	now := time.Now()
+	msg := &Message{
+		ID:       now.Format("20060102-150405") + "-" + hex.EncodeToString(suffix),
+		From:     from,
+		To:       append([]string{}, to...),
+		Subject:  subjectOf(raw),
+		Received: now,
+		Size:     len(raw),
+		Raw:      raw,
+	}
+
+	if s.dir != "" {
+		meta, err := json.MarshalIndent(msg, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(s.path(msg.ID, ".eml"), raw, 0600); err != nil {
+			return nil, fmt.Errorf("error saving captured mail: %v", err)
+		}
+		if err := os.WriteFile(s.path(msg.ID, ".json"), meta, 0600); err != nil {
+			return nil, fmt.Errorf("error saving captured mail: %v", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append([]*Message{msg}, s.messages...)
+	max := s.Max
+	if max <= 0 {
+		max = DefaultMaxMessages
+	}
+	for len(s.messages) > max {
+		old := s.messages[len(s.messages)-1]
+		s.messages = s.messages[:len(s.messages)-1]
+		s.remove(old.ID)
+	}
+	return msg, nil
+}
+
+// Send captures a message from the Mailer; it makes Store a mailer.Transport
+func (s *Store) Send(ctx context.Context, from string, rcpts []string, msg io.Reader) error {
+	raw, err := io.ReadAll(msg)
+	if err != nil {
+		return err
+	}
+	_, err = s.Add(from, rcpts, raw)
+	return err
+}
+
+// HandleSMTP captures a message received by an smtpd.Server
+func (s *Store) HandleSMTP(env smtpd.Envelope, data []byte) error {
+	_, err := s.Add(env.From, env.To, data)
+	return err
+}
+
+// List returns the captured messages, newest first
+func (s *Store) List() []*Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*Message{}, s.messages...)
+}
+
+// Get returns the message with the given ID, or nil
+func (s *Store) Get(id string) *Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, msg := range s.messages {
+		if msg.ID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+// Delete removes a message
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, msg := range s.messages {
+		if msg.ID == id {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			return s.remove(id)
+		}
+	}
+	return fmt.Errorf("no captured message %s", id)
+}
+
+// Clear removes all messages
+func (s *Store) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, msg := range s.messages {
+		if err := s.remove(msg.ID); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.messages = nil
+	return firstErr
+}
+
+// remove deletes the files of a message
+func (s *Store) remove(id string) error {
+	if s.dir == "" {
+		return nil
+	}
+	for _, ext := range []string{".eml", ".json"} {
+		if err := os.Remove(s.path(id, ext)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error deleting captured mail: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) path(id, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
+
+// subjectOf returns the decoded Subject of a raw message
+func subjectOf(raw []byte) string {
+	for _, field := range headerFields(raw) {
+		if strings.EqualFold(field.Name, "Subject") {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// decodeHeader decodes RFC 2047 encoded-words, returning the value as it is
+// when it cannot be decoded
+func decodeHeader(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
@@ -0,0 +1,259 @@
+package catcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pranavKharche24/mail/mailer"
+	"github.com/pranavKharche24/mail/smtpd"
+)
+
+func add(t *testing.T, s *Store, subject string) *Message {
+	t.Helper()
+	msg, err := s.Add("alice@example.com", []string{"bob@example.com"}, []byte("Subject: "+subject+"\r\n\r\nx\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func subjects(msgs []*Message) string {
+	var list []string
+	for _, msg := range msgs {
+		list = append(list, msg.Subject)
+	}
+	return strings.Join(list, ",")
+}
+
+func TestStore(t *testing.T) {
+	s, err := New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Max = 3
+
+	first := add(t, s, "One")
+	if first.From != "alice@example.com" || first.Size != len(first.Raw) || first.ID == "" {
+		t.Errorf("captured %+v", first)
+	}
+	add(t, s, "Two")
+	third := add(t, s, "=?UTF-8?q?Dr=C3=A9i?=")
+	if got := subjects(s.List()); got != "Dréi,Two,One" {
+		t.Errorf("messages %s, want the newest first", got)
+	}
+
+	// Beyond Max the oldest messages are dropped
+	add(t, s, "Four")
+	if got := subjects(s.List()); got != "Four,Dréi,Two" {
+		t.Errorf("messages %s after exceeding Max", got)
+	}
+	if s.Get(first.ID) != nil {
+		t.Error("dropped message still found")
+	}
+	if s.Get(third.ID) != third {
+		t.Error("Get did not find a captured message")
+	}
+
+	if err := s.Delete(third.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(third.ID); err == nil {
+		t.Error("deleting a missing message succeeded")
+	}
+	if got := subjects(s.List()); got != "Four,Two" {
+		t.Errorf("messages %s after Delete", got)
+	}
+	if err := s.Clear(); err != nil || len(s.List()) != 0 {
+		t.Errorf("Clear: %v, %d messages left", err, len(s.List()))
+	}
+}
+
+func TestStoreDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "catcher")
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Max = 2
+	add(t, s, "One")
+	time.Sleep(10 * time.Millisecond)
+	second := add(t, s, "Two")
+	time.Sleep(10 * time.Millisecond)
+	third := add(t, s, "Three")
+
+	// The dropped message is removed from disk as well
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 4 {
+		t.Errorf("%d files on disk, want 4", len(files))
+	}
+
+	reopened, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := reopened.List()
+	if subjects(msgs) != "Three,Two" {
+		t.Fatalf("reloaded %s", subjects(msgs))
+	}
+	if msgs[0].ID != third.ID || string(msgs[0].Raw) != string(third.Raw) || msgs[1].To[0] != "bob@example.com" {
+		t.Errorf("reloaded %+v", msgs[0])
+	}
+
+	if err := reopened.Delete(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, second.ID+".eml")); !os.IsNotExist(err) {
+		t.Error("deleted message left on disk")
+	}
+	if err := reopened.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("files left after Clear: %v", files)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(dir); err == nil {
+		t.Error("corrupt metadata was loaded")
+	}
+}
+
+func TestStoreReceives(t *testing.T) {
+	s, _ := New("")
+	if err := s.HandleSMTP(smtpd.Envelope{From: "relay@example.com", To: []string{"a@example.com", "b@example.com"}}, []byte("Subject: Relayed\r\n\r\nx\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Store is a Transport, so the Mailer can deliver into it
+	m := mailer.New()
+	m.SetCredentials("alice@example.com", "secret")
+	m.SetTransport(s)
+	msg := &mailer.Message{
+		To:      []string{"Bob <bob@example.com>"},
+		Bcc:     []string{"carol@example.com"},
+		Subject: "Grüße",
+		Text:    "Hallo Bob",
+		HTML:    "<p>Hallo <b>Bob</b></p>",
+		Headers: map[string]string{"X-Campaign": "spring"},
+	}
+	msg.AttachData("report.csv", []byte("a,b\n1,2\n"))
+	if _, err := m.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := s.List()
+	if subjects(msgs) != "Grüße,Relayed" {
+		t.Fatalf("captured %s", subjects(msgs))
+	}
+	if strings.Join(msgs[0].To, ",") != "bob@example.com,carol@example.com" || strings.Join(msgs[1].To, ",") != "a@example.com,b@example.com" {
+		t.Errorf("recipients %v and %v", msgs[0].To, msgs[1].To)
+	}
+
+	parsed := msgs[0].Parse()
+	if !strings.Contains(parsed.Text, "Hallo Bob") || !strings.Contains(parsed.HTML, "<b>Bob</b>") {
+		t.Errorf("bodies %q and %q", parsed.Text, parsed.HTML)
+	}
+	if len(parsed.Parts) != 1 || parsed.Parts[0].Filename != "report.csv" || string(parsed.Parts[0].Data) != "a,b\n1,2\n" {
+		t.Errorf("parts %+v", parsed.Parts)
+	}
+	fields := map[string]string{}
+	for _, f := range parsed.Header {
+		fields[f.Name] = f.Value
+	}
+	if fields["Subject"] != "Grüße" || fields["X-Campaign"] != "spring" || fields["Bcc"] != "" {
+		t.Errorf("header %v", parsed.Header)
+	}
+}
+
+func TestParse(t *testing.T) {
+	raw := "From: =?UTF-8?q?J=C3=B6rg?= <jorg@example.com>\r\n" +
+		"Subject: A long subject\r\n" +
+		"  folded onto two lines\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/related; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<p>Caf=C3=A9</p><img src=3D\"cid:logo@example\">\r\n" +
+		"--inner\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-ID: <logo@example>\r\n" +
+		"\r\n" +
+		"iVBORw0K\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain; name=\"=?UTF-8?q?b=C3=BCro.txt?=\"\r\n" +
+		"Content-Disposition: attachment\r\n" +
+		"\r\n" +
+		"attached text\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"bad.bin\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"!!!not base64\r\n" +
+		"--outer--\r\n"
+
+	p := (&Message{Raw: []byte(raw)}).Parse()
+	if len(p.Header) != 3 || p.Header[0].Value != "Jörg <jorg@example.com>" || p.Header[1].Value != "A long subject folded onto two lines" {
+		t.Errorf("header %q", p.Header)
+	}
+	if p.Text != "" || p.HTML != `<p>Café</p><img src="cid:logo@example">` {
+		t.Errorf("text %q, HTML %q", p.Text, p.HTML)
+	}
+	if len(p.Parts) != 3 {
+		t.Fatalf("%d parts, want 3: %+v", len(p.Parts), p.Parts)
+	}
+	if img := p.Part(1); img.ContentType != "image/png" || img.ContentID != "logo@example" || string(img.Data) != "\x89PNG\r\n" {
+		t.Errorf("inline image %+v", img)
+	}
+	// A text part sent as an attachment is not taken for the body
+	if att := p.Part(2); att.Filename != "büro.txt" || string(att.Data) != "attached text" {
+		t.Errorf("attachment %+v", att)
+	}
+	if bad := p.Part(3); bad.Filename != "bad.bin" || !strings.Contains(string(bad.Data), "[error decoding part") {
+		t.Errorf("undecodable part %+v", bad)
+	}
+	if p.Part(4) != nil || p.Part(0) != nil {
+		t.Error("Part returned a part that does not exist")
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		raw   string
+		text  string
+		parts int
+	}{
+		{"no header at all", "no header at all", 0},
+		{"Subject: x\r\n\r\nbody", "body", 0},
+		{"Content-Type: text/plain; charset\r\n\r\nbad type", "bad type", 0},
+		// A multipart body that cannot be split is kept as one part
+		{"Content-Type: multipart/mixed\r\n\r\nno boundary", "", 1},
+	}
+	for _, tt := range tests {
+		p := (&Message{Raw: []byte(tt.raw)}).Parse()
+		if p.Text != tt.text || len(p.Parts) != tt.parts {
+			t.Errorf("%q: text %q, %d parts", tt.raw, p.Text, len(p.Parts))
+		}
+	}
+
+	// Deeply nested multiparts are not walked without limit
+	var raw strings.Builder
+	for i := 0; i < maxDepth+5; i++ {
+		raw.WriteString("Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n")
+	}
+	raw.WriteString("\r\ninnermost\r\n")
+	(&Message{Raw: []byte(raw.String())}).Parse()
+}
@@ -0,0 +1,151 @@
+package catcher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// maxDepth limits how deeply multipart messages are walked
+const maxDepth = 20
+
+// Field is a header field, in the order it appears in the message
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Part is a decoded leaf part of a message other than its text and HTML
+// bodies: an attachment, an inline image or a signature
+type Part struct {
+	// Index identifies the part within the message
+	Index       int
+	ContentType string
+	Filename    string
+	ContentID   string
+	Data        []byte
+}
+
+// Parsed is the readable form of a captured message
+type Parsed struct {
+	Header []Field
+	Text   string
+	HTML   string
+	Parts  []Part
+}
+
+// Parse decodes the header, bodies and attachments of a message. Malformed
+// parts are kept as attachments rather than failing the whole message.
+func (msg *Message) Parse() *Parsed {
+	p := &Parsed{Header: headerFields(msg.Raw)}
+	r := bufio.NewReader(bytes.NewReader(msg.Raw))
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		p.Text = string(msg.Raw)
+		return p
+	}
+	p.walk(header, r, 0)
+	return p
+}
+
+// Part returns the part with the given index, or nil
+func (p *Parsed) Part(index int) *Part {
+	for i := range p.Parts {
+		if p.Parts[i].Index == index {
+			return &p.Parts[i]
+		}
+	}
+	return nil
+}
+
+// walk collects the leaf parts of an entity
+func (p *Parsed) walk(header textproto.MIMEHeader, body io.Reader, depth int) {
+	contentType := header.Get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxDepth {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			p.walk(part.Header, part, depth+1)
+		}
+	}
+
+	data, err := io.ReadAll(decodeBody(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		data = append(data, []byte("\n[error decoding part: "+err.Error()+"]")...)
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	filename = decodeHeader(filename)
+
+	if disposition != "attachment" && filename == "" {
+		switch {
+		case mediaType == "text/plain" && p.Text == "":
+			p.Text = string(data)
+			return
+		case mediaType == "text/html" && p.HTML == "":
+			p.HTML = string(data)
+			return
+		}
+	}
+	p.Parts = append(p.Parts, Part{
+		Index:       len(p.Parts) + 1,
+		ContentType: mediaType,
+		Filename:    filename,
+		ContentID:   strings.Trim(header.Get("Content-Id"), "<> "),
+		Data:        data,
+	})
+}
+
+// decodeBody undoes a Content-Transfer-Encoding
+func decodeBody(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// headerFields returns the unfolded and decoded header fields of a raw
+// message in their original order
+func headerFields(raw []byte) []Field {
+	var fields []Field
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			break
+		}
+		fields = append(fields, Field{Name: name, Value: strings.TrimSpace(value)})
+	}
+	for i := range fields {
+		fields[i].Value = decodeHeader(fields[i].Value)
+	}
+	return fields
+}
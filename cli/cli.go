@@ -2,11 +2,16 @@ package cli
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/pranavKharche24/mail/config"
 	"github.com/pranavKharche24/mail/mailer"
 )
 
@@ -60,7 +65,7 @@ func (c *CLI) Run() {
 		case "5":
 			c.listTemplates()
 		case "6", "q", "quit", "exit":
-			fmt.Println("\n  Goodbye.\n")
+			fmt.Print("\n  Goodbye.\n\n")
 			return
 		default:
 			c.showError("Invalid option")
@@ -88,6 +93,26 @@ func (c *CLI) prompt(label string) string {
 	return strings.TrimSpace(input)
 }
 
+func (c *CLI) promptDefault(label, defaultValue string) string {
+	if defaultValue == "" {
+		return c.prompt(label)
+	}
+	if input := c.prompt(fmt.Sprintf("%s [%s]", label, defaultValue)); input != "" {
+		return input
+	}
+	return defaultValue
+}
+
+// promptAddresses reads a comma-separated address list, reporting invalid input
+func (c *CLI) promptAddresses(label string) ([]string, bool) {
+	list, err := mailer.ParseAddressList(c.prompt(label))
+	if err != nil {
+		c.showError(err.Error())
+		return nil, false
+	}
+	return list, true
+}
+
 func (c *CLI) promptMultiline(label string) string {
 	fmt.Printf("  %s> %s (end with empty line):%s\n", Bold, label, Reset)
 	var lines []string
@@ -115,6 +140,18 @@ func (c *CLI) showInfo(msg string) {
 	fmt.Printf("  %s[INFO]%s %s\n", Cyan, Reset, msg)
 }
 
+// reportQueued tells the user when a send was deferred to the outbox and
+// returns true if so
+func (c *CLI) reportQueued(id string, err error) bool {
+	if !errors.Is(err, mailer.ErrQueued) {
+		return false
+	}
+	fmt.Printf("\n  %s[QUEUED]%s %v\n", Yellow, Reset, err)
+	c.showInfo("The email will be retried automatically (gomail queue list)")
+	c.showInfo(fmt.Sprintf("Message-ID: %s", id))
+	return true
+}
+
 func (c *CLI) sendPlainEmail() {
 	fmt.Println()
 	fmt.Printf("  %s%sSEND PLAIN TEXT EMAIL%s\n", Bold, Green, Reset)
@@ -126,42 +163,41 @@ func (c *CLI) sendPlainEmail() {
 		return
 	}
 
-	to := c.prompt("To (comma-separated)")
-	if to == "" {
+	to, ok := c.promptAddresses("To (comma-separated)")
+	if !ok {
+		return
+	}
+	if len(to) == 0 {
 		c.showError("Recipient is required")
 		return
 	}
 
-	cc := c.prompt("CC (optional)")
-	bcc := c.prompt("BCC (optional)")
+	cc, ok := c.promptAddresses("CC (optional)")
+	if !ok {
+		return
+	}
+	bcc, ok := c.promptAddresses("BCC (optional)")
+	if !ok {
+		return
+	}
 	subject := c.prompt("Subject")
 	message := c.promptMultiline("Message")
 	attachments := c.prompt("Attachments (paths, optional)")
 
-	var attachmentList []string
-	if attachments != "" {
-		for _, a := range strings.Split(attachments, ",") {
-			attachmentList = append(attachmentList, strings.TrimSpace(a))
-		}
+	msg := &mailer.Message{
+		To:      to,
+		Cc:      cc,
+		Bcc:     bcc,
+		Subject: subject,
+		Text:    message,
 	}
+	attachAll(msg, attachments)
 
-	c.showInfo("Sending...")
-
-	err := c.mailer.SendPlain(
-		splitEmails(to),
-		subject,
-		message,
-		splitEmails(cc),
-		splitEmails(bcc),
-		attachmentList,
-	)
-
-	if err != nil {
-		c.showError(fmt.Sprintf("Send failed: %v", err))
+	if !c.promptAdvanced(msg) {
 		return
 	}
 
-	c.showSuccess("Email sent successfully")
+	c.sendMessage(msg, "Email sent successfully")
 }
 
 func (c *CLI) sendHTMLEmail() {
@@ -177,14 +213,23 @@ func (c *CLI) sendHTMLEmail() {
 
 	c.listTemplates()
 
-	to := c.prompt("To (comma-separated)")
-	if to == "" {
+	to, ok := c.promptAddresses("To (comma-separated)")
+	if !ok {
+		return
+	}
+	if len(to) == 0 {
 		c.showError("Recipient is required")
 		return
 	}
 
-	cc := c.prompt("CC (optional)")
-	bcc := c.prompt("BCC (optional)")
+	cc, ok := c.promptAddresses("CC (optional)")
+	if !ok {
+		return
+	}
+	bcc, ok := c.promptAddresses("BCC (optional)")
+	if !ok {
+		return
+	}
 	subject := c.prompt("Subject")
 	htmlFile := c.prompt("HTML file path")
 
@@ -195,30 +240,164 @@ func (c *CLI) sendHTMLEmail() {
 
 	attachments := c.prompt("Attachments (paths, optional)")
 
-	var attachmentList []string
-	if attachments != "" {
-		for _, a := range strings.Split(attachments, ",") {
-			attachmentList = append(attachmentList, strings.TrimSpace(a))
+	msg := &mailer.Message{
+		To:      to,
+		Cc:      cc,
+		Bcc:     bcc,
+		Subject: subject,
+	}
+	attachAll(msg, attachments)
+
+	data, ok := c.promptTemplateData()
+	if !ok {
+		return
+	}
+	if err := msg.LoadHTMLTemplate(htmlFile, data); err != nil {
+		c.showError(err.Error())
+		return
+	}
+
+	if !c.promptAdvanced(msg) {
+		return
+	}
+
+	c.sendMessage(msg, "HTML email sent successfully")
+}
+
+// sendMessage asks when to send and then sends or schedules msg
+func (c *CLI) sendMessage(msg *mailer.Message, sentText string) {
+	c.promptPGP(msg)
+
+	at, err := mailer.ParseSendAt(c.prompt("Send at (optional: YYYY-MM-DD HH:MM, HH:MM or +2h; Enter for now)"), time.Now())
+	if err != nil {
+		c.showError(err.Error())
+		return
+	}
+
+	if !at.IsZero() {
+		c.showInfo("Scheduling...")
+		id, err := c.mailer.Schedule(msg, at)
+		if err != nil {
+			c.showError(fmt.Sprintf("Schedule failed: %v", err))
+			return
 		}
+		c.showSuccess(fmt.Sprintf("Email scheduled for %s", at.Format("Mon Jan 2 15:04")))
+		c.showInfo(fmt.Sprintf("Message-ID: %s", id))
+		c.showInfo("Manage scheduled sends with: gomail queue list|reschedule|cancel")
+		return
 	}
 
-	c.showInfo("Sending...")
+	// Ctrl+C cancels the send in progress instead of quitting gomail
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	err := c.mailer.SendHTML(
-		splitEmails(to),
-		subject,
-		htmlFile,
-		splitEmails(cc),
-		splitEmails(bcc),
-		attachmentList,
-	)
+	c.showInfo("Sending... (Ctrl+C to cancel)")
 
+	id, err := c.mailer.Send(ctx, msg)
+	if errors.Is(err, context.Canceled) {
+		fmt.Println()
+		c.showError("Send cancelled")
+		return
+	}
+	if c.reportQueued(id, err) {
+		return
+	}
 	if err != nil {
 		c.showError(fmt.Sprintf("Send failed: %v", err))
 		return
 	}
 
-	c.showSuccess("HTML email sent successfully")
+	c.showSuccess(sentText)
+	c.showInfo(fmt.Sprintf("Message-ID: %s", id))
+}
+
+// promptTemplateData reads template data from a JSON file or key=value
+// prompts. It returns nil data when nothing is entered.
+func (c *CLI) promptTemplateData() (interface{}, bool) {
+	if jsonFile := c.prompt("Template data JSON file (optional, Enter to type fields)"); jsonFile != "" {
+		data, err := mailer.LoadTemplateData(jsonFile)
+		if err != nil {
+			c.showError(err.Error())
+			return nil, false
+		}
+		return data, true
+	}
+
+	var pairs []string
+	for {
+		pair := c.prompt("Template field (key=value, empty to finish)")
+		if pair == "" {
+			break
+		}
+		if _, err := mailer.ParseTemplateFields([]string{pair}); err != nil {
+			c.showError(err.Error())
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	if len(pairs) == 0 {
+		return nil, true
+	}
+	data, _ := mailer.ParseTemplateFields(pairs)
+	return data, true
+}
+
+// promptPGP asks whether to sign and encrypt msg when a PGP keyring is
+// loaded
+func (c *CLI) promptPGP(msg *mailer.Message) {
+	if c.mailer.Keyring() == nil {
+		return
+	}
+	msg.Sign = c.confirm("Sign with PGP? [y/N]")
+	msg.Encrypt = c.confirm("Encrypt with PGP? [y/N]")
+}
+
+// confirm asks a yes/no question that defaults to no
+func (c *CLI) confirm(label string) bool {
+	answer := c.prompt(label)
+	return strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")
+}
+
+// promptAdvanced optionally asks for Reply-To, threading and extra headers
+func (c *CLI) promptAdvanced(msg *mailer.Message) bool {
+	if !c.confirm("Advanced options (Reply-To, threading, headers)? [y/N]") {
+		return true
+	}
+
+	replyTo, ok := c.promptAddresses("Reply-To (optional)")
+	if !ok {
+		return false
+	}
+	msg.ReplyTo = replyTo
+	msg.InReplyTo = c.prompt("In-Reply-To Message-ID (optional)")
+	if refs := c.prompt("References (space-separated, optional)"); refs != "" {
+		msg.References = strings.Fields(refs)
+	}
+
+	for {
+		line := c.prompt("Extra header (Name: value, empty to finish)")
+		if line == "" {
+			return true
+		}
+		name, value, err := mailer.ParseHeaderField(line)
+		if err != nil {
+			c.showError(err.Error())
+			continue
+		}
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers[name] = value
+	}
+}
+
+// attachAll adds a comma-separated list of file paths as attachments
+func attachAll(msg *mailer.Message, paths string) {
+	for _, a := range strings.Split(paths, ",") {
+		if path := strings.TrimSpace(a); path != "" {
+			msg.Attach(path)
+		}
+	}
 }
 
 func (c *CLI) configureCredentials() {
@@ -227,19 +406,40 @@ func (c *CLI) configureCredentials() {
 	fmt.Println("  " + strings.Repeat("-", 40))
 	fmt.Println()
 
-	email := c.prompt("Gmail address")
-	password := c.prompt("App password")
+	currentEmail, _ := c.mailer.GetCredentials()
+	currentHost, currentPort, currentTLS := c.mailer.GetServer()
+
+	email := c.promptDefault("Email address", currentEmail)
+	password := c.prompt("Password / app password")
 
 	if email == "" || password == "" {
 		c.showError("Both email and password are required")
 		return
 	}
 
-	c.mailer.SetCredentials(email, password)
-
-	envContent := fmt.Sprintf("# Gomail Configuration\nEMAIL_FROM=%s\nEMAIL_PASSWORD=%s\nPORT=8080\n", email, password)
+	host := c.promptDefault("SMTP host", currentHost)
+	tlsInput := c.promptDefault("TLS mode (starttls, implicit, none)", string(currentTLS))
+	tlsMode, err := mailer.ParseTLSMode(tlsInput)
+	if err != nil {
+		c.showError(err.Error())
+		return
+	}
+	defaultPort := currentPort
+	if tlsMode != currentTLS {
+		defaultPort = config.DefaultSMTPPort(string(tlsMode))
+	}
+	port := c.promptDefault("SMTP port", defaultPort)
 
-	err := os.WriteFile(".env", []byte(envContent), 0600)
+	c.mailer.SetCredentials(email, password)
+	c.mailer.SetServer(host, port, tlsMode)
+
+	err = config.SaveEnv(".env", map[string]string{
+		"EMAIL_FROM":     email,
+		"EMAIL_PASSWORD": password,
+		"SMTP_HOST":      host,
+		"SMTP_PORT":      port,
+		"SMTP_TLS":       string(tlsMode),
+	})
 	if err != nil {
 		c.showError(fmt.Sprintf("Failed to save: %v", err))
 		return
@@ -261,8 +461,11 @@ func (c *CLI) showCredentials() {
 		return
 	}
 
+	host, port, tlsMode := c.mailer.GetServer()
+
 	fmt.Printf("  Email:    %s\n", email)
 	fmt.Printf("  Password: ********\n")
+	fmt.Printf("  Server:   %s:%s (%s)\n", host, port, tlsMode)
 	fmt.Printf("  Status:   %sConfigured%s\n", Green, Reset)
 }
 
@@ -305,16 +508,3 @@ func (c *CLI) listTemplates() {
 	}
 	fmt.Println()
 }
-
-func splitEmails(s string) []string {
-	if s == "" {
-		return []string{}
-	}
-	var result []string
-	for _, p := range strings.Split(s, ",") {
-		if trimmed := strings.TrimSpace(p); trimmed != "" {
-			result = append(result, trimmed)
-		}
-	}
-	return result
-}
@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"crypto"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pranavKharche24/mail/config"
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+// RunDKIM runs the "gomail dkim" command, which creates DKIM signing keys
+// and prints the DNS record to publish, and returns the process exit code
+func RunDKIM(cfg *config.Config, args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: gomail dkim keygen [options]")
+		fmt.Fprintln(os.Stderr, "       gomail dkim record")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	switch args[0] {
+	case "keygen":
+		return dkimKeygen(cfg, args[1:])
+	case "record":
+		return dkimRecord(cfg)
+	case "help", "-h", "--help":
+		usage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown dkim command: %s\n", args[0])
+		usage()
+		return 2
+	}
+}
+
+func dkimKeygen(cfg *config.Config, args []string) int {
+	out := cfg.DKIMKeyPath
+	if out == "" {
+		out = "dkim.pem"
+	}
+
+	fs := flag.NewFlagSet("dkim keygen", flag.ContinueOnError)
+	keyType := fs.String("type", "rsa", "key type: rsa or ed25519")
+	bits := fs.Int("bits", 2048, "RSA key size")
+	domain := fs.String("domain", cfg.DKIMDomain, "signing domain")
+	selector := fs.String("selector", cfg.DKIMSelector, "DKIM selector")
+	keyPath := fs.String("out", out, "file to write the private key to")
+	force := fs.Bool("force", false, "overwrite an existing key file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *domain == "" {
+		fmt.Fprintln(os.Stderr, "No signing domain: pass --domain or set EMAIL_FROM or DKIM_DOMAIN")
+		return 2
+	}
+
+	if _, err := os.Stat(*keyPath); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists; pass --force to replace it\n", *keyPath)
+		return 1
+	}
+
+	key, err := mailer.GenerateDKIMKey(*keyType, *bits)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	data, err := mailer.MarshalDKIMKey(key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := os.WriteFile(*keyPath, data, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing key: %v\n", err)
+		return 1
+	}
+
+	fmt.Println()
+	fmt.Printf("  %sPrivate key written to %s%s\n", Green, *keyPath, Reset)
+	if err := printDKIMRecord(key, *domain, *selector); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("  Then enable signing in .env:")
+	fmt.Println()
+	fmt.Printf("    DKIM_DOMAIN=%s\n", *domain)
+	fmt.Printf("    DKIM_SELECTOR=%s\n", *selector)
+	fmt.Printf("    DKIM_KEY_PATH=%s\n", *keyPath)
+	fmt.Println()
+	return 0
+}
+
+func dkimRecord(cfg *config.Config) int {
+	if cfg.DKIMKeyPath == "" {
+		fmt.Fprintln(os.Stderr, "DKIM_KEY_PATH is not set; create a key with 'gomail dkim keygen'")
+		return 1
+	}
+	key, err := mailer.LoadDKIMKey(cfg.DKIMKeyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := printDKIMRecord(key, cfg.DKIMDomain, cfg.DKIMSelector); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// printDKIMRecord prints the TXT record for key in zone file syntax. DNS
+// strings are limited to 255 bytes, so long RSA keys are split into several.
+func printDKIMRecord(key crypto.Signer, domain, selector string) error {
+	record, err := mailer.DKIMRecord(key)
+	if err != nil {
+		return err
+	}
+	var parts []string
+	for len(record) > 255 {
+		parts = append(parts, `"`+record[:255]+`"`)
+		record = record[255:]
+	}
+	parts = append(parts, `"`+record+`"`)
+
+	fmt.Println()
+	fmt.Println("  Publish this DNS TXT record:")
+	fmt.Println()
+	fmt.Printf("    %s._domainkey.%s. IN TXT ( %s )\n", selector, domain, strings.Join(parts, "\n      "))
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+// RunMerge runs the non-interactive "gomail merge" command and returns the
+// process exit code
+func RunMerge(m *mailer.Mailer, args []string) int {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	templateFile := fs.String("template", "", "HTML or text template file")
+	dataFile := fs.String("data", "", "CSV or JSON file with one row per recipient")
+	subject := fs.String("subject", "", "subject line (may use template fields)")
+	toField := fs.String("to-field", "email", "data column holding the recipient address")
+	cc := fs.String("cc", "", "CC addresses for every message")
+	bcc := fs.String("bcc", "", "BCC addresses for every message")
+	attach := fs.String("attach", "", "comma-separated files attached to every message")
+	dryRun := fs.Bool("dry-run", false, "write rendered messages to --out instead of sending")
+	outDir := fs.String("out", "merge-output", "output directory for --dry-run")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gomail merge --template FILE --data FILE --subject TEXT [options]")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Exit codes: 0 every row sent or written, 1 some rows failed, 2 invalid input,")
+		fmt.Fprintln(fs.Output(), "78 configuration error")
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return ExitOK
+		}
+		return ExitValidation
+	}
+
+	if *templateFile == "" || *dataFile == "" {
+		fs.Usage()
+		return ExitValidation
+	}
+
+	ccList, err := mailer.ParseAddressList(*cc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --cc: %v\n", err)
+		return ExitValidation
+	}
+	bccList, err := mailer.ParseAddressList(*bcc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --bcc: %v\n", err)
+		return ExitValidation
+	}
+
+	rows, err := mailer.LoadMergeData(*dataFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitValidation
+	}
+
+	if email, _ := m.GetCredentials(); *dryRun && email == "" {
+		fmt.Fprintln(os.Stderr, "EMAIL_FROM is not configured.")
+		return ExitConfig
+	}
+	if !*dryRun && !m.IsConfigured() {
+		fmt.Fprintln(os.Stderr, "Credentials not configured. Run 'gomail cli' and use Configure Credentials, or edit .env.")
+		return ExitConfig
+	}
+
+	job := mailer.MergeJob{
+		Template: *templateFile,
+		Subject:  *subject,
+		ToField:  *toField,
+		Cc:       ccList,
+		Bcc:      bccList,
+	}
+	for _, a := range strings.Split(*attach, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			job.Attachments = append(job.Attachments, a)
+		}
+	}
+
+	dir := ""
+	if *dryRun {
+		dir = *outDir
+	}
+
+	results := m.Merge(context.Background(), job, rows, dir)
+	failed := printMergeResults(results, *dryRun)
+	if failed > 0 {
+		return ExitPermanent
+	}
+	return ExitOK
+}
+
+// printMergeResults prints one line per row and a summary, returning the
+// number of failed rows
+func printMergeResults(results []mailer.MergeResult, dryRun bool) int {
+	failed, queued := 0, 0
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			failed++
+			fmt.Printf("  %s[ERROR]%s row %d %s: %v\n", Red, Reset, r.Row, r.To, r.Err)
+		case r.Queued:
+			queued++
+			fmt.Printf("  %s[QUEUED]%s row %d %s %s\n", Yellow, Reset, r.Row, r.To, r.MessageID)
+		case r.File != "":
+			fmt.Printf("  %s[OK]%s row %d %s -> %s\n", Green, Reset, r.Row, r.To, r.File)
+		default:
+			fmt.Printf("  %s[OK]%s row %d %s %s\n", Green, Reset, r.Row, r.To, r.MessageID)
+		}
+	}
+	verb := "sent"
+	if dryRun {
+		verb = "written"
+	}
+	if queued > 0 {
+		fmt.Printf("\n  %d %s, %d queued for retry, %d failed\n", len(results)-failed-queued, verb, queued, failed)
+	} else {
+		fmt.Printf("\n  %d %s, %d failed\n", len(results)-failed, verb, failed)
+	}
+	return failed
+}
@@ -0,0 +1,174 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pranavKharche24/mail/mailer"
+	"github.com/pranavKharche24/mail/outbox"
+)
+
+// RunQueue runs the "gomail queue" command, which inspects and manages the
+// outbox and scheduled sends, and returns the process exit code
+func RunQueue(m *mailer.Mailer, ob *outbox.Outbox, args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: gomail queue list")
+		fmt.Fprintln(os.Stderr, "       gomail queue retry [ID | --all]")
+		fmt.Fprintln(os.Stderr, "       gomail queue reschedule ID TIME")
+		fmt.Fprintln(os.Stderr, "       gomail queue cancel ID")
+		fmt.Fprintln(os.Stderr, "       gomail queue purge [ID | --dead | --all]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "TIME is YYYY-MM-DD HH:MM, HH:MM (next occurrence) or +DURATION such as +2h.")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	switch args[0] {
+	case "list", "ls":
+		return queueList(ob)
+	case "retry":
+		return queueRetry(m, ob, args[1:])
+	case "reschedule":
+		return queueReschedule(ob, args[1:])
+	case "cancel":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: gomail queue cancel ID")
+			return 2
+		}
+		return queuePurge(ob, args[1:])
+	case "purge":
+		return queuePurge(ob, args[1:])
+	case "help", "-h", "--help":
+		usage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown queue command: %s\n", args[0])
+		usage()
+		return 2
+	}
+}
+
+func queueList(ob *outbox.Outbox) int {
+	entries, err := ob.List()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(entries) == 0 {
+		fmt.Println("  Outbox is empty.")
+		return 0
+	}
+
+	for _, e := range entries {
+		status := Yellow + "pending" + Reset
+		next := fmt.Sprintf("attempts %d, next attempt %s", e.Attempts, e.NextAttempt.Format("2006-01-02 15:04:05"))
+		switch e.Status {
+		case outbox.StatusScheduled:
+			status = Cyan + "scheduled" + Reset
+			next = "send at " + e.NextAttempt.Format("2006-01-02 15:04:05")
+		case outbox.StatusDead:
+			status = Red + "dead" + Reset
+			next = fmt.Sprintf("attempts %d, not retried", e.Attempts)
+		}
+		fmt.Printf("  %s%s%s  %s  %s\n", Bold, e.ID, Reset, status, next)
+		fmt.Printf("    To: %s\n", strings.Join(e.To, ", "))
+		if e.Subject != "" {
+			fmt.Printf("    Subject: %s\n", e.Subject)
+		}
+		if e.MessageID != "" {
+			fmt.Printf("    Message-ID: %s\n", e.MessageID)
+		}
+		if e.LastError != "" {
+			fmt.Printf("    %sLast error: %s%s\n", Dim, e.LastError, Reset)
+		}
+	}
+	return 0
+}
+
+func queueRetry(m *mailer.Mailer, ob *outbox.Outbox, args []string) int {
+	fs := flag.NewFlagSet("queue retry", flag.ContinueOnError)
+	all := fs.Bool("all", false, "retry every queued and dead message")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	id := fs.Arg(0)
+	if id == "" && !*all {
+		fmt.Fprintln(os.Stderr, "Usage: gomail queue retry [ID | --all]")
+		return 2
+	}
+	if !m.IsConfigured() {
+		fmt.Fprintln(os.Stderr, "Credentials not configured. Run 'gomail cli' and use Configure Credentials, or edit .env.")
+		return 1
+	}
+
+	if err := ob.Retry(id); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	delivered, failed, err := ob.ProcessDue(ctx, mailer.TransportFunc(m.Deliver))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("\n  %d delivered, %d failed\n", delivered, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func queueReschedule(ob *outbox.Outbox, args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "Usage: gomail queue reschedule ID TIME")
+		return 2
+	}
+	at, err := mailer.ParseSendAt(strings.Join(args[1:], " "), time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if err := ob.Reschedule(args[0], at); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("  %s will be sent at %s\n", args[0], at.Format("2006-01-02 15:04:05"))
+	return 0
+}
+
+func queuePurge(ob *outbox.Outbox, args []string) int {
+	fs := flag.NewFlagSet("queue purge", flag.ContinueOnError)
+	dead := fs.Bool("dead", false, "remove every dead-letter message")
+	all := fs.Bool("all", false, "remove every message")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	id := fs.Arg(0)
+	if id == "" && !*dead && !*all {
+		fmt.Fprintln(os.Stderr, "Usage: gomail queue purge [ID | --dead | --all]")
+		return 2
+	}
+
+	status := ""
+	if *dead {
+		status = outbox.StatusDead
+	}
+	removed, err := ob.Purge(id, status)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("  %d message(s) removed\n", removed)
+	return 0
+}
@@ -0,0 +1,240 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+// Exit codes of the non-interactive commands. The codes for temporary and
+// configuration errors come from sysexits.h, as sendmail uses them.
+const (
+	ExitOK         = 0
+	ExitPermanent  = 1  // the server rejected the message
+	ExitValidation = 2  // invalid flags, addresses or files
+	ExitTemporary  = 75 // delivery failed but may succeed later
+	ExitConfig     = 78 // gomail is not configured
+)
+
+// stringList is a flag that may be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// sendResult is printed by "gomail send --json"
+type sendResult struct {
+	Status     string   `json:"status"`
+	MessageID  string   `json:"message_id,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	ExitCode   int      `json:"exit_code"`
+}
+
+// RunSend runs the non-interactive "gomail send" command and returns the
+// process exit code
+func RunSend(m *mailer.Mailer, args []string) int {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	var to, cc, bcc, attach, headers stringList
+	fs.Var(&to, "to", "recipient addresses, comma-separated (repeatable)")
+	fs.Var(&cc, "cc", "CC addresses, comma-separated (repeatable)")
+	fs.Var(&bcc, "bcc", "BCC addresses, comma-separated (repeatable)")
+	subject := fs.String("subject", "", "subject line")
+	body := fs.String("body", "", "message body")
+	bodyFile := fs.String("body-file", "", "read the message body from a file (- for stdin)")
+	html := fs.Bool("html", false, "send the body as HTML with a generated plain-text part")
+	fs.Var(&attach, "attach", "file to attach (repeatable)")
+	fs.Var(&headers, "header", `extra header as "Name: value" (repeatable)`)
+	noQueue := fs.Bool("no-queue", false, "exit with a temporary failure instead of queueing the message for retry")
+	queueOK := fs.Bool("queue-ok", false, "exit with 0 when the message was queued for retry instead of sent")
+	jsonOut := fs.Bool("json", false, "print the result as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gomail send --to ADDRESS --subject TEXT [--body TEXT | --body-file FILE] [options]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "The body is read from standard input when it is piped and neither --body nor")
+		fmt.Fprintln(fs.Output(), "--body-file is given.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Exit codes: 0 sent, 1 rejected, 2 invalid input, 75 queued for retry or")
+		fmt.Fprintln(fs.Output(), "temporary failure, 78 configuration error. A queued message exits with 0 when")
+		fmt.Fprintln(fs.Output(), "--queue-ok is given.")
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return ExitOK
+		}
+		return ExitValidation
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected argument: %s\n", fs.Arg(0))
+		fs.Usage()
+		return ExitValidation
+	}
+
+	report := func(result sendResult) int {
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.SetEscapeHTML(false)
+			enc.Encode(result)
+			return result.ExitCode
+		}
+		switch result.Status {
+		case "sent":
+			fmt.Printf("Sent %s\n", result.MessageID)
+		case "queued":
+			fmt.Printf("Queued %s for retry: %s\n", result.MessageID, result.Error)
+		default:
+			fmt.Fprintf(os.Stderr, "Error: %s\n", result.Error)
+		}
+		return result.ExitCode
+	}
+	fail := func(code int, err error) int {
+		return report(sendResult{Status: "failed", Error: err.Error(), ExitCode: code})
+	}
+
+	if !m.IsConfigured() {
+		return fail(ExitConfig, fmt.Errorf("credentials not configured; set EMAIL_FROM and EMAIL_PASSWORD in .env"))
+	}
+
+	msg, err := buildSendMessage(to, cc, bcc, attach, headers)
+	if err != nil {
+		return fail(ExitValidation, err)
+	}
+	msg.Subject = *subject
+
+	text, err := readBody(*body, *bodyFile)
+	if err != nil {
+		return fail(ExitValidation, err)
+	}
+	if *html {
+		msg.HTML = text
+	} else {
+		msg.Text = text
+	}
+
+	if *noQueue {
+		m.SetSpooler(nil)
+	}
+	recipients, _ := msg.Recipients()
+	id, err := m.Send(context.Background(), msg)
+	switch {
+	case err == nil:
+		return report(sendResult{Status: "sent", MessageID: id, Recipients: recipients, ExitCode: ExitOK})
+	case errors.Is(err, mailer.ErrQueued):
+		// The message has not been delivered yet, so callers must opt in to
+		// treating that as success
+		code := ExitTemporary
+		if *queueOK {
+			code = ExitOK
+		}
+		return report(sendResult{Status: "queued", MessageID: id, Recipients: recipients, Error: err.Error(), ExitCode: code})
+	case mailer.IsTemporary(err) || mailer.IsRateLimited(err):
+		return fail(ExitTemporary, err)
+	default:
+		return fail(ExitPermanent, err)
+	}
+}
+
+// buildSendMessage checks the addresses, attachments and headers given on
+// the command line and builds a message from them
+func buildSendMessage(to, cc, bcc, attach, headers stringList) (*mailer.Message, error) {
+	msg := &mailer.Message{}
+	var err error
+	if msg.To, err = parseAddressFlags(to); err != nil {
+		return nil, fmt.Errorf("invalid --to: %v", err)
+	}
+	if msg.Cc, err = parseAddressFlags(cc); err != nil {
+		return nil, fmt.Errorf("invalid --cc: %v", err)
+	}
+	if msg.Bcc, err = parseAddressFlags(bcc); err != nil {
+		return nil, fmt.Errorf("invalid --bcc: %v", err)
+	}
+	if len(msg.To)+len(msg.Cc)+len(msg.Bcc) == 0 {
+		return nil, fmt.Errorf("no recipients: pass --to, --cc or --bcc")
+	}
+
+	for _, path := range attach {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --attach: %v", err)
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("invalid --attach: %s is a directory", path)
+		}
+		msg.Attach(path)
+	}
+
+	for _, line := range headers {
+		name, value, err := mailer.ParseHeaderField(line)
+		if err != nil {
+			return nil, err
+		}
+		if mailer.IsReservedHeader(name) {
+			return nil, fmt.Errorf("header %s cannot be set with --header", name)
+		}
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers[name] = value
+	}
+	return msg, nil
+}
+
+func parseAddressFlags(values stringList) ([]string, error) {
+	var list []string
+	for _, v := range values {
+		addrs, err := mailer.ParseAddressList(v)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, addrs...)
+	}
+	return list, nil
+}
+
+// readBody returns the body from --body or --body-file, or from standard
+// input when it is not a terminal
+func readBody(body, bodyFile string) (string, error) {
+	if body != "" && bodyFile != "" {
+		return "", fmt.Errorf("use either --body or --body-file, not both")
+	}
+	switch {
+	case body != "":
+		return body, nil
+	case bodyFile == "-":
+		return readStdin()
+	case bodyFile != "":
+		data, err := os.ReadFile(bodyFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading body: %v", err)
+		}
+		return string(data), nil
+	}
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice == 0 {
+		return readStdin()
+	}
+	return "", nil
+}
+
+func readStdin() (string, error) {
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("error reading body from stdin: %v", err)
+	}
+	return string(data), nil
+}
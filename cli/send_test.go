@@ -0,0 +1,217 @@
+package cli
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pranavKharche24/mail/mailer"
+	"github.com/pranavKharche24/mail/mailtest"
+	"github.com/pranavKharche24/mail/outbox"
+)
+
+// redirect points *f at a temporary file for the test and returns a
+// function reading what was written to it
+func redirect(t *testing.T, f **os.File, input string) func() string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stdio")
+	if err := os.WriteFile(path, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := *f
+	*f = file
+	t.Cleanup(func() {
+		*f = old
+		file.Close()
+	})
+	return func() string {
+		data, _ := os.ReadFile(path)
+		return string(data)
+	}
+}
+
+// run calls fn with input on stdin and returns its exit code and output
+func run(t *testing.T, input string, fn func() int) (int, string) {
+	t.Helper()
+	redirect(t, &os.Stdin, input)
+	stdout := redirect(t, &os.Stdout, "")
+	stderr := redirect(t, &os.Stderr, "")
+	code := fn()
+	return code, stdout() + stderr()
+}
+
+func TestRunSendExitCodes(t *testing.T) {
+	attachment := filepath.Join(t.TempDir(), "report.txt")
+	if err := os.WriteFile(attachment, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	send := []string{"--to", "bob@example.com", "--subject", "Hi", "--body", "Hello"}
+
+	tests := []struct {
+		name         string
+		args         []string
+		unconfigured bool
+		queue        bool
+		limit        bool
+		failure      *mailtest.Failure
+		want         int
+	}{
+		{name: "sent", args: send, want: ExitOK},
+		{name: "attachment", args: append([]string{"--attach", attachment}, send...), want: ExitOK},
+		{name: "help", args: []string{"-h"}, want: ExitOK},
+		{name: "unknown flag", args: append([]string{"--urgent"}, send...), want: ExitValidation},
+		{name: "argument", args: append(send, "extra"), want: ExitValidation},
+		{name: "invalid address", args: []string{"--to", "bob@", "--body", "x"}, want: ExitValidation},
+		{name: "no recipients", args: []string{"--subject", "Hi", "--body", "x"}, want: ExitValidation},
+		{name: "missing attachment", args: append([]string{"--attach", attachment + ".missing"}, send...), want: ExitValidation},
+		{name: "directory attached", args: append([]string{"--attach", filepath.Dir(attachment)}, send...), want: ExitValidation},
+		{name: "two bodies", args: append([]string{"--body-file", attachment}, send...), want: ExitValidation},
+		{name: "reserved header", args: append([]string{"--header", "Bcc: eve@example.com"}, send...), want: ExitValidation},
+		{name: "not configured", args: send, unconfigured: true, want: ExitConfig},
+		{name: "rejected", args: send, failure: &mailtest.Failure{Command: "EOM", Code: 554, Message: "5.7.1 Rejected"}, want: ExitPermanent},
+		{name: "rejected with outbox", args: send, queue: true, failure: &mailtest.Failure{Command: "RCPT", Code: 550, Message: "5.1.1 No such user"}, want: ExitPermanent},
+		{name: "temporary failure", args: send, failure: &mailtest.Failure{Command: "MAIL", Code: 451, Message: "4.3.0 Try later"}, want: ExitTemporary},
+		{name: "queued", args: send, queue: true, failure: &mailtest.Failure{Command: "MAIL", Code: 451, Message: "4.3.0 Try later"}, want: ExitTemporary},
+		{name: "queued with --queue-ok", args: append([]string{"--queue-ok"}, send...), queue: true, failure: &mailtest.Failure{Command: "MAIL", Code: 451, Message: "4.3.0 Try later"}, want: ExitOK},
+		{name: "--no-queue", args: append([]string{"--no-queue", "--queue-ok"}, send...), queue: true, failure: &mailtest.Failure{Command: "MAIL", Code: 451, Message: "4.3.0 Try later"}, want: ExitTemporary},
+		{name: "server down", args: send, failure: &mailtest.Failure{Command: "CONNECT", Code: 421, Message: "4.3.2 Shutting down"}, want: ExitTemporary},
+		{name: "rate limited", args: send, limit: true, want: ExitTemporary},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := mailtest.NewServer()
+			defer srv.Close()
+			m := srv.Mailer()
+			if tt.unconfigured {
+				m.SetCredentials("", "")
+			}
+			var ob *outbox.Outbox
+			if tt.queue {
+				var err error
+				if ob, err = outbox.Open(t.TempDir()); err != nil {
+					t.Fatal(err)
+				}
+				m.SetSpooler(ob)
+			}
+			if tt.limit {
+				m.SetRateLimit(mailer.RateLimit{PerMinute: 1})
+				m.SendPlain([]string{"bob@example.com"}, "First", "x", nil, nil, nil)
+				srv.Reset()
+			}
+			if tt.failure != nil {
+				srv.Fail(*tt.failure)
+			}
+
+			code, out := run(t, "", func() int { return RunSend(m, tt.args) })
+			if code != tt.want {
+				t.Errorf("exit code %d, want %d; output:\n%s", code, tt.want, out)
+			}
+			sent := 0
+			if tt.want == ExitOK && tt.failure == nil && tt.args[0] != "-h" {
+				sent = 1
+			}
+			srv.AssertCount(t, sent)
+
+			queued := 0
+			if ob != nil {
+				entries, err := ob.List()
+				if err != nil {
+					t.Fatal(err)
+				}
+				queued = len(entries)
+			}
+			if wantQueued := strings.HasPrefix(tt.name, "queued"); (queued == 1) != wantQueued {
+				t.Errorf("%d messages queued", queued)
+			}
+		})
+	}
+}
+
+func TestRunSendJSON(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	m := srv.Mailer()
+	ob, err := outbox.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetSpooler(ob)
+
+	tests := []struct {
+		args    []string
+		failure *mailtest.Failure
+		want    sendResult
+	}{
+		{
+			args: []string{"--to", "bob@example.com", "--bcc", "carol@example.com"},
+			want: sendResult{Status: "sent", Recipients: []string{"bob@example.com", "carol@example.com"}, ExitCode: ExitOK},
+		},
+		{
+			args:    []string{"--to", "bob@example.com", "--queue-ok"},
+			failure: &mailtest.Failure{Command: "MAIL", Code: 451, Message: "4.3.0 Try later", Times: 1},
+			want:    sendResult{Status: "queued", Recipients: []string{"bob@example.com"}, ExitCode: ExitOK},
+		},
+		{
+			args:    []string{"--to", "bob@example.com"},
+			failure: &mailtest.Failure{Command: "EOM", Code: 554, Message: "5.7.1 Rejected", Times: 1},
+			want:    sendResult{Status: "failed", ExitCode: ExitPermanent},
+		},
+		{
+			args: []string{"--to", "bob@"},
+			want: sendResult{Status: "failed", ExitCode: ExitValidation},
+		},
+	}
+	for _, tt := range tests {
+		if tt.failure != nil {
+			srv.Fail(*tt.failure)
+		}
+		args := append([]string{"--json", "--subject", "Hi", "--body", "x"}, tt.args...)
+		code, out := run(t, "", func() int { return RunSend(m, args) })
+
+		var got sendResult
+		if err := json.Unmarshal([]byte(out), &got); err != nil {
+			t.Fatalf("%v: output is not JSON: %v\n%s", tt.args, err, out)
+		}
+		if got.Status != tt.want.Status || got.ExitCode != tt.want.ExitCode || code != got.ExitCode ||
+			strings.Join(got.Recipients, ",") != strings.Join(tt.want.Recipients, ",") {
+			t.Errorf("%v: exit code %d, result %+v", tt.args, code, got)
+		}
+		if (got.Status == "failed") != (got.MessageID == "") || (got.Status == "sent") != (got.Error == "") {
+			t.Errorf("%v: result %+v", tt.args, got)
+		}
+	}
+}
+
+func TestRunSendBody(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	bodyFile := filepath.Join(t.TempDir(), "body.txt")
+	if err := os.WriteFile(bodyFile, []byte("From a file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args  []string
+		stdin string
+		want  string
+	}{
+		{[]string{"--body", "From the flag"}, "ignored", "From the flag"},
+		{[]string{"--body-file", bodyFile}, "ignored", "From a file"},
+		{[]string{"--body-file", "-"}, "From stdin", "From stdin"},
+		{nil, "Piped in", "Piped in"},
+	}
+	for _, tt := range tests {
+		srv.Reset()
+		args := append([]string{"--to", "bob@example.com", "--subject", "Body"}, tt.args...)
+		if code, out := run(t, tt.stdin, func() int { return RunSend(srv.Mailer(), args) }); code != ExitOK {
+			t.Fatalf("%v: exit code %d\n%s", tt.args, code, out)
+		}
+		srv.LastMessage(t).AssertTextContains(t, tt.want)
+	}
+}
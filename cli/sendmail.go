@@ -0,0 +1,207 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/pranavKharche24/mail/config"
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+// Further sysexits.h codes, which programs calling sendmail expect
+const (
+	exitUsage       = 64
+	exitDataErr     = 65
+	exitUnavailable = 69
+)
+
+// sendmailOptions are the command line options understood in sendmail mode
+type sendmailOptions struct {
+	from       string
+	fullName   string
+	extract    bool
+	ignoreDots bool
+	verbose    bool
+	recipients []string
+}
+
+// RunSendmail runs gomail as a drop-in sendmail: it reads a complete message
+// from standard input and sends it to the recipients given as arguments, or
+// listed in its header with -t, and returns the process exit code
+func RunSendmail(m *mailer.Mailer, args []string) int {
+	opts, err := parseSendmailArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return exitUsage
+	}
+	if !m.IsConfigured() {
+		fmt.Fprintln(os.Stderr, "sendmail: credentials not configured; set EMAIL_FROM and EMAIL_PASSWORD in .env or "+config.SystemEnvFile)
+		return ExitConfig
+	}
+
+	var input io.Reader = os.Stdin
+	if !opts.ignoreDots {
+		if input, err = readUntilDot(os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "sendmail: error reading message: %v\n", err)
+			return exitDataErr
+		}
+	}
+	msg, err := mailer.ReadRawMessage(input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return exitDataErr
+	}
+
+	var rcpts []string
+	for _, arg := range opts.recipients {
+		addrs, err := mailer.ParseAddressList(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+			return exitUsage
+		}
+		rcpts = append(rcpts, addrs...)
+	}
+	if opts.extract {
+		addrs, err := msg.Recipients()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+			return exitDataErr
+		}
+		rcpts = append(rcpts, addrs...)
+	}
+	if len(rcpts) == 0 {
+		fmt.Fprintln(os.Stderr, "sendmail: no recipients: pass addresses as arguments or use -t")
+		return exitUsage
+	}
+
+	sender, _ := m.GetCredentials()
+	envelopeFrom := ""
+	if strings.Contains(opts.from, "@") {
+		envelopeFrom = opts.from
+	} else {
+		opts.from = sender
+	}
+	setSendmailFrom(msg, opts)
+
+	id, err := m.SendRaw(context.Background(), envelopeFrom, rcpts, msg)
+	switch {
+	case err == nil:
+		if opts.verbose {
+			fmt.Fprintf(os.Stderr, "sendmail: sent %s\n", id)
+		}
+		return ExitOK
+	case errors.Is(err, mailer.ErrQueued):
+		if opts.verbose {
+			fmt.Fprintf(os.Stderr, "sendmail: queued %s: %v\n", id, err)
+		}
+		return ExitOK
+	case mailer.IsTemporary(err) || mailer.IsRateLimited(err):
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return ExitTemporary
+	default:
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return exitUnavailable
+	}
+}
+
+// parseSendmailArgs parses the options of sendmail(8). Options that only
+// matter to a real MTA, such as -oem or -B8BITMIME, are accepted and
+// ignored so that existing callers keep working.
+func parseSendmailArgs(args []string) (sendmailOptions, error) {
+	var opts sendmailOptions
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			opts.recipients = append(opts.recipients, args[i+1:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			opts.recipients = append(opts.recipients, arg)
+			continue
+		}
+
+		flag, value := arg[1], arg[2:]
+		switch flag {
+		case 'f', 'r', 'F', 'o', 'A', 'B', 'C', 'L', 'N', 'O', 'R', 'V', 'X', 'h':
+			if value == "" {
+				if i+1 >= len(args) {
+					return opts, fmt.Errorf("option -%c needs a value", flag)
+				}
+				i++
+				value = args[i]
+			}
+			switch {
+			case flag == 'f' || flag == 'r':
+				opts.from = value
+			case flag == 'F':
+				opts.fullName = value
+			case flag == 'o' && value == "i":
+				opts.ignoreDots = true
+			}
+		case 'b':
+			if value != "m" {
+				return opts, fmt.Errorf("mode -b%s is not supported", value)
+			}
+		case 'q':
+			return opts, fmt.Errorf("queue runs are not supported; use 'gomail queue retry --all'")
+		default:
+			// Flags without a value, which may be combined as in -ti
+			for _, c := range arg[1:] {
+				switch c {
+				case 't':
+					opts.extract = true
+				case 'i':
+					opts.ignoreDots = true
+				case 'v':
+					opts.verbose = true
+				}
+			}
+		}
+	}
+	return opts, nil
+}
+
+// readUntilDot reads r up to a line holding a single dot, which ends the
+// message in sendmail unless -i or -oi is given
+func readUntilDot(r io.Reader) (io.Reader, error) {
+	var buf bytes.Buffer
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "." {
+			break
+		}
+		buf.WriteString(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &buf, nil
+}
+
+// setSendmailFrom fills in the From field from -f and -F. Local senders
+// such as "root" written by cron are replaced as well, since relays reject
+// addresses without a domain.
+func setSendmailFrom(msg *mailer.RawMessage, opts sendmailOptions) {
+	if from := msg.Get("From"); from != "" {
+		if addr, err := mail.ParseAddress(from); err == nil && strings.Contains(addr.Address, "@") {
+			return
+		}
+	}
+	addr := mail.Address{Name: opts.fullName, Address: opts.from}
+	if addr.Name == "" {
+		msg.Set("From", addr.Address)
+		return
+	}
+	msg.Set("From", addr.String())
+}
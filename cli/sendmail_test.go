@@ -0,0 +1,161 @@
+package cli
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pranavKharche24/mail/mailer"
+	"github.com/pranavKharche24/mail/mailtest"
+	"github.com/pranavKharche24/mail/outbox"
+)
+
+const cronMessage = "From: root\r\nTo: admin@example.com\r\nSubject: Cron output\r\n\r\nDisk full\r\n"
+
+func TestRunSendmailExitCodes(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		input        string
+		unconfigured bool
+		queue        bool
+		limit        bool
+		failure      *mailtest.Failure
+		want         int
+		sent         int
+	}{
+		{name: "sent", args: []string{"bob@example.com"}, input: cronMessage, want: ExitOK, sent: 1},
+		{name: "extract", args: []string{"-t", "-i"}, input: cronMessage, want: ExitOK, sent: 1},
+		{name: "no recipients", args: []string{"-i"}, input: cronMessage, want: exitUsage},
+		{name: "invalid recipient", args: []string{"bob@"}, input: cronMessage, want: exitUsage},
+		{name: "missing value", args: []string{"bob@example.com", "-f"}, input: cronMessage, want: exitUsage},
+		{name: "daemon mode", args: []string{"-bd"}, want: exitUsage},
+		{name: "queue run", args: []string{"-q"}, want: exitUsage},
+		{name: "invalid header", args: []string{"bob@example.com"}, input: "not a header\r\n\r\nx\r\n", want: exitDataErr},
+		{name: "invalid To with -t", args: []string{"-t"}, input: "To: bob@\r\n\r\nx\r\n", want: exitDataErr},
+		{name: "not configured", args: []string{"bob@example.com"}, input: cronMessage, unconfigured: true, want: ExitConfig},
+		{name: "rejected", args: []string{"bob@example.com"}, input: cronMessage, failure: &mailtest.Failure{Command: "EOM", Code: 554, Message: "5.7.1 Rejected"}, want: exitUnavailable},
+		{name: "temporary failure", args: []string{"bob@example.com"}, input: cronMessage, failure: &mailtest.Failure{Command: "RCPT", Code: 450, Message: "4.2.1 Busy"}, want: ExitTemporary},
+		// Queued mail has been accepted for delivery, as a real MTA would
+		{name: "queued", args: []string{"bob@example.com"}, input: cronMessage, queue: true, failure: &mailtest.Failure{Command: "RCPT", Code: 450, Message: "4.2.1 Busy"}, want: ExitOK},
+		{name: "rate limited", args: []string{"bob@example.com"}, input: cronMessage, queue: true, limit: true, want: ExitTemporary},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := mailtest.NewServer()
+			defer srv.Close()
+			m := srv.Mailer()
+			if tt.unconfigured {
+				m.SetCredentials("", "")
+			}
+			var ob *outbox.Outbox
+			if tt.queue {
+				var err error
+				if ob, err = outbox.Open(t.TempDir()); err != nil {
+					t.Fatal(err)
+				}
+				m.SetSpooler(ob)
+			}
+			if tt.limit {
+				m.SetRateLimit(mailer.RateLimit{PerMinute: 1})
+				m.SendPlain([]string{"bob@example.com"}, "First", "x", nil, nil, nil)
+				srv.Reset()
+			}
+			if tt.failure != nil {
+				srv.Fail(*tt.failure)
+			}
+
+			code, out := run(t, tt.input, func() int { return RunSendmail(m, tt.args) })
+			if code != tt.want {
+				t.Errorf("exit code %d, want %d; output:\n%s", code, tt.want, out)
+			}
+			srv.AssertCount(t, tt.sent)
+			if ob != nil {
+				entries, _ := ob.List()
+				if queued := len(entries) == 1; queued != (tt.name == "queued") {
+					t.Errorf("%d messages queued", len(entries))
+				}
+			}
+		})
+	}
+}
+
+func TestRunSendmailEnvelope(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+
+	tests := []struct {
+		args  []string
+		input string
+		from  string
+		rcpts []string
+		head  string
+		text  string
+	}{
+		{
+			// A local sender is replaced by the configured account
+			args: []string{"bob@example.com"}, input: cronMessage,
+			from: "sender@example.com", rcpts: []string{"bob@example.com"},
+			head: "sender@example.com", text: "Disk full",
+		},
+		{
+			args: []string{"-f", "alerts@example.com", "-F", "Alerts", "-t"}, input: cronMessage,
+			from: "alerts@example.com", rcpts: []string{"admin@example.com"},
+			head: `"Alerts" <alerts@example.com>`, text: "Disk full",
+		},
+		{
+			args: []string{"-ti", "--", "-odd@example.com"}, input: "From: Ops <ops@example.com>\r\nTo: a@example.com\r\nBcc: b@example.com\r\n\r\nx\r\n",
+			from: "sender@example.com", rcpts: []string{"-odd@example.com", "a@example.com", "b@example.com"},
+			head: "Ops <ops@example.com>", text: "x",
+		},
+		{
+			// Without -i a line holding a single dot ends the message
+			args: []string{"bob@example.com"}, input: cronMessage + ".\r\nNot part of it\r\n",
+			from: "sender@example.com", rcpts: []string{"bob@example.com"},
+			head: "sender@example.com", text: "Disk full",
+		},
+		{
+			args: []string{"-oi", "bob@example.com"}, input: cronMessage + ".\r\nStill part of it\r\n",
+			from: "sender@example.com", rcpts: []string{"bob@example.com"},
+			head: "sender@example.com", text: "Still part of it",
+		},
+	}
+	for _, tt := range tests {
+		srv.Reset()
+		if code, out := run(t, tt.input, func() int { return RunSendmail(srv.Mailer(), tt.args) }); code != ExitOK {
+			t.Fatalf("%v: exit code %d\n%s", tt.args, code, out)
+		}
+		msg := srv.LastMessage(t)
+		msg.AssertFrom(t, tt.from)
+		msg.AssertRecipients(t, tt.rcpts...)
+		msg.AssertHeader(t, "From", tt.head)
+		msg.AssertNoHeader(t, "Bcc")
+		msg.AssertTextContains(t, tt.text)
+		if strings.Contains(tt.input, "Not part") && strings.Contains(msg.Text, "Not part") {
+			t.Errorf("%v: text after the dot was sent", tt.args)
+		}
+	}
+}
+
+func TestParseSendmailArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want sendmailOptions
+	}{
+		{[]string{"-oi", "-oem", "-B8BITMIME", "bob@example.com"}, sendmailOptions{ignoreDots: true, recipients: []string{"bob@example.com"}}},
+		{[]string{"-tiv", "-bm"}, sendmailOptions{extract: true, ignoreDots: true, verbose: true}},
+		{[]string{"-falice@example.com", "-F", "Alice", "bob"}, sendmailOptions{from: "alice@example.com", fullName: "Alice", recipients: []string{"bob"}}},
+		{[]string{"-r", "alice@example.com", "--", "-t"}, sendmailOptions{from: "alice@example.com", recipients: []string{"-t"}}},
+		{[]string{"-o", "i", "-"}, sendmailOptions{ignoreDots: true, recipients: []string{"-"}}},
+	}
+	for _, tt := range tests {
+		got, err := parseSendmailArgs(tt.args)
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package config
 
 import (
 	"bufio"
+	"fmt"
 	"os"
+	"sort"
 	"strings"
 )
 
@@ -11,22 +13,229 @@ type Config struct {
 	EmailFrom     string
 	EmailPassword string
 	Port          string
+
+	// SMTP server settings
+	SMTPHost string
+	SMTPPort string
+	SMTPTLS  string
+
+	// SMTP login: mechanism (auto, plain, login, cram-md5 or xoauth2) and
+	// an OAuth2 access token, or a command that prints a fresh one
+	SMTPAuth          string
+	SMTPOAuthToken    string
+	SMTPOAuthTokenCmd string
+
+	// SMTP connection pool: connections kept open and their idle timeout
+	SMTPPoolSize    string
+	SMTPIdleTimeout string
+
+	// SMTP timeouts: connecting and logging in, and each command
+	SMTPTimeout        string
+	SMTPCommandTimeout string
+
+	// Delivery transport: smtp, sendmail, file or memory
+	Transport    string
+	SendmailPath string
+	DropDir      string
+
+	// DKIM signing: enabled when DKIMKeyPath is set. The domain defaults to
+	// that of EmailFrom.
+	DKIMDomain   string
+	DKIMSelector string
+	DKIMKeyPath  string
+
+	// PGP/MIME: armored keyring with recipients' public keys and the
+	// sender's secret key, and the passphrase protecting the secret key
+	PGPKeyring    string
+	PGPPassphrase string
+
+	// S/MIME signing: enabled when both the certificate and key are set
+	SMIMECert string
+	SMIMEKey  string
+
+	// SMTP relay for other programs: listen address, user:password pairs,
+	// allowed client networks, STARTTLS certificate and message size limit
+	// in megabytes
+	RelayAddr     string
+	RelayUsers    string
+	RelayNetworks string
+	RelayTLSCert  string
+	RelayTLSKey   string
+	RelayMaxSize  string
+
+	// Mail catcher for local testing: SMTP listen address and an optional
+	// directory that keeps captured mail across restarts
+	CatcherAddr string
+	CatcherDir  string
+
+	// DataDir holds persistent state such as the outbox
+	DataDir string
+	// SendmailDataDir is DataDir for sendmail mode, which is called from
+	// arbitrary working directories and so defaults to SystemDataDir
+	SendmailDataDir string
+
+	// Rate limits for outgoing mail; empty or 0 means unlimited
+	RatePerSecond string
+	RatePerMinute string
+	RatePerDay    string
+	MaxConcurrent string
+	// RateLimitMode is "wait" to block senders or "fail" to reject them
+	RateLimitMode string
 }
 
-// Load reads configuration from environment variables and .env file
+// SystemEnvFile holds settings for programs that run gomail as sendmail
+// from outside the directory with the .env file, such as cron. It is only
+// read in sendmail mode and must not be accessible to all users.
+const SystemEnvFile = "/etc/gomail.env"
+
+// SystemDataDir is the data directory in sendmail mode when DATA_DIR is
+// not set
+const SystemDataDir = "/var/lib/gomail"
+
+// Load reads configuration from environment variables and the .env file,
+// in that order of precedence
 func Load() *Config {
 	// Load .env file if it exists
 	loadEnvFile(".env")
+	return fromEnv()
+}
+
+// LoadSendmail is Load for sendmail mode, which also reads SystemEnvFile
+// with the lowest precedence. It fails if that file is readable or
+// writable by all users, as it holds the account's credentials.
+func LoadSendmail() (*Config, error) {
+	return loadWithSystemFile(SystemEnvFile)
+}
+
+func loadWithSystemFile(path string) (*Config, error) {
+	loadEnvFile(".env")
+	if err := checkPrivate(path); err != nil {
+		return nil, err
+	}
+	loadEnvFile(path)
+	return fromEnv(), nil
+}
+
+// checkPrivate returns an error if the file at path exists and other users
+// may read or change it
+func checkPrivate(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil // the file is optional
+	}
+	if info.Mode().Perm()&0006 != 0 {
+		return fmt.Errorf("%s is accessible to all users (mode %04o); restrict it with chmod o-rwx", path, info.Mode().Perm())
+	}
+	return nil
+}
+
+// fromEnv builds the configuration from the environment
+func fromEnv() *Config {
+	tlsMode := strings.ToLower(getEnv("SMTP_TLS", "starttls"))
+	emailFrom := getEnv("EMAIL_FROM", "")
 
 	cfg := &Config{
-		EmailFrom:     getEnv("EMAIL_FROM", ""),
-		EmailPassword: getEnv("EMAIL_PASSWORD", ""),
-		Port:          getEnv("PORT", "8080"),
+		EmailFrom:          emailFrom,
+		EmailPassword:      getEnv("EMAIL_PASSWORD", ""),
+		Port:               getEnv("PORT", "8080"),
+		SMTPHost:           getEnv("SMTP_HOST", "smtp.gmail.com"),
+		SMTPPort:           getEnv("SMTP_PORT", DefaultSMTPPort(tlsMode)),
+		SMTPTLS:            tlsMode,
+		SMTPAuth:           strings.ToLower(getEnv("SMTP_AUTH", "auto")),
+		SMTPOAuthToken:     getEnv("SMTP_OAUTH_TOKEN", ""),
+		SMTPOAuthTokenCmd:  getEnv("SMTP_OAUTH_TOKEN_CMD", ""),
+		SMTPPoolSize:       getEnv("SMTP_POOL_SIZE", "2"),
+		SMTPIdleTimeout:    getEnv("SMTP_IDLE_TIMEOUT", "30s"),
+		SMTPTimeout:        getEnv("SMTP_TIMEOUT", "30s"),
+		SMTPCommandTimeout: getEnv("SMTP_COMMAND_TIMEOUT", "60s"),
+		Transport:          strings.ToLower(getEnv("MAIL_TRANSPORT", "smtp")),
+		SendmailPath:       getEnv("SENDMAIL_PATH", "/usr/sbin/sendmail"),
+		DropDir:            getEnv("MAIL_DROP_DIR", "maildrop"),
+		DKIMDomain:         getEnv("DKIM_DOMAIN", domainOf(emailFrom)),
+		DKIMSelector:       getEnv("DKIM_SELECTOR", "gomail"),
+		DKIMKeyPath:        getEnv("DKIM_KEY_PATH", ""),
+		PGPKeyring:         getEnv("PGP_KEYRING", ""),
+		PGPPassphrase:      getEnv("PGP_PASSPHRASE", ""),
+		SMIMECert:          getEnv("SMIME_CERT", ""),
+		SMIMEKey:           getEnv("SMIME_KEY", ""),
+		RelayAddr:          getEnv("RELAY_ADDR", ""),
+		RelayUsers:         getEnv("RELAY_USERS", ""),
+		RelayNetworks:      getEnv("RELAY_NETWORKS", "127.0.0.0/8,::1"),
+		RelayTLSCert:       getEnv("RELAY_TLS_CERT", ""),
+		RelayTLSKey:        getEnv("RELAY_TLS_KEY", ""),
+		RelayMaxSize:       getEnv("RELAY_MAX_SIZE_MB", "25"),
+		CatcherAddr:        getEnv("CATCHER_ADDR", "localhost:1025"),
+		CatcherDir:         getEnv("CATCHER_DIR", ""),
+		DataDir:            getEnv("DATA_DIR", "data"),
+		SendmailDataDir:    getEnv("DATA_DIR", SystemDataDir),
+		RatePerSecond:      getEnv("RATE_PER_SECOND", ""),
+		RatePerMinute:      getEnv("RATE_PER_MINUTE", ""),
+		RatePerDay:         getEnv("RATE_PER_DAY", ""),
+		MaxConcurrent:      getEnv("MAX_CONCURRENT_SENDS", ""),
+		RateLimitMode:      strings.ToLower(getEnv("RATE_LIMIT_MODE", "wait")),
 	}
 
 	return cfg
 }
 
+// DefaultSMTPPort returns the conventional port for a TLS mode
+func DefaultSMTPPort(tlsMode string) string {
+	switch tlsMode {
+	case "implicit":
+		return "465"
+	case "none":
+		return "25"
+	default:
+		return "587"
+	}
+}
+
+// domainOf returns the domain part of an email address
+func domainOf(email string) string {
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return strings.TrimSuffix(email[i+1:], ">")
+	}
+	return ""
+}
+
+// SaveEnv writes the given keys to a .env file, updating existing entries
+// in place and keeping any other lines untouched
+func SaveEnv(filename string, values map[string]string) error {
+	var lines []string
+	if data, err := os.ReadFile(filename); err == nil {
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	} else {
+		lines = []string{"# Gomail Configuration"}
+	}
+
+	written := make(map[string]bool)
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		parts := strings.SplitN(trimmed, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if value, ok := values[key]; ok {
+			lines[i] = fmt.Sprintf("%s=%s", key, value)
+			written[key] = true
+		}
+	}
+
+	var missing []string
+	for key := range values {
+		if !written[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	for _, key := range missing {
+		lines = append(lines, fmt.Sprintf("%s=%s", key, values[key]))
+	}
+
+	return os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
 // loadEnvFile reads a .env file and sets environment variables
 func loadEnvFile(filename string) {
 	file, err := os.Open(filename)
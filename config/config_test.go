@@ -0,0 +1,202 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// clearEnv unsets keys for the test, restoring them afterwards
+func clearEnv(t *testing.T, keys ...string) {
+	for _, key := range keys {
+		t.Setenv(key, "")
+	}
+}
+
+// chdir changes the working directory for the test, where .env is read
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func writeEnvFile(t *testing.T, mode os.FileMode, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gomail.env")
+	if err := os.WriteFile(path, []byte(data), mode); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile is subject to the umask
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadIgnoresSystemFile(t *testing.T) {
+	clearEnv(t, "EMAIL_FROM", "SMTP_HOST")
+	chdir(t, t.TempDir())
+
+	cfg := Load()
+	if cfg.EmailFrom != "" || cfg.SMTPHost != "smtp.gmail.com" {
+		t.Errorf("Load picked up settings from elsewhere: %q, %q", cfg.EmailFrom, cfg.SMTPHost)
+	}
+}
+
+func TestLoadWithSystemFile(t *testing.T) {
+	clearEnv(t, "EMAIL_FROM", "SMTP_HOST", "SMTP_PORT")
+	dir := t.TempDir()
+	chdir(t, dir)
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("SMTP_HOST=smtp.local.example\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SMTP_PORT", "2525")
+	path := writeEnvFile(t, 0640, "EMAIL_FROM=system@example.com\nSMTP_HOST=smtp.system.example\nSMTP_PORT=25\n")
+
+	cfg, err := loadWithSystemFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The environment wins over .env, which wins over the system file
+	if cfg.EmailFrom != "system@example.com" || cfg.SMTPHost != "smtp.local.example" || cfg.SMTPPort != "2525" {
+		t.Errorf("got %q, %q, %q", cfg.EmailFrom, cfg.SMTPHost, cfg.SMTPPort)
+	}
+}
+
+func TestSystemFilePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no permission bits for other users")
+	}
+	tests := []struct {
+		mode os.FileMode
+		ok   bool
+	}{
+		{0600, true},
+		{0640, true},
+		{0660, true},
+		{0644, false},
+		{0604, false},
+		{0602, false},
+		{0666, false},
+	}
+	for _, tt := range tests {
+		clearEnv(t, "EMAIL_PASSWORD")
+		path := writeEnvFile(t, tt.mode, "EMAIL_PASSWORD=secret\n")
+		cfg, err := loadWithSystemFile(path)
+		if tt.ok && (err != nil || cfg.EmailPassword != "secret") {
+			t.Errorf("mode %04o: %v", tt.mode, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("mode %04o: file readable by all users was accepted", tt.mode)
+		}
+		if !tt.ok && os.Getenv("EMAIL_PASSWORD") != "" {
+			t.Errorf("mode %04o: settings read from a refused file", tt.mode)
+		}
+	}
+
+	if _, err := loadWithSystemFile(filepath.Join(t.TempDir(), "missing.env")); err != nil {
+		t.Errorf("missing system file: %v", err)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	clearEnv(t, "EMAIL_FROM", "SMTP_TLS", "SMTP_PORT", "SMTP_AUTH", "MAIL_TRANSPORT", "DKIM_DOMAIN", "DATA_DIR", "RATE_LIMIT_MODE")
+	tests := []struct {
+		tls, port string
+	}{
+		{"", "587"},
+		{"starttls", "587"},
+		{"Implicit", "465"},
+		{"NONE", "25"},
+	}
+	for _, tt := range tests {
+		t.Setenv("SMTP_TLS", tt.tls)
+		cfg := fromEnv()
+		if cfg.SMTPPort != tt.port {
+			t.Errorf("SMTP_TLS=%q: port %s, want %s", tt.tls, cfg.SMTPPort, tt.port)
+		}
+	}
+	t.Setenv("SMTP_TLS", "implicit")
+	t.Setenv("SMTP_PORT", "2465")
+	if cfg := fromEnv(); cfg.SMTPPort != "2465" {
+		t.Errorf("SMTP_PORT ignored: %s", cfg.SMTPPort)
+	}
+
+	t.Setenv("EMAIL_FROM", "Alice <alice@mail.example.com>")
+	t.Setenv("SMTP_AUTH", "CRAM-MD5")
+	t.Setenv("MAIL_TRANSPORT", "File")
+	t.Setenv("RATE_LIMIT_MODE", "Fail")
+	cfg := fromEnv()
+	if cfg.DKIMDomain != "mail.example.com" || cfg.SMTPAuth != "cram-md5" || cfg.Transport != "file" || cfg.RateLimitMode != "fail" {
+		t.Errorf("got DKIM domain %q, auth %q, transport %q, rate limit mode %q", cfg.DKIMDomain, cfg.SMTPAuth, cfg.Transport, cfg.RateLimitMode)
+	}
+	if cfg.DataDir != "data" || cfg.SendmailDataDir != SystemDataDir {
+		t.Errorf("data directories %q and %q", cfg.DataDir, cfg.SendmailDataDir)
+	}
+	t.Setenv("DATA_DIR", "/srv/gomail")
+	if cfg := fromEnv(); cfg.DataDir != "/srv/gomail" || cfg.SendmailDataDir != "/srv/gomail" {
+		t.Errorf("DATA_DIR ignored: %q and %q", cfg.DataDir, cfg.SendmailDataDir)
+	}
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	clearEnv(t, "EMAIL_FROM", "EMAIL_PASSWORD", "SMTP_HOST", "SMTP_PORT", "PGP_PASSPHRASE")
+	t.Setenv("SMTP_PORT", "2525")
+	path := writeEnvFile(t, 0600, "# Gomail Configuration\n"+
+		"\n"+
+		"  EMAIL_FROM = alice@example.com  \n"+
+		"EMAIL_PASSWORD=a=b#c\n"+
+		"not a setting\n"+
+		"# SMTP_HOST=smtp.commented.example\n"+
+		"SMTP_PORT=25\n"+
+		"PGP_PASSPHRASE=\n")
+
+	loadEnvFile(path)
+	want := map[string]string{
+		"EMAIL_FROM":     "alice@example.com",
+		"EMAIL_PASSWORD": "a=b#c",
+		"SMTP_HOST":      "",
+		"SMTP_PORT":      "2525",
+		"PGP_PASSPHRASE": "",
+	}
+	for key, value := range want {
+		if got := os.Getenv(key); got != value {
+			t.Errorf("%s=%q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestSaveEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := SaveEnv(path, map[string]string{"SMTP_PORT": "465", "EMAIL_FROM": "alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if want := "# Gomail Configuration\nEMAIL_FROM=alice@example.com\nSMTP_PORT=465\n"; string(data) != want {
+		t.Errorf("new file:\n%s\nwant:\n%s", data, want)
+	}
+
+	// Existing entries are updated in place, other lines are kept
+	existing := "# Mail\nSMTP_HOST=smtp.example.com\n\n# Login\n EMAIL_FROM = old@example.com\nSMTP_PORT=587\n"
+	if err := os.WriteFile(path, []byte(existing), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveEnv(path, map[string]string{"EMAIL_FROM": "alice@example.com", "SMTP_TLS": "implicit", "EMAIL_PASSWORD": "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(path)
+	want := "# Mail\nSMTP_HOST=smtp.example.com\n\n# Login\nEMAIL_FROM=alice@example.com\nSMTP_PORT=587\nEMAIL_PASSWORD=secret\nSMTP_TLS=implicit\n"
+	if string(data) != want {
+		t.Errorf("updated file:\n%s\nwant:\n%s", data, want)
+	}
+	if info, err := os.Stat(path); err == nil && runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("mode %04o, want 0600", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,117 @@
+package mailer
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+// ParseAddressList parses a comma-separated list of RFC 5322 addresses such
+// as `"Doe, Jane" <jane@example.com>, bob@example.com`. Display names are
+// kept; an empty string yields an empty list.
+func ParseAddressList(s string) ([]string, error) {
+	s = strings.Trim(s, ", \t\r\n")
+	if s == "" {
+		return []string{}, nil
+	}
+	addrs, err := mail.ParseAddressList(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address list %q: %v", s, err)
+	}
+	result := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		result = append(result, formatAddress(addr))
+	}
+	return result, nil
+}
+
+// parseAddress parses a single address, accepting a bare addr-spec as well
+// as the name-addr form
+func parseAddress(s string) (*mail.Address, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %v", s, err)
+	}
+	return addr, nil
+}
+
+// envelopeAddresses returns the bare addr-specs for a list of addresses
+func envelopeAddresses(list []string) ([]string, error) {
+	result := make([]string, 0, len(list))
+	for _, s := range list {
+		addr, err := parseAddress(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, addr.Address)
+	}
+	return result, nil
+}
+
+// formatAddressList renders addresses for a header, encoding display names
+// as RFC 2047 encoded-words where needed
+func formatAddressList(list []string) (string, error) {
+	formatted := make([]string, 0, len(list))
+	for _, s := range list {
+		addr, err := parseAddress(s)
+		if err != nil {
+			return "", err
+		}
+		formatted = append(formatted, formatAddress(addr))
+	}
+	return strings.Join(formatted, ", "), nil
+}
+
+func formatAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+	return addr.String()
+}
+
+// encodeHeader encodes a header value as RFC 2047 encoded-words when it
+// contains non-ASCII characters, picking Q or B encoding by length
+func encodeHeader(value string) string {
+	if isASCII(value) {
+		return value
+	}
+	q := mime.QEncoding.Encode("UTF-8", value)
+	b := mime.BEncoding.Encode("UTF-8", value)
+	if len(b) < len(q) {
+		return b
+	}
+	return q
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// foldHeader formats a header field, folding it at existing whitespace so
+// lines stay within the 78 character limit recommended by RFC 5322. Line
+// breaks in the value are replaced so they cannot inject extra headers.
+func foldHeader(key, value string) string {
+	const limit = 78
+
+	value = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+
+	var b strings.Builder
+	line := key + ":"
+	for _, word := range strings.Split(value, " ") {
+		if len(line)+1+len(word) > limit && strings.TrimSpace(line) != key+":" {
+			b.WriteString(line)
+			b.WriteString("\r\n")
+			line = ""
+		}
+		line += " " + word
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+	return b.String()
+}
@@ -0,0 +1,221 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// AuthMechanism selects how the Mailer logs in to the SMTP server
+type AuthMechanism string
+
+const (
+	// AuthAuto picks the best mechanism the server offers
+	AuthAuto AuthMechanism = "auto"
+	// AuthPlain sends the username and password in one step (RFC 4616)
+	AuthPlain AuthMechanism = "plain"
+	// AuthLogin sends the username and password in answer to two prompts,
+	// as older servers and Microsoft Exchange expect
+	AuthLogin AuthMechanism = "login"
+	// AuthCRAMMD5 proves knowledge of the password without sending it
+	AuthCRAMMD5 AuthMechanism = "cram-md5"
+	// AuthXOAuth2 logs in with an OAuth2 access token instead of a password
+	// (Gmail, Outlook.com)
+	AuthXOAuth2 AuthMechanism = "xoauth2"
+)
+
+// ParseAuthMechanism converts a configuration value into an AuthMechanism
+func ParseAuthMechanism(s string) (AuthMechanism, error) {
+	switch mech := AuthMechanism(strings.ToLower(strings.TrimSpace(s))); mech {
+	case AuthAuto, AuthPlain, AuthLogin, AuthCRAMMD5, AuthXOAuth2:
+		return mech, nil
+	case "":
+		return AuthAuto, nil
+	default:
+		return "", fmt.Errorf("unknown auth mechanism %q (want auto, plain, login, cram-md5 or xoauth2)", s)
+	}
+}
+
+// TokenSource returns an OAuth2 access token for XOAUTH2 logins. It is
+// called every time a new SMTP connection logs in, so it can refresh a
+// token that has expired.
+type TokenSource func(ctx context.Context) (string, error)
+
+// StaticToken returns a TokenSource that always returns token
+func StaticToken(token string) TokenSource {
+	return func(context.Context) (string, error) {
+		return token, nil
+	}
+}
+
+// authenticate logs in on c with the configured mechanism, or with the best
+// one listed in the server's EHLO AUTH capability
+func (t *SMTPTransport) authenticate(ctx context.Context, c *smtp.Client) error {
+	if t.Password == "" && t.TokenSource == nil {
+		return nil
+	}
+	ok, params := c.Extension("AUTH")
+	if !ok {
+		if t.Auth == "" || t.Auth == AuthAuto {
+			// Local relays often accept mail without logging in
+			return nil
+		}
+		return fmt.Errorf("server does not support authentication")
+	}
+	offered := strings.Fields(strings.ToLower(params))
+	_, secure := c.TLSConnectionState()
+
+	mech, err := t.chooseAuth(offered, secure)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	switch mech {
+	case AuthPlain:
+		auth = smtp.PlainAuth("", t.Username, t.Password, t.Host)
+	case AuthLogin:
+		auth = &loginAuth{username: t.Username, password: t.Password, host: t.Host}
+	case AuthCRAMMD5:
+		auth = smtp.CRAMMD5Auth(t.Username, t.Password)
+	case AuthXOAuth2:
+		if t.TokenSource == nil {
+			return fmt.Errorf("XOAUTH2 needs an OAuth2 token")
+		}
+		token, err := t.TokenSource(ctx)
+		if err != nil {
+			return fmt.Errorf("error getting OAuth2 token: %w", err)
+		}
+		auth = &xoauth2Auth{username: t.Username, token: token, host: t.Host}
+	}
+	return c.Auth(auth)
+}
+
+// chooseAuth returns the mechanism to log in with. In auto mode XOAUTH2 is
+// used whenever a token source is set; otherwise PLAIN or LOGIN are
+// preferred on encrypted connections and CRAM-MD5 on plain ones, where it
+// keeps the password off the wire.
+func (t *SMTPTransport) chooseAuth(offered []string, secure bool) (AuthMechanism, error) {
+	has := func(mech AuthMechanism) bool {
+		for _, name := range offered {
+			if name == string(mech) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if t.Auth != "" && t.Auth != AuthAuto {
+		if !has(t.Auth) {
+			return "", fmt.Errorf("server does not support AUTH %s (offers %s)",
+				strings.ToUpper(string(t.Auth)), strings.ToUpper(strings.Join(offered, " ")))
+		}
+		return t.Auth, nil
+	}
+
+	preference := []AuthMechanism{AuthPlain, AuthLogin, AuthCRAMMD5}
+	if !secure {
+		preference = []AuthMechanism{AuthCRAMMD5, AuthPlain, AuthLogin}
+	}
+	if t.TokenSource != nil {
+		if has(AuthXOAuth2) {
+			return AuthXOAuth2, nil
+		}
+		if t.Password == "" {
+			return "", fmt.Errorf("server does not support AUTH XOAUTH2 (offers %s)",
+				strings.ToUpper(strings.Join(offered, " ")))
+		}
+	}
+	for _, mech := range preference {
+		if has(mech) {
+			return mech, nil
+		}
+	}
+	return "", fmt.Errorf("no supported authentication mechanism (server offers %s)",
+		strings.ToUpper(strings.Join(offered, " ")))
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp does not provide
+type loginAuth struct {
+	username string
+	password string
+	host     string
+	step     int
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkSecure(server, a.host); err != nil {
+		return "", nil, err
+	}
+	a.step = 0
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	// Servers prompt with "Username:" and "Password:", but some word the
+	// prompts differently, so fall back to their order
+	prompt := strings.ToLower(string(fromServer))
+	a.step++
+	switch {
+	case strings.HasPrefix(prompt, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "pass"):
+		return []byte(a.password), nil
+	case a.step == 1:
+		return []byte(a.username), nil
+	case a.step == 2:
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN prompt %q", fromServer)
+	}
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism used by Gmail and Outlook.com
+type xoauth2Auth struct {
+	username string
+	token    string
+	host     string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkSecure(server, a.host); err != nil {
+		return "", nil, err
+	}
+	resp := "user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"
+	return "XOAUTH2", []byte(resp), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server sent a JSON error description; an empty reply makes
+		// it finish with the actual error code
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// checkSecure refuses to send credentials over an unencrypted connection
+// except to localhost, matching smtp.PlainAuth
+func checkSecure(server *smtp.ServerInfo, host string) error {
+	if server.Name != host {
+		return errors.New("wrong host name")
+	}
+	if server.TLS || isLocalhost(server.Name) {
+		return nil
+	}
+	return errors.New("unencrypted connection")
+}
+
+func isLocalhost(name string) bool {
+	if name == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(name)
+	return ip != nil && ip.IsLoopback()
+}
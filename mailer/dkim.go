@@ -0,0 +1,326 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultDKIMHeaders are the header fields signed when DKIMSigner.Headers
+// is empty. Fields missing from a message are skipped.
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// DKIMSigner adds a DKIM-Signature header (RFC 6376) to outgoing messages
+// using relaxed/relaxed canonicalization. RSA keys sign with rsa-sha256 and
+// Ed25519 keys with ed25519-sha256 (RFC 8463).
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+	// Headers lists the header fields to sign (default DefaultDKIMHeaders)
+	Headers []string
+}
+
+// NewDKIMSigner creates a signer for domain and selector, loading the
+// private key from a PEM file
+func NewDKIMSigner(domain, selector, keyPath string) (*DKIMSigner, error) {
+	if domain == "" || selector == "" {
+		return nil, fmt.Errorf("DKIM signing needs a domain and a selector")
+	}
+	key, err := LoadDKIMKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &DKIMSigner{Domain: domain, Selector: selector, Key: key}, nil
+}
+
+// LoadDKIMKey reads an RSA or Ed25519 private key from a PEM file in PKCS#8
+// or PKCS#1 form
+func LoadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading DKIM key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("error reading DKIM key: %s is not a PEM file", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("error reading DKIM key: unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing DKIM key: %v", err)
+	}
+	if _, err := dkimAlgorithm(key); err != nil {
+		return nil, err
+	}
+	return key.(crypto.Signer), nil
+}
+
+// GenerateDKIMKey creates a new signing key. keyType is "rsa" or "ed25519";
+// bits only applies to RSA keys.
+func GenerateDKIMKey(keyType string, bits int) (crypto.Signer, error) {
+	switch strings.ToLower(keyType) {
+	case "rsa":
+		if bits < 1024 {
+			return nil, fmt.Errorf("RSA keys for DKIM need at least 1024 bits")
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unknown key type %q (want rsa or ed25519)", keyType)
+	}
+}
+
+// MarshalDKIMKey encodes a private key as a PKCS#8 PEM block
+func MarshalDKIMKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding DKIM key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// DKIMRecord returns the value of the DNS TXT record publishing the public
+// half of key, to be placed at <selector>._domainkey.<domain>
+func DKIMRecord(key crypto.Signer) (string, error) {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	default:
+		return "", fmt.Errorf("unsupported DKIM key type %T", pub)
+	}
+}
+
+// dkimAlgorithm returns the a= tag value for a private key
+func dkimAlgorithm(key interface{}) (string, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("unsupported DKIM key type %T (want RSA or Ed25519)", key)
+	}
+}
+
+// Sign reads a complete message and returns it with a DKIM-Signature header
+// prepended. The body is hashed while it is copied to a temporary file, so
+// large messages are not held in memory; the returned function removes that
+// file and must be called once the message has been sent.
+func (s *DKIMSigner) Sign(msg io.Reader) (io.Reader, func(), error) {
+	algo, err := dkimAlgorithm(s.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(msg)
+	rawHeader, fields, err := readHeader(br)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error signing message: %v", err)
+	}
+
+	body, err := os.CreateTemp("", "gomail-dkim-*.eml")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error signing message: %v", err)
+	}
+	cleanup := func() {
+		body.Close()
+		os.Remove(body.Name())
+	}
+
+	bodyHash := sha256.New()
+	canon := &relaxedBody{w: bodyHash}
+	if _, err := io.Copy(io.MultiWriter(body, canon), br); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("error signing message: %v", err)
+	}
+	canon.Close()
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("error signing message: %v", err)
+	}
+
+	signature, err := s.signature(algo, fields, bodyHash)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return io.MultiReader(strings.NewReader(signature), bytes.NewReader(rawHeader), body), cleanup, nil
+}
+
+// signature builds the DKIM-Signature header field for the given header
+// fields and body hash
+func (s *DKIMSigner) signature(algo string, fields []string, bodyHash hash.Hash) (string, error) {
+	names := s.Headers
+	if len(names) == 0 {
+		names = DefaultDKIMHeaders
+	}
+
+	// Sign the last occurrence of a field first, as verifiers expect
+	headerHash := sha256.New()
+	var signed []string
+	used := make(map[int]bool)
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			io.WriteString(headerHash, relaxedHeader(fields[i])+"\r\n")
+			signed = append(signed, strings.ToLower(name))
+		}
+	}
+
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		algo, s.Domain, s.Selector, time.Now().Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash.Sum(nil)))
+	io.WriteString(headerHash, relaxedHeader("DKIM-Signature: "+value))
+
+	// Ed25519 signs the SHA-256 digest itself (RFC 8463, section 3)
+	opts := crypto.Hash(0)
+	if algo == "rsa-sha256" {
+		opts = crypto.SHA256
+	}
+	sig, err := s.Key.Sign(rand.Reader, headerHash.Sum(nil), opts)
+	if err != nil {
+		return "", fmt.Errorf("error signing message: %v", err)
+	}
+	return "DKIM-Signature: " + value + foldBase64(base64.StdEncoding.EncodeToString(sig)) + "\r\n", nil
+}
+
+// readHeader reads the message header up to and including the blank line
+// that ends it. It returns the raw bytes and the header fields, each with
+// its continuation lines and line breaks.
+func readHeader(r *bufio.Reader) ([]byte, []string, error) {
+	var raw bytes.Buffer
+	var fields []string
+	for {
+		line, err := r.ReadString('\n')
+		raw.WriteString(line)
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if strings.TrimRight(line, "\r\n") == "" {
+			return raw.Bytes(), fields, nil
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+		if err == io.EOF {
+			return raw.Bytes(), fields, nil
+		}
+	}
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+// relaxedHeader canonicalizes a header field with the relaxed algorithm
+// (RFC 6376, section 3.4.2), without the trailing CRLF
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// relaxedBody canonicalizes a message body with the relaxed algorithm
+// (RFC 6376, section 3.4.4) as it is written: whitespace runs become one
+// space, trailing whitespace is dropped, and empty lines at the end of the
+// body are ignored. Close must be called after the last write.
+type relaxedBody struct {
+	w io.Writer
+	// line collects the current line; emptyLines counts blank lines held
+	// back in case they end the body
+	line       []byte
+	emptyLines int
+}
+
+func (b *relaxedBody) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c == '\n' {
+			b.endLine()
+			continue
+		}
+		b.line = append(b.line, c)
+	}
+	return len(p), nil
+}
+
+// Close flushes a final line that has no line break
+func (b *relaxedBody) Close() error {
+	if len(b.line) > 0 {
+		b.endLine()
+	}
+	return nil
+}
+
+func (b *relaxedBody) endLine() {
+	raw := strings.TrimSuffix(string(b.line), "\r")
+	line := strings.Join(strings.FieldsFunc(raw, isWSP), " ")
+	if line != "" && isWSP(rune(raw[0])) {
+		line = " " + line
+	}
+	b.line = b.line[:0]
+	if line == "" {
+		b.emptyLines++
+		return
+	}
+	for ; b.emptyLines > 0; b.emptyLines-- {
+		io.WriteString(b.w, "\r\n")
+	}
+	io.WriteString(b.w, line+"\r\n")
+}
+
+// foldBase64 breaks a long base64 value into continuation lines
+func foldBase64(s string) string {
+	var b strings.Builder
+	for len(s) > 72 {
+		b.WriteString(s[:72])
+		b.WriteString("\r\n\t")
+		s = s[72:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
@@ -0,0 +1,278 @@
+package mailer
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const dkimTestMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: A subject that is long enough\r\n" +
+	" \tto be folded   over\r\n\tthree lines\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"X-Unsigned: not in h=\r\n" +
+	"\r\n" +
+	" Hello \t world  \r\n" +
+	"line\t2\r\n" +
+	"\r\n" +
+	"last line\r\n" +
+	"\r\n" +
+	"\r\n" +
+	"  \r\n"
+
+func TestDKIMSign(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ed25519"} {
+		t.Run(keyType, func(t *testing.T) {
+			key, err := GenerateDKIMKey(keyType, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record, err := DKIMRecord(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &DKIMSigner{Domain: "example.com", Selector: "mail", Key: key}
+			signed := dkimSign(t, s, dkimTestMessage)
+
+			tags, err := verifyDKIM(signed, record)
+			if err != nil {
+				t.Fatalf("signature does not verify: %v\n%s", err, signed)
+			}
+			if want := keyType + "-sha256"; tags["a"] != want {
+				t.Errorf("a=%s, want %s", tags["a"], want)
+			}
+			if tags["c"] != "relaxed/relaxed" || tags["d"] != "example.com" || tags["s"] != "mail" {
+				t.Errorf("tags %v", tags)
+			}
+			if tags["h"] != "from:subject:date:to" {
+				t.Errorf("h=%s", tags["h"])
+			}
+			// The body without its trailing blank lines, whitespace runs
+			// reduced to one space and trailing whitespace removed
+			canonical := sha256.Sum256([]byte(" Hello world\r\nline 2\r\n\r\nlast line\r\n"))
+			if want := base64.StdEncoding.EncodeToString(canonical[:]); tags["bh"] != want {
+				t.Errorf("bh=%s, want %s", tags["bh"], want)
+			}
+			if !strings.HasSuffix(signed, dkimTestMessage) {
+				t.Errorf("message changed by signing")
+			}
+
+			// Changes that relaxed canonicalization ignores
+			for _, change := range [][2]string{
+				{"Subject: A subject", "subject:   A subject"},
+				{"over\r\n\tthree", "over three"},
+				{"line\t2", "line   2 "},
+				{"last line\r\n\r\n\r\n  \r\n", "last line \r\n\t\r\n"},
+				{"X-Unsigned: not in h=", "X-Unsigned: changed"},
+			} {
+				if _, err := verifyDKIM(strings.Replace(signed, change[0], change[1], 1), record); err != nil {
+					t.Errorf("%q -> %q breaks the signature: %v", change[0], change[1], err)
+				}
+			}
+			// Changes that must break it
+			for _, change := range [][2]string{
+				{"three lines", "four lines"},
+				{"Hello", "Hallo"},
+				{"line\t2\r\n\r\n", "line\t2\r\n"},
+				{"last line\r\n\r\n\r\n  \r\n", "last line\r\n\r\n\r\n.\r\n"},
+			} {
+				if _, err := verifyDKIM(strings.Replace(signed, change[0], change[1], 1), record); err == nil {
+					t.Errorf("%q -> %q keeps the signature valid", change[0], change[1])
+				}
+			}
+		})
+	}
+}
+
+func TestDKIMEmptyBody(t *testing.T) {
+	key, err := GenerateDKIMKey("ed25519", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, _ := DKIMRecord(key)
+	s := &DKIMSigner{Domain: "example.com", Selector: "mail", Key: key}
+	for _, body := range []string{"", "\r\n", "\r\n\r\n \t\r\n"} {
+		signed := dkimSign(t, s, "From: alice@example.com\r\nSubject: empty\r\n\r\n"+body)
+		tags, err := verifyDKIM(signed, record)
+		if err != nil {
+			t.Fatalf("body %q: %v", body, err)
+		}
+		// RFC 6376, section 3.4.4: an empty body hashes as nothing
+		if tags["bh"] != "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=" {
+			t.Errorf("body %q: bh=%s", body, tags["bh"])
+		}
+	}
+}
+
+func dkimSign(t *testing.T, s *DKIMSigner, msg string) string {
+	t.Helper()
+	r, cleanup, err := s.Sign(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	signed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(signed)
+}
+
+var (
+	wspRun     = regexp.MustCompile(`[ \t]+`)
+	dkimBValue = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+)
+
+// verifyDKIM checks the first DKIM-Signature of msg against the public key
+// in a DNS TXT record value, following RFC 6376 section 6.1 for
+// relaxed/relaxed signatures, and returns the signature's tags
+func verifyDKIM(msg, record string) (map[string]string, error) {
+	header, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		return nil, testError("no header/body separator")
+	}
+	var fields []string
+	for _, line := range strings.Split(header, "\r\n") {
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	relaxed := func(field string) string {
+		name, value, _ := strings.Cut(field, ":")
+		value = strings.ReplaceAll(value, "\r\n", "")
+		value = strings.Trim(wspRun.ReplaceAllString(value, " "), " ")
+		return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + value
+	}
+
+	sigField := fields[0]
+	if !strings.EqualFold(strings.TrimSpace(strings.SplitN(sigField, ":", 2)[0]), "DKIM-Signature") {
+		return nil, testError("first field is not DKIM-Signature")
+	}
+	tags := make(map[string]string)
+	_, value, _ := strings.Cut(sigField, ":")
+	for _, tag := range strings.Split(value, ";") {
+		name, v, _ := strings.Cut(tag, "=")
+		v = strings.Join(strings.Fields(v), "")
+		if name = strings.TrimSpace(name); name != "" {
+			tags[name] = v
+		}
+	}
+	if tags["v"] != "1" || tags["c"] != "relaxed/relaxed" {
+		return tags, testError("unsupported v= or c=")
+	}
+
+	// Body hash
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(wspRun.ReplaceAllString(line, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	canonical := ""
+	if len(lines) > 0 {
+		canonical = strings.Join(lines, "\r\n") + "\r\n"
+	}
+	bh := sha256.Sum256([]byte(canonical))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return tags, testError("body hash mismatch")
+	}
+
+	// Header hash: h= fields from the bottom up, then the signature field
+	// with an empty b=
+	h := sha256.New()
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i > 0; i-- {
+			if !used[i] && strings.EqualFold(strings.TrimSpace(strings.SplitN(fields[i], ":", 2)[0]), name) {
+				used[i] = true
+				io.WriteString(h, relaxed(fields[i])+"\r\n")
+				break
+			}
+		}
+	}
+	io.WriteString(h, relaxed(dkimBValue.ReplaceAllString(sigField, "$1$2")))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return tags, err
+	}
+	p := regexp.MustCompile(`p=([A-Za-z0-9+/=]+)`).FindStringSubmatch(record)
+	if p == nil {
+		return tags, testError("no p= in the DNS record")
+	}
+	pub, err := base64.StdEncoding.DecodeString(p[1])
+	if err != nil {
+		return tags, err
+	}
+	switch tags["a"] {
+	case "rsa-sha256":
+		key, err := x509.ParsePKIXPublicKey(pub)
+		if err != nil {
+			return tags, err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || !strings.Contains(record, "k=rsa") {
+			return tags, testError("record does not hold an RSA key")
+		}
+		return tags, rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, h.Sum(nil), sig)
+	case "ed25519-sha256":
+		if len(pub) != ed25519.PublicKeySize || !strings.Contains(record, "k=ed25519") {
+			return tags, testError("record does not hold an Ed25519 key")
+		}
+		if !ed25519.Verify(pub, h.Sum(nil), sig) {
+			return tags, testError("bad signature")
+		}
+		return tags, nil
+	}
+	return tags, testError("unsupported a=")
+}
+
+func TestDKIMKeyRoundTrip(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ed25519"} {
+		key, err := GenerateDKIMKey(keyType, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pemData, err := MarshalDKIMKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := writeTestFile(t, "dkim.pem", pemData)
+		loaded, err := LoadDKIMKey(path)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if !publicKeysEqual(loaded.Public(), key.Public()) {
+			t.Errorf("%s: loaded a different key", keyType)
+		}
+	}
+	if _, err := GenerateDKIMKey("rsa", 512); err == nil {
+		t.Errorf("512-bit RSA key accepted")
+	}
+	if _, err := LoadDKIMKey(writeTestFile(t, "bad.pem", []byte("not PEM"))); err == nil {
+		t.Errorf("loaded a key from a non-PEM file")
+	}
+}
+
+// writeTestFile creates a file in a temporary directory and returns its path
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
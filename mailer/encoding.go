@@ -0,0 +1,142 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// maxLineLength is the line length used for base64 bodies (RFC 2045)
+const maxLineLength = 76
+
+// crlf is written as a byte slice so wrapping lines does not allocate
+var crlf = []byte("\r\n")
+
+// lineWrapper inserts CRLF line breaks every maxLineLength bytes
+type lineWrapper struct {
+	w   io.Writer
+	col int
+}
+
+func (lw *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := maxLineLength - lw.col
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := lw.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		lw.col += n
+		p = p[n:]
+		if lw.col == maxLineLength {
+			if _, err := lw.w.Write(crlf); err != nil {
+				return written, err
+			}
+			lw.col = 0
+		}
+	}
+	return written, nil
+}
+
+// writeBase64 streams r to w as base64 wrapped at 76 columns
+func writeBase64(w io.Writer, r io.Reader) error {
+	enc := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: w})
+	if _, err := io.Copy(enc, r); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// chooseTextEncoding picks quoted-printable for text that is mostly ASCII
+// and base64 when that produces a smaller body, as with most non-Latin
+// scripts
+func chooseTextEncoding(content string) string {
+	escaped := 0
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		if c >= 0x80 || c == '=' || (c < ' ' && c != '\r' && c != '\n' && c != '\t') {
+			escaped++
+		}
+	}
+	qpSize := len(content) + 2*escaped
+	qpSize += qpSize / maxLineLength * 3 // soft line breaks
+	b64Size := (len(content) + 2) / 3 * 4
+	b64Size += b64Size / maxLineLength * 2
+	if b64Size < qpSize {
+		return "base64"
+	}
+	return "quoted-printable"
+}
+
+// writeQuotedPrintable writes text as quoted-printable with CRLF line breaks
+func writeQuotedPrintable(w io.Writer, content string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, content); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// canonicalLineBreaks converts line breaks to CRLF as required for text
+// parts before base64 encoding
+func canonicalLineBreaks(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	return strings.ReplaceAll(content, "\n", "\r\n")
+}
+
+// sniffLen is the number of bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// detectContentType determines the MIME type of a file from its extension,
+// falling back to sniffing the content. It returns a reader that yields
+// the complete content, including the bytes consumed for sniffing.
+func detectContentType(filename string, r io.Reader) (string, io.Reader, error) {
+	if t := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))); t != "" {
+		return t, r, nil
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+	return http.DetectContentType(head), io.MultiReader(bytes.NewReader(head), r), nil
+}
+
+// formatDisposition builds a Content-Disposition value, using RFC 2231
+// encoding for filenames that are not plain ASCII
+func formatDisposition(disposition, filename string) string {
+	if filename == "" {
+		return disposition
+	}
+	if v := mime.FormatMediaType(disposition, map[string]string{"filename": filename}); v != "" {
+		return v
+	}
+	return disposition
+}
+
+// withNameParam adds a name parameter to a content type for older clients
+// that ignore the Content-Disposition filename
+func withNameParam(contentType, filename string) string {
+	if filename == "" {
+		return contentType
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	params["name"] = filename
+	if v := mime.FormatMediaType(mediaType, params); v != "" {
+		return v
+	}
+	return contentType
+}
@@ -0,0 +1,158 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestWriteBase64Wrapping(t *testing.T) {
+	for _, n := range []int{0, 1, 56, 57, 58, 113, 114, 115, 1000, 100000} {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i * 31)
+		}
+
+		var buf bytes.Buffer
+		if err := writeBase64(&buf, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		// Small reads must wrap exactly like large ones
+		var small bytes.Buffer
+		if err := writeBase64(&small, iotest.OneByteReader(bytes.NewReader(data))); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), small.Bytes()) {
+			t.Errorf("%d bytes: output depends on read size", n)
+		}
+
+		lines := strings.Split(buf.String(), "\r\n")
+		for i, line := range lines {
+			last := i == len(lines)-1
+			if !last && len(line) != maxLineLength {
+				t.Errorf("%d bytes: line %d has %d characters, want 76", n, i+1, len(line))
+			}
+			if last && len(line) >= maxLineLength {
+				t.Errorf("%d bytes: last line has %d characters", n, len(line))
+			}
+			if strings.ContainsAny(line, "\r\n") {
+				t.Errorf("%d bytes: bare line break in line %d", n, i+1)
+			}
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(buf.String(), "\r\n", ""))
+		if err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("%d bytes: does not decode to the input (%v)", n, err)
+		}
+	}
+}
+
+func TestWriteBase64Streams(t *testing.T) {
+	data := make([]byte, 4<<20)
+	r := bytes.NewReader(data)
+	allocs := testing.AllocsPerRun(3, func() {
+		r.Reset(data)
+		if err := writeBase64(io.Discard, r); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// The copy buffer and encoder, not anything per line or per byte
+	if allocs > 10 {
+		t.Errorf("encoding 4 MB took %.0f allocations", allocs)
+	}
+}
+
+func TestFilenameParameters(t *testing.T) {
+	tests := []struct {
+		filename    string
+		disposition string
+		contentType string
+	}{
+		{"report.pdf", "attachment; filename=report.pdf", "application/pdf; name=report.pdf"},
+		{"my report.pdf", `attachment; filename="my report.pdf"`, `application/pdf; name="my report.pdf"`},
+		{"Übersicht.pdf", "attachment; filename*=utf-8''%C3%9Cbersicht.pdf", "application/pdf; name*=utf-8''%C3%9Cbersicht.pdf"},
+		{"日本語 ファイル.pdf", "attachment; filename*=utf-8''%E6%97%A5%E6%9C%AC%E8%AA%9E%20%E3%83%95%E3%82%A1%E3%82%A4%E3%83%AB.pdf",
+			"application/pdf; name*=utf-8''%E6%97%A5%E6%9C%AC%E8%AA%9E%20%E3%83%95%E3%82%A1%E3%82%A4%E3%83%AB.pdf"},
+		{`quote".txt`, `attachment; filename="quote\".txt"`, `application/pdf; name="quote\".txt"`},
+	}
+	for _, tt := range tests {
+		disposition := formatDisposition("attachment", tt.filename)
+		if disposition != tt.disposition {
+			t.Errorf("formatDisposition(%q) = %s, want %s", tt.filename, disposition, tt.disposition)
+		}
+		contentType := withNameParam("application/pdf", tt.filename)
+		if contentType != tt.contentType {
+			t.Errorf("withNameParam(%q) = %s, want %s", tt.filename, contentType, tt.contentType)
+		}
+		// RFC 2231 values must decode back to the original name
+		for _, v := range []struct{ value, param string }{{disposition, "filename"}, {contentType, "name"}} {
+			_, params, err := mime.ParseMediaType(v.value)
+			if err != nil || params[v.param] != tt.filename {
+				t.Errorf("%s parses as %q (%v), want %q", v.value, params[v.param], err, tt.filename)
+			}
+		}
+	}
+	if got := formatDisposition("inline", ""); got != "inline" {
+		t.Errorf("formatDisposition without a filename = %q", got)
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 1000)...)
+	tests := []struct {
+		filename string
+		data     []byte
+		want     string
+	}{
+		{"photo.JPG", []byte("not really a jpeg"), "image/jpeg"},
+		{"notes.txt", []byte("hello"), "text/plain; charset=utf-8"},
+		{"image", png, "image/png"},
+		{"", []byte("%PDF-1.7\n"), "application/pdf"},
+		{"blob", []byte{0, 1, 2, 3}, "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		got, r, err := detectContentType(tt.filename, bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("detectContentType(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
+		// The bytes read for sniffing must not be lost
+		if data, _ := io.ReadAll(r); !bytes.Equal(data, tt.data) {
+			t.Errorf("%q: reader returns %d bytes, want %d", tt.filename, len(data), len(tt.data))
+		}
+	}
+}
+
+// BenchmarkLargeAttachment renders a message with a 500 MB attachment. The
+// file is streamed through the base64 encoder, so the bytes allocated per
+// operation stay in the kilobytes however large the file is.
+func BenchmarkLargeAttachment(b *testing.B) {
+	const size = 500 << 20
+	path := filepath.Join(b.TempDir(), "large.bin")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// A sparse file reads as zeros without taking up disk space
+	if err := f.Truncate(size); err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg := &Message{From: "sender@example.com", To: []string{"bob@example.com"}, Subject: "Large", Text: "See attached"}
+		msg.Attach(path)
+		if _, err := msg.WriteTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package mailer
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// reservedHeaders are generated by the message writer and cannot be set
+// through Message.Headers
+var reservedHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true,
+	"Subject": true, "Date": true, "Message-Id": true, "In-Reply-To": true,
+	"References": true, "Mime-Version": true, "Content-Type": true,
+	"Content-Transfer-Encoding": true,
+}
+
+// IsReservedHeader reports whether the message writer generates the header
+// name itself, so it cannot be set through Message.Headers
+func IsReservedHeader(name string) bool {
+	return reservedHeaders[textproto.CanonicalMIMEHeaderKey(name)]
+}
+
+// ParseHeaderField parses a "Name: value" line into a header name and value
+func ParseHeaderField(line string) (string, string, error) {
+	name, value, ok := strings.Cut(line, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid header %q (want Name: value)", line)
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f {
+			return "", "", fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return textproto.CanonicalMIMEHeaderKey(name), strings.TrimSpace(value), nil
+}
+
+// generateMessageID creates a unique Message-ID using the sender's domain
+func generateMessageID(from string) string {
+	domain := "localhost"
+	if addr, err := parseAddress(from); err == nil {
+		if at := strings.LastIndex(addr.Address, "@"); at >= 0 && at < len(addr.Address)-1 {
+			domain = addr.Address[at+1:]
+		}
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), randomID(), domain)
+}
+
+// normalizeMessageID wraps a message ID in angle brackets if needed
+func normalizeMessageID(id string) string {
+	id = strings.TrimSpace(id)
+	if id == "" || strings.HasPrefix(id, "<") {
+		return id
+	}
+	return "<" + id + ">"
+}
+
+// formatDate formats a time for the Date header as specified by RFC 5322
+func formatDate(t time.Time) string {
+	return t.Format(time.RFC1123Z)
+}
@@ -0,0 +1,328 @@
+package mailer
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// HTMLToText converts an HTML document into readable plain text for the
+// text/plain alternative of HTML mail. Links keep their target in
+// parentheses, list items are prefixed with bullets or numbers and the
+// top-level headings are underlined.
+func HTMLToText(doc string) string {
+	c := &htmlConverter{}
+	c.convert(doc)
+	return c.result()
+}
+
+type htmlList struct {
+	ordered bool
+	index   int
+}
+
+type htmlConverter struct {
+	out          strings.Builder
+	hasText      bool
+	pendingSpace bool
+	skipDepth    int
+	preDepth     int
+	lists        []htmlList
+	links        []htmlLink
+	headings     []int
+}
+
+type htmlLink struct {
+	href  string
+	start int
+}
+
+// skippedTags hold content that is never shown to the reader
+var skippedTags = map[string]bool{
+	"head": true, "style": true, "script": true, "title": true, "template": true,
+}
+
+// blockTags start and end a paragraph
+var blockTags = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "header": true,
+	"footer": true, "main": true, "nav": true, "aside": true, "blockquote": true,
+	"table": true, "form": true, "fieldset": true, "address": true, "figure": true,
+	"dl": true, "pre": true, "center": true,
+}
+
+func (c *htmlConverter) convert(doc string) {
+	for len(doc) > 0 {
+		lt := strings.IndexByte(doc, '<')
+		if lt < 0 {
+			c.text(doc)
+			return
+		}
+		c.text(doc[:lt])
+		doc = doc[lt:]
+
+		if strings.HasPrefix(doc, "<!--") {
+			end := strings.Index(doc, "-->")
+			if end < 0 {
+				return
+			}
+			doc = doc[end+3:]
+			continue
+		}
+
+		gt := strings.IndexByte(doc, '>')
+		if gt < 0 {
+			c.text(doc)
+			return
+		}
+		c.tag(doc[1:gt])
+		doc = doc[gt+1:]
+	}
+}
+
+func (c *htmlConverter) tag(raw string) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || raw[0] == '!' || raw[0] == '?' {
+		return
+	}
+
+	closing := raw[0] == '/'
+	if closing {
+		raw = raw[1:]
+	}
+	raw = strings.TrimSuffix(raw, "/")
+	name := raw
+	if i := strings.IndexAny(raw, " \t\r\n"); i >= 0 {
+		name = raw[:i]
+	}
+	name = strings.ToLower(name)
+
+	if skippedTags[name] {
+		if closing {
+			if c.skipDepth > 0 {
+				c.skipDepth--
+			}
+		} else {
+			c.skipDepth++
+		}
+		return
+	}
+	if c.skipDepth > 0 {
+		return
+	}
+
+	if closing {
+		c.closeTag(name)
+	} else {
+		c.openTag(name, raw)
+	}
+}
+
+func (c *htmlConverter) openTag(name, raw string) {
+	switch name {
+	case "br":
+		c.newlines(1)
+	case "hr":
+		c.newlines(2)
+		c.out.WriteString(strings.Repeat("-", 40))
+		c.hasText = true
+		c.newlines(2)
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		c.newlines(2)
+		c.headings = append(c.headings, c.out.Len())
+	case "li":
+		c.newlines(1)
+		depth := len(c.lists)
+		if depth > 0 {
+			c.out.WriteString(strings.Repeat("  ", depth-1))
+			list := &c.lists[depth-1]
+			if list.ordered {
+				list.index++
+				fmt.Fprintf(&c.out, "%d. ", list.index)
+				break
+			}
+		}
+		c.out.WriteString("- ")
+	case "tr":
+		c.newlines(1)
+	case "td", "th":
+		if !c.atLineStart() {
+			c.out.WriteString("  ")
+		}
+	case "ul", "ol":
+		if len(c.lists) > 0 {
+			c.newlines(1)
+		} else {
+			c.newlines(2)
+		}
+	case "a":
+		c.links = append(c.links, htmlLink{href: attr(raw, "href"), start: c.out.Len()})
+	case "img":
+		if alt := attr(raw, "alt"); alt != "" {
+			c.text("[" + alt + "]")
+		}
+	default:
+		if blockTags[name] {
+			c.newlines(2)
+		}
+	}
+
+	switch name {
+	case "ul", "ol":
+		c.lists = append(c.lists, htmlList{ordered: name == "ol"})
+	case "pre":
+		c.preDepth++
+	}
+}
+
+func (c *htmlConverter) closeTag(name string) {
+	switch name {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		if n := len(c.headings); n > 0 {
+			start := c.headings[n-1]
+			c.headings = c.headings[:n-1]
+			if underline := map[string]string{"h1": "=", "h2": "-"}[name]; underline != "" {
+				width := len([]rune(strings.TrimSpace(c.out.String()[start:])))
+				if width > 0 {
+					c.newlines(1)
+					c.out.WriteString(strings.Repeat(underline, width))
+				}
+			}
+		}
+		c.newlines(2)
+	case "a":
+		if n := len(c.links); n > 0 {
+			link := c.links[n-1]
+			c.links = c.links[:n-1]
+			label := strings.TrimSpace(c.out.String()[link.start:])
+			href := strings.TrimPrefix(link.href, "mailto:")
+			if href != "" && !strings.HasPrefix(href, "#") && href != label {
+				c.pendingSpace = true
+				c.text("(" + href + ")")
+			}
+		}
+	case "ul", "ol":
+		if n := len(c.lists); n > 0 {
+			c.lists = c.lists[:n-1]
+		}
+		if len(c.lists) > 0 {
+			c.newlines(1)
+		} else {
+			c.newlines(2)
+		}
+	case "pre":
+		if c.preDepth > 0 {
+			c.preDepth--
+		}
+		c.newlines(2)
+	default:
+		if blockTags[name] {
+			c.newlines(2)
+		}
+	}
+}
+
+// text writes character data, collapsing whitespace outside <pre>
+func (c *htmlConverter) text(s string) {
+	if c.skipDepth > 0 || s == "" {
+		return
+	}
+	s = html.UnescapeString(s)
+
+	if c.preDepth > 0 {
+		c.out.WriteString(s)
+		c.hasText = true
+		c.pendingSpace = false
+		return
+	}
+
+	if strings.TrimSpace(s) == "" {
+		c.pendingSpace = true
+		return
+	}
+	if s[0] == ' ' || s[0] == '\t' || s[0] == '\n' || s[0] == '\r' {
+		c.pendingSpace = true
+	}
+	for i, word := range strings.Fields(s) {
+		if (i > 0 || c.pendingSpace) && !c.atLineStart() {
+			c.out.WriteByte(' ')
+		}
+		c.out.WriteString(word)
+		c.hasText = true
+		c.pendingSpace = false
+	}
+	last := s[len(s)-1]
+	c.pendingSpace = last == ' ' || last == '\t' || last == '\n' || last == '\r'
+}
+
+// newlines makes sure the output ends with at least n line breaks
+func (c *htmlConverter) newlines(n int) {
+	c.pendingSpace = false
+	if !c.hasText {
+		return
+	}
+	out := c.out.String()
+	trailing := len(out) - len(strings.TrimRight(out, "\n"))
+	for ; trailing < n; trailing++ {
+		c.out.WriteByte('\n')
+	}
+}
+
+func (c *htmlConverter) atLineStart() bool {
+	out := c.out.String()
+	return out == "" || out[len(out)-1] == '\n' || out[len(out)-1] == ' '
+}
+
+func (c *htmlConverter) result() string {
+	lines := strings.Split(c.out.String(), "\n")
+	var cleaned []string
+	blank := 0
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			blank++
+			if blank > 1 {
+				continue
+			}
+		} else {
+			blank = 0
+		}
+		cleaned = append(cleaned, line)
+	}
+	return strings.TrimSpace(strings.Join(cleaned, "\n"))
+}
+
+// attr returns the value of a named attribute from a raw tag
+func attr(raw, name string) string {
+	lower := strings.ToLower(raw)
+	for i := 0; ; {
+		idx := strings.Index(lower[i:], name)
+		if idx < 0 {
+			return ""
+		}
+		idx += i
+		i = idx + len(name)
+
+		// The attribute name must stand alone and be followed by '='
+		if idx > 0 && !strings.ContainsRune(" \t\r\n", rune(lower[idx-1])) {
+			continue
+		}
+		rest := strings.TrimLeft(raw[i:], " \t\r\n")
+		if !strings.HasPrefix(rest, "=") {
+			continue
+		}
+		rest = strings.TrimLeft(rest[1:], " \t\r\n")
+		if rest == "" {
+			return ""
+		}
+		if quote := rest[0]; quote == '"' || quote == '\'' {
+			if end := strings.IndexByte(rest[1:], quote); end >= 0 {
+				return html.UnescapeString(rest[1 : end+1])
+			}
+			return html.UnescapeString(rest[1:])
+		}
+		if end := strings.IndexAny(rest, " \t\r\n"); end >= 0 {
+			return html.UnescapeString(rest[:end])
+		}
+		return html.UnescapeString(rest)
+	}
+}
@@ -0,0 +1,85 @@
+package mailer
+
+import (
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// imgSrcPattern matches the src attribute of <img> tags, quoted or not
+var imgSrcPattern = regexp.MustCompile(`(?i)(<img\b[^>]*?\bsrc\s*=\s*)("[^"]*"|'[^']*'|[^\s>]+)`)
+
+// EmbedImages turns <img> tags that point at local files into inline parts.
+// Each relative src is resolved against baseDir and, if the file exists,
+// embedded as a multipart/related part and rewritten to a cid: reference.
+// Remote, data: and absolute sources and paths that leave baseDir are left
+// untouched. Files that are embedded are removed from the attachments.
+func (msg *Message) EmbedImages(baseDir string) {
+	embedded := make(map[string]string)
+
+	msg.HTML = imgSrcPattern.ReplaceAllStringFunc(msg.HTML, func(tag string) string {
+		groups := imgSrcPattern.FindStringSubmatch(tag)
+		prefix, quoted := groups[1], groups[2]
+		src := strings.Trim(quoted, `"'`)
+
+		path, ok := localImagePath(baseDir, src)
+		if !ok {
+			return tag
+		}
+		cid, ok := embedded[path]
+		if !ok {
+			cid = msg.Embed(path)
+			embedded[path] = cid
+		}
+		return prefix + `"cid:` + cid + `"`
+	})
+
+	if len(embedded) == 0 {
+		return
+	}
+	attachments := msg.Attachments[:0]
+	for _, a := range msg.Attachments {
+		if _, ok := embedded[filepath.Clean(a.Path)]; a.Path != "" && ok {
+			continue
+		}
+		attachments = append(attachments, a)
+	}
+	msg.Attachments = attachments
+}
+
+// localImagePath resolves an image src to a file inside baseDir
+func localImagePath(baseDir, src string) (string, bool) {
+	if src == "" || strings.HasPrefix(src, "//") || strings.Contains(src, ":") {
+		return "", false
+	}
+	if unescaped, err := url.PathUnescape(src); err == nil {
+		src = unescaped
+	}
+	if i := strings.IndexAny(src, "?#"); i >= 0 {
+		src = src[:i]
+	}
+	if filepath.IsAbs(src) || strings.HasPrefix(src, "/") {
+		return "", false
+	}
+
+	rel := filepath.Clean(filepath.FromSlash(src))
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	path := filepath.Join(baseDir, rel)
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return "", false
+	}
+	return path, true
+}
+
+// imageContentType returns the MIME type of an image file based on its extension
+func imageContentType(path string) string {
+	if t := mime.TypeByExtension(strings.ToLower(filepath.Ext(path))); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
@@ -1,25 +1,45 @@
 package mailer
 
 import (
-	"bytes"
-	"encoding/base64"
+	"context"
 	"fmt"
-	"html/template"
 	"io"
-	"mime/multipart"
-	"net/smtp"
-	"net/textproto"
 	"os"
-	"path/filepath"
-	"strings"
+	"sync"
+	"time"
 )
 
-// Mailer handles email sending operations
+// Mailer handles email sending operations. It is safe for concurrent use.
 type Mailer struct {
+	mu sync.RWMutex
+
 	email    string
 	password string
 	smtpHost string
 	smtpPort string
+	tlsMode  TLSMode
+	auth     AuthMechanism
+	tokens   TokenSource
+
+	// smtp is built from the settings above on first use so its
+	// connection pool is shared by every send
+	smtp           *SMTPTransport
+	poolSize       int
+	idleTimeout    time.Duration
+	timeout        time.Duration
+	commandTimeout time.Duration
+
+	// transport overrides SMTP delivery when set
+	transport Transport
+	// spooler keeps temporarily failed messages for a later retry
+	spooler Spooler
+	limiter *rateLimiter
+	// dkim signs every message before it reaches the transport
+	dkim *DKIMSigner
+	// keyring holds the PGP keys for messages with Sign or Encrypt set
+	keyring *Keyring
+	// smime signs every message that does not use PGP
+	smime *SMIMESigner
 }
 
 // New creates a new Mailer instance
@@ -27,128 +47,375 @@ func New() *Mailer {
 	return &Mailer{
 		smtpHost: "smtp.gmail.com",
 		smtpPort: "587",
+		tlsMode:  TLSStartTLS,
+		auth:     AuthAuto,
+		poolSize: 2,
+		limiter:  newRateLimiter(),
 	}
 }
 
 // SetCredentials sets the email credentials
 func (m *Mailer) SetCredentials(email, password string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.email = email
 	m.password = password
+	m.resetSMTP()
 }
 
 // GetCredentials returns the current credentials
 func (m *Mailer) GetCredentials() (string, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return m.email, m.password
 }
 
-// IsConfigured returns true if credentials are set
-func (m *Mailer) IsConfigured() bool {
-	return m.email != "" && m.password != ""
+// SetServer sets the SMTP server address and TLS mode
+func (m *Mailer) SetServer(host, port string, mode TLSMode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.smtpHost = host
+	m.smtpPort = port
+	m.tlsMode = mode
+	m.resetSMTP()
 }
 
-// SendPlain sends a plain text email
-func (m *Mailer) SendPlain(to []string, subject, message string, cc, bcc, attachments []string) error {
-	return m.sendEmail(to, subject, message, cc, bcc, attachments, false)
+// GetServer returns the SMTP server address and TLS mode
+func (m *Mailer) GetServer() (string, string, TLSMode) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.smtpHost, m.smtpPort, m.tlsMode
 }
 
-// SendHTML sends an HTML email from a file
-func (m *Mailer) SendHTML(to []string, subject, htmlFile string, cc, bcc, attachments []string) error {
-	var body bytes.Buffer
-	t, err := template.ParseFiles(htmlFile)
-	if err != nil {
-		return fmt.Errorf("error parsing HTML file: %v", err)
+// SetAuth sets the SMTP login mechanism. AuthAuto picks one from the
+// mechanisms the server offers.
+func (m *Mailer) SetAuth(mech AuthMechanism) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.auth = mech
+	m.resetSMTP()
+}
+
+// GetAuth returns the SMTP login mechanism
+func (m *Mailer) GetAuth() AuthMechanism {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.auth
+}
+
+// SetTokenSource sets where OAuth2 access tokens for XOAUTH2 logins come
+// from. It is called for every new connection, so it may refresh expired
+// tokens. Use StaticToken for a fixed token; nil disables XOAUTH2.
+func (m *Mailer) SetTokenSource(ts TokenSource) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens = ts
+	m.resetSMTP()
+}
+
+// SetPool sets how many SMTP connections are kept open between sends and
+// how long an unused connection stays open. A size of 0 opens a new
+// connection for every message.
+func (m *Mailer) SetPool(size int, idleTimeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.poolSize = size
+	m.idleTimeout = idleTimeout
+	m.resetSMTP()
+}
+
+// SetTimeouts sets how long connecting and logging in to the SMTP server
+// may take, and how long any single SMTP command may take. Zero keeps the
+// defaults of 30 and 60 seconds.
+func (m *Mailer) SetTimeouts(timeout, commandTimeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timeout = timeout
+	m.commandTimeout = commandTimeout
+	m.resetSMTP()
+}
+
+// Close closes the pooled SMTP connections
+func (m *Mailer) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.smtp == nil {
+		return nil
 	}
-	if err := t.Execute(&body, struct{ Name string }{Name: "User"}); err != nil {
-		return fmt.Errorf("error executing template: %v", err)
+	err := m.smtp.Close()
+	m.smtp = nil
+	return err
+}
+
+// resetSMTP drops the SMTP transport after a settings change so the next
+// send connects with the new settings. The caller must hold m.mu.
+func (m *Mailer) resetSMTP() {
+	if m.smtp != nil {
+		go m.smtp.Close()
+		m.smtp = nil
 	}
-	return m.sendEmail(to, subject, body.String(), cc, bcc, attachments, true)
 }
 
-// SendHTMLContent sends HTML content directly
-func (m *Mailer) SendHTMLContent(to []string, subject, htmlContent string, cc, bcc, attachments []string) error {
-	return m.sendEmail(to, subject, htmlContent, cc, bcc, attachments, true)
+// SetTransport sets the transport used to deliver messages.
+// A nil transport restores SMTP delivery through the configured server.
+func (m *Mailer) SetTransport(t Transport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transport = t
 }
 
-func (m *Mailer) sendEmail(to []string, subject, content string, cc, bcc, attachments []string, isHTML bool) error {
-	if !m.IsConfigured() {
-		return fmt.Errorf("email credentials not configured")
+// Transport returns the transport used to deliver messages
+func (m *Mailer) Transport() Transport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.transport != nil {
+		return m.transport
+	}
+	if m.smtp == nil {
+		m.smtp = &SMTPTransport{
+			Host:           m.smtpHost,
+			Port:           m.smtpPort,
+			TLS:            m.tlsMode,
+			Username:       m.email,
+			Password:       m.password,
+			Auth:           m.auth,
+			TokenSource:    m.tokens,
+			MaxIdle:        m.poolSize,
+			IdleTimeout:    m.idleTimeout,
+			Timeout:        m.timeout,
+			CommandTimeout: m.commandTimeout,
+		}
+	}
+	return m.smtp
+}
+
+// IsConfigured returns true if the mailer is ready to send. SMTP delivery
+// needs a password or an OAuth2 token source; other transports only need a
+// sender address.
+func (m *Mailer) IsConfigured() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.transport != nil {
+		return m.email != ""
 	}
+	return m.email != "" && (m.password != "" || m.tokens != nil)
+}
 
-	auth := smtp.PlainAuth("", m.email, m.password, m.smtpHost)
+// SetSpooler sets where messages go when delivery fails temporarily.
+// With no spooler such failures are returned to the caller.
+func (m *Mailer) SetSpooler(s Spooler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spooler = s
+}
 
-	recipients := append(append([]string{}, to...), cc...)
-	recipients = append(recipients, bcc...)
+// SetDKIM sets the signer that adds a DKIM-Signature to every outgoing
+// message. A nil signer disables signing.
+func (m *Mailer) SetDKIM(s *DKIMSigner) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dkim = s
+}
+
+// SetKeyring sets the PGP keys used for messages with Sign or Encrypt set
+func (m *Mailer) SetKeyring(kr *Keyring) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keyring = kr
+}
 
-	var buf bytes.Buffer
-	writer := multipart.NewWriter(&buf)
+// Keyring returns the PGP keyring, or nil when PGP is not configured
+func (m *Mailer) Keyring() *Keyring {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keyring
+}
+
+// SetSMIME sets the signer that S/MIME signs every message not protected
+// with PGP. A nil signer disables S/MIME signing.
+func (m *Mailer) SetSMIME(s *SMIMESigner) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.smime = s
+}
+
+// SetRateLimit sets the limits applied to every delivery. The limits are
+// shared by all callers of the Mailer.
+func (m *Mailer) SetRateLimit(limits RateLimit) {
+	m.limiter.setLimits(limits)
+}
+
+// RateStats returns the rate limiter counters
+func (m *Mailer) RateStats() RateStats {
+	return m.limiter.stats()
+}
+
+// Deliver hands an already rendered message to the transport without
+// spooling it on failure, subject to the rate limit, and DKIM signs it when
+// a signer is set. The outbox worker uses it for retries.
+func (m *Mailer) Deliver(ctx context.Context, from string, rcpts []string, msg io.Reader) error {
+	release, err := m.limiter.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
 
-	fmt.Fprintf(&buf, "From: %s\r\n", m.email)
-	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ","))
-	if len(cc) > 0 {
-		fmt.Fprintf(&buf, "Cc: %s\r\n", strings.Join(cc, ","))
+	m.mu.RLock()
+	signer := m.dkim
+	m.mu.RUnlock()
+	if signer != nil {
+		signed, cleanup, err := signer.Sign(msg)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		msg = signed
 	}
-	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
-	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
-	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+	return m.Transport().Send(ctx, from, rcpts, msg)
+}
 
-	bodyHeader := make(textproto.MIMEHeader)
-	if isHTML {
-		bodyHeader.Set("Content-Type", `text/html; charset="UTF-8"`)
-	} else {
-		bodyHeader.Set("Content-Type", `text/plain; charset="UTF-8"`)
+// Send renders msg and delivers it through the configured transport,
+// returning the Message-ID. An empty From is filled in with the configured
+// sender address; display names are kept in the headers while bare
+// addresses form the envelope. When delivery fails temporarily and a
+// spooler is set, the message is queued and the returned error wraps
+// ErrQueued alongside the Message-ID.
+func (m *Mailer) Send(ctx context.Context, msg *Message) (string, error) {
+	if !m.IsConfigured() {
+		return "", fmt.Errorf("email credentials not configured")
+	}
+	sender, _ := m.GetCredentials()
+	if msg.From == "" {
+		msg.From = sender
 	}
-	bodyPart, err := writer.CreatePart(bodyHeader)
+
+	recipients, err := msg.Recipients()
 	if err != nil {
-		return fmt.Errorf("error creating body part: %v", err)
+		return "", err
 	}
-	if _, err := bodyPart.Write([]byte(content)); err != nil {
-		return fmt.Errorf("error writing body part: %v", err)
+	if len(recipients) == 0 {
+		return "", fmt.Errorf("no recipients specified")
 	}
 
-	for _, filePath := range attachments {
-		if filePath == "" {
-			continue
-		}
-		if err := m.attachFile(writer, filePath); err != nil {
-			return fmt.Errorf("error attaching file: %v", err)
-		}
+	if err := msg.checkFiles(); err != nil {
+		return "", err
+	}
+	if err := m.preparePGP(msg, recipients); err != nil {
+		return "", err
+	}
+	if err := m.prepareSMIME(msg); err != nil {
+		return "", err
 	}
 
-	if err := writer.Close(); err != nil {
-		return fmt.Errorf("error closing writer: %v", err)
+	rendered, cleanup, err := renderTemp(msg)
+	if err != nil {
+		return "", err
 	}
+	defer cleanup()
 
-	addr := fmt.Sprintf("%s:%s", m.smtpHost, m.smtpPort)
-	if err := smtp.SendMail(addr, auth, m.email, recipients, buf.Bytes()); err != nil {
-		return fmt.Errorf("error sending email: %v", err)
+	if sendErr := m.Deliver(ctx, sender, recipients, rendered); sendErr != nil {
+		env := Envelope{From: sender, To: recipients, MessageID: msg.MessageID, Subject: msg.Subject}
+		return msg.MessageID, m.spool(env, msg, sendErr)
 	}
-	return nil
+	return msg.MessageID, nil
 }
 
-func (m *Mailer) attachFile(w *multipart.Writer, filePath string) error {
-	file, err := os.Open(filePath)
+// renderTemp renders msg into a temporary file, so an unreadable attachment
+// fails the send before the transport has started delivering a truncated
+// message. The file keeps large attachments out of memory.
+func renderTemp(msg io.WriterTo) (*os.File, func(), error) {
+	file, err := os.CreateTemp("", "gomail-*.eml")
 	if err != nil {
-		return fmt.Errorf("error opening file: %v", err)
+		return nil, nil, fmt.Errorf("error rendering message: %v", err)
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	if _, err := msg.WriteTo(file); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("error rendering message: %v", err)
 	}
-	defer file.Close()
+	return file, cleanup, nil
+}
 
-	filename := filepath.Base(filePath)
-	partHeader := make(textproto.MIMEHeader)
-	partHeader.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
-	partHeader.Set("Content-Type", "application/octet-stream")
-	partHeader.Set("Content-Transfer-Encoding", "base64")
-	part, err := w.CreatePart(partHeader)
-	if err != nil {
-		return fmt.Errorf("error creating part: %v", err)
+// spool queues a message whose delivery failed temporarily and returns the
+// error to report to the caller. Rate limit errors are returned as they are
+// so callers can back off.
+func (m *Mailer) spool(env Envelope, msg io.WriterTo, sendErr error) error {
+	if IsRateLimited(sendErr) {
+		return sendErr
 	}
-	contentBytes, err := io.ReadAll(file)
-	if err != nil {
-		return fmt.Errorf("error reading file: %v", err)
+	m.mu.RLock()
+	spooler := m.spooler
+	m.mu.RUnlock()
+	if spooler == nil || !IsTemporary(sendErr) {
+		return fmt.Errorf("error sending email: %w", sendErr)
+	}
+
+	env.LastError = sendErr.Error()
+	if err := enqueue(spooler, env, msg); err != nil {
+		return fmt.Errorf("error sending email: %w (queueing failed: %v)", sendErr, err)
+	}
+	return fmt.Errorf("%w: %v", ErrQueued, sendErr)
+}
+
+// SendPlain sends a plain text email and returns its Message-ID
+func (m *Mailer) SendPlain(to []string, subject, message string, cc, bcc, attachments []string) (string, error) {
+	return m.SendPlainContext(context.Background(), to, subject, message, cc, bcc, attachments)
+}
+
+// SendPlainContext is like SendPlain but stops when ctx is done
+func (m *Mailer) SendPlainContext(ctx context.Context, to []string, subject, message string, cc, bcc, attachments []string) (string, error) {
+	msg := newMessage(to, subject, cc, bcc, attachments)
+	msg.Text = message
+	return m.Send(ctx, msg)
+}
+
+// SendHTML sends an HTML email from a template file and returns its
+// Message-ID. The template and the subject are executed with data; a nil
+// data value provides {{.Name}} as "User".
+func (m *Mailer) SendHTML(to []string, subject, htmlFile string, cc, bcc, attachments []string, data interface{}) (string, error) {
+	return m.SendHTMLContext(context.Background(), to, subject, htmlFile, cc, bcc, attachments, data)
+}
+
+// SendHTMLContext is like SendHTML but stops when ctx is done
+func (m *Mailer) SendHTMLContext(ctx context.Context, to []string, subject, htmlFile string, cc, bcc, attachments []string, data interface{}) (string, error) {
+	msg := newMessage(to, subject, cc, bcc, attachments)
+	if err := msg.LoadHTMLTemplate(htmlFile, data); err != nil {
+		return "", err
 	}
-	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(contentBytes)))
-	base64.StdEncoding.Encode(encoded, contentBytes)
-	if _, err := part.Write(encoded); err != nil {
-		return fmt.Errorf("error writing part: %v", err)
+	return m.Send(ctx, msg)
+}
+
+// SendHTMLContent sends HTML content directly and returns its Message-ID
+func (m *Mailer) SendHTMLContent(to []string, subject, htmlContent string, cc, bcc, attachments []string) (string, error) {
+	return m.SendHTMLContentContext(context.Background(), to, subject, htmlContent, cc, bcc, attachments)
+}
+
+// SendHTMLContentContext is like SendHTMLContent but stops when ctx is done
+func (m *Mailer) SendHTMLContentContext(ctx context.Context, to []string, subject, htmlContent string, cc, bcc, attachments []string) (string, error) {
+	msg := newMessage(to, subject, cc, bcc, attachments)
+	msg.HTML = htmlContent
+	return m.Send(ctx, msg)
+}
+
+// newMessage builds the common parts of a message for the Send helpers
+func newMessage(to []string, subject string, cc, bcc, attachments []string) *Message {
+	msg := &Message{
+		To:      to,
+		Cc:      cc,
+		Bcc:     bcc,
+		Subject: subject,
+	}
+	for _, filePath := range attachments {
+		if filePath != "" {
+			msg.Attach(filePath)
+		}
 	}
-	return nil
+	return msg
 }
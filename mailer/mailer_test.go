@@ -0,0 +1,289 @@
+package mailer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pranavKharche24/mail/mailer"
+	"github.com/pranavKharche24/mail/mailtest"
+)
+
+// writeFile creates a file in a temporary directory and returns its path
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSendPlain(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	m := srv.Mailer()
+
+	id, err := m.SendPlain([]string{"bob@example.com"}, "Grüße", "Hello Bob",
+		[]string{`"Doe, Jane" <jane@example.com>`}, []string{"hidden@example.com"}, nil)
+	if err != nil {
+		t.Fatalf("SendPlain: %v", err)
+	}
+
+	srv.AssertCount(t, 1)
+	msg := srv.LastMessage(t)
+	msg.AssertFrom(t, "sender@example.com")
+	msg.AssertRecipients(t, "bob@example.com", "jane@example.com", "hidden@example.com")
+	msg.AssertHeader(t, "Subject", "Grüße")
+	msg.AssertHeader(t, "To", "bob@example.com")
+	msg.AssertHeader(t, "Cc", `"Doe, Jane" <jane@example.com>`)
+	msg.AssertHeader(t, "Message-ID", id)
+	msg.AssertNoHeader(t, "Bcc")
+	msg.AssertTextContains(t, "Hello Bob")
+	if msg.HTML != "" || len(msg.Parts) != 0 {
+		t.Errorf("plain message has HTML %q and %d parts", msg.HTML, len(msg.Parts))
+	}
+	if msg.User != "sender@example.com" {
+		t.Errorf("logged in as %q", msg.User)
+	}
+}
+
+func TestSendHTML(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	m := srv.Mailer()
+
+	tmpl := writeFile(t, "welcome.html", []byte(`<h1>Welcome, {{.Name}}</h1><p>Your plan: <b>{{.Plan}}</b></p>`))
+	data := map[string]string{"Name": "Ann", "Plan": "Pro"}
+	if _, err := m.SendHTML([]string{"ann@example.com"}, "Hi {{.Name}}", tmpl, nil, nil, nil, data); err != nil {
+		t.Fatalf("SendHTML: %v", err)
+	}
+
+	msg := srv.LastMessage(t)
+	msg.AssertRecipients(t, "ann@example.com")
+	msg.AssertHeader(t, "Subject", "Hi Ann")
+	msg.AssertHTMLContains(t, "<h1>Welcome, Ann</h1>")
+	msg.AssertHTMLContains(t, "<b>Pro</b>")
+	// The plain-text alternative is generated from the HTML
+	msg.AssertTextContains(t, "Welcome, Ann")
+	msg.AssertTextContains(t, "Your plan: Pro")
+}
+
+func TestSendHTMLContent(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	m := srv.Mailer()
+
+	html := `<p>Line one</p><p><a href="https://example.com/">link</a></p>`
+	if _, err := m.SendHTMLContent([]string{"bob@example.com"}, "Content", html, nil, nil, nil); err != nil {
+		t.Fatalf("SendHTMLContent: %v", err)
+	}
+
+	msg := srv.LastMessage(t)
+	msg.AssertHeader(t, "Subject", "Content")
+	msg.AssertHTMLContains(t, html)
+	msg.AssertTextContains(t, "Line one")
+	msg.AssertTextContains(t, "https://example.com/")
+}
+
+func TestSendAttachments(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	m := srv.Mailer()
+
+	binary := make([]byte, 3000)
+	for i := range binary {
+		binary[i] = byte(i * 7)
+	}
+	text := []byte("name,amount\nAnn,12\n")
+	files := []string{
+		writeFile(t, "data.bin", binary),
+		writeFile(t, "report.csv", text),
+		writeFile(t, "Übersicht.txt", []byte("ä")),
+	}
+
+	if _, err := m.SendPlain([]string{"bob@example.com"}, "Files", "See attached", nil, nil, files); err != nil {
+		t.Fatalf("SendPlain: %v", err)
+	}
+	msg := srv.LastMessage(t)
+	msg.AssertTextContains(t, "See attached")
+	msg.AssertAttachment(t, "data.bin", binary)
+	msg.AssertAttachment(t, "report.csv", text)
+	msg.AssertAttachment(t, "Übersicht.txt", []byte("ä"))
+
+	if _, err := m.SendHTMLContent([]string{"bob@example.com"}, "Files", "<p>See attached</p>", nil, nil, files[:1]); err != nil {
+		t.Fatalf("SendHTMLContent: %v", err)
+	}
+	msg = srv.LastMessage(t)
+	msg.AssertHTMLContains(t, "See attached")
+	msg.AssertAttachment(t, "data.bin", binary)
+}
+
+func TestSendMissingAttachment(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+
+	_, err := srv.Mailer().SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, []string{filepath.Join(t.TempDir(), "missing.pdf")})
+	if err == nil {
+		t.Fatal("send with a missing attachment succeeded")
+	}
+	srv.AssertCount(t, 0)
+	if len(srv.Commands()) != 0 {
+		t.Errorf("server was contacted: %q", srv.Commands())
+	}
+}
+
+func TestSendAuthMechanisms(t *testing.T) {
+	for _, mech := range []string{"PLAIN", "LOGIN", "CRAM-MD5"} {
+		t.Run(mech, func(t *testing.T) {
+			srv := mailtest.NewUnstartedServer()
+			srv.AuthMechanisms = []string{mech}
+			srv.RequireAuth = true
+			srv.Start()
+			defer srv.Close()
+
+			if _, err := srv.Mailer().SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, nil); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			if msg := srv.LastMessage(t); msg.User != "sender@example.com" {
+				t.Errorf("logged in as %q", msg.User)
+			}
+			if cmd := srv.Commands()[1]; cmd != "AUTH "+mech {
+				t.Errorf("second command is %q, want AUTH %s", cmd, mech)
+			}
+		})
+	}
+}
+
+func TestSendAuthFailure(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	m := srv.Mailer()
+	m.SetCredentials("sender@example.com", "wrong")
+
+	_, err := m.SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "535") {
+		t.Fatalf("send with a wrong password returned %v, want a 535 error", err)
+	}
+	if mailer.IsTemporary(err) {
+		t.Errorf("rejected login reported as temporary: %v", err)
+	}
+	srv.AssertCount(t, 0)
+}
+
+func TestSendPermanentFailure(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	m := srv.Mailer()
+	spool := &recordingSpooler{}
+	m.SetSpooler(spool)
+
+	srv.Fail(mailtest.Failure{Command: "EOM", Code: 554, Message: "5.7.1 Message rejected as spam"})
+	_, err := m.SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "5.7.1 Message rejected as spam") {
+		t.Fatalf("send returned %v, want the 554 reply", err)
+	}
+	if mailer.IsTemporary(err) || errors.Is(err, mailer.ErrQueued) {
+		t.Errorf("554 treated as temporary: %v", err)
+	}
+	if len(spool.envelopes) != 0 {
+		t.Errorf("permanently rejected message was queued")
+	}
+	srv.AssertCount(t, 0)
+}
+
+func TestSendTemporaryFailure(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	m := srv.Mailer()
+
+	srv.Fail(mailtest.Failure{Command: "RCPT", Code: 450, Message: "4.2.1 Mailbox busy", Times: 1})
+	_, err := m.SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, nil)
+	if !mailer.IsTemporary(err) {
+		t.Fatalf("send returned %v, want a temporary error", err)
+	}
+	srv.AssertCount(t, 0)
+
+	// The failure was injected once, so the next attempt goes through
+	if _, err := m.SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, nil); err != nil {
+		t.Fatalf("second send: %v", err)
+	}
+	srv.AssertCount(t, 1)
+}
+
+func TestSendTemporaryFailureQueued(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	m := srv.Mailer()
+	spool := &recordingSpooler{}
+	m.SetSpooler(spool)
+
+	srv.Fail(mailtest.Failure{Command: "MAIL", Code: 451, Message: "4.3.0 Try again later"})
+	id, err := m.SendPlain([]string{"bob@example.com"}, "Queued", "body", nil, []string{"hidden@example.com"}, nil)
+	if !errors.Is(err, mailer.ErrQueued) {
+		t.Fatalf("send returned %v, want ErrQueued", err)
+	}
+	if len(spool.envelopes) != 1 {
+		t.Fatalf("%d messages queued, want 1", len(spool.envelopes))
+	}
+	env := spool.envelopes[0]
+	if env.MessageID != id || env.Subject != "Queued" || len(env.To) != 2 || !strings.Contains(env.LastError, "451") {
+		t.Errorf("queued envelope %+v", env)
+	}
+	if !bytes.Contains(spool.messages[0], []byte("body")) || bytes.Contains(spool.messages[0], []byte("hidden@")) {
+		t.Errorf("queued message:\n%s", spool.messages[0])
+	}
+}
+
+func TestSendGreetingFailure(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+
+	srv.Fail(mailtest.Failure{Command: "CONNECT", Code: 421, Message: "4.3.2 Too busy"})
+	_, err := srv.Mailer().SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, nil)
+	if !mailer.IsTemporary(err) {
+		t.Fatalf("send returned %v, want a temporary error", err)
+	}
+}
+
+func TestSendRenderFailure(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	m := srv.Mailer()
+	spool := &recordingSpooler{}
+	m.SetSpooler(spool)
+
+	// The From header cannot be rendered, so nothing may reach the server
+	msg := &mailer.Message{From: "Broken <not an address", To: []string{"bob@example.com"}, Subject: "x", Text: "x"}
+	if _, err := m.Send(context.Background(), msg); err == nil {
+		t.Fatal("send succeeded")
+	}
+	srv.AssertCount(t, 0)
+	if cmds := srv.Commands(); len(cmds) != 0 {
+		t.Errorf("transaction started for a message that cannot be rendered: %q", cmds)
+	}
+	if len(spool.envelopes) != 0 {
+		t.Errorf("message that cannot be rendered was queued")
+	}
+}
+
+// recordingSpooler keeps queued messages in memory
+type recordingSpooler struct {
+	envelopes []mailer.Envelope
+	messages  [][]byte
+}
+
+func (s *recordingSpooler) Enqueue(env mailer.Envelope, msg io.Reader) error {
+	data, err := io.ReadAll(msg)
+	if err != nil {
+		return err
+	}
+	s.envelopes = append(s.envelopes, env)
+	s.messages = append(s.messages, data)
+	return nil
+}
@@ -0,0 +1,196 @@
+package mailer
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// MergeJob describes a mail merge: one message per data row, rendered
+// through the same template engine as SendHTML
+type MergeJob struct {
+	// Template is an HTML (.html, .htm) or plain-text template file
+	Template string
+	// Subject is rendered as a text template for every row
+	Subject string
+	// ToField names the column holding each recipient (default "email")
+	ToField string
+	Cc      []string
+	Bcc     []string
+
+	Attachments []string
+}
+
+// MergeResult reports the outcome for one data row
+type MergeResult struct {
+	Row       int
+	To        string
+	MessageID string
+	// File is the rendered message written during a dry run
+	File string
+	// Queued is set when delivery failed temporarily and the message was
+	// left in the outbox for a retry
+	Queued bool
+	Err    error
+}
+
+// LoadMergeData reads merge rows from a CSV file with a header row or a
+// JSON file containing an array of objects
+func LoadMergeData(path string) ([]map[string]interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening data file: %v", err)
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var rows []map[string]interface{}
+		if err := json.NewDecoder(file).Decode(&rows); err != nil {
+			return nil, fmt.Errorf("error parsing JSON data: %v", err)
+		}
+		return rows, nil
+	}
+	return readCSVRows(file)
+}
+
+func readCSVRows(r io.Reader) ([]map[string]interface{}, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CSV data: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("CSV data has no header row")
+	}
+
+	header := records[0]
+	rows := make([]map[string]interface{}, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(header))
+		for i, key := range header {
+			if i < len(record) {
+				row[strings.TrimSpace(key)] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Merge renders and sends one message per row. With dryRunDir set, the
+// rendered messages are written there as .eml files instead of being sent.
+func (m *Mailer) Merge(ctx context.Context, job MergeJob, rows []map[string]interface{}, dryRunDir string) []MergeResult {
+	toField := job.ToField
+	if toField == "" {
+		toField = "email"
+	}
+	if dryRunDir != "" {
+		if err := os.MkdirAll(dryRunDir, 0755); err != nil {
+			return []MergeResult{{Err: fmt.Errorf("error creating output directory: %v", err)}}
+		}
+	}
+
+	results := make([]MergeResult, 0, len(rows))
+	for i, row := range rows {
+		result := MergeResult{Row: i + 1}
+
+		msg, err := m.mergeMessage(job, row, toField)
+		if err == nil {
+			result.To = strings.Join(msg.To, ", ")
+			if dryRunDir != "" {
+				result.File, err = writeMergeFile(dryRunDir, i+1, msg)
+				result.MessageID = msg.MessageID
+			} else {
+				result.MessageID, err = m.Send(ctx, msg)
+				if errors.Is(err, ErrQueued) {
+					result.Queued, err = true, nil
+				}
+			}
+		}
+		result.Err = err
+		results = append(results, result)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return results
+}
+
+// mergeMessage renders the message for one row
+func (m *Mailer) mergeMessage(job MergeJob, row map[string]interface{}, toField string) (*Message, error) {
+	value, ok := lookupField(row, toField)
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil, fmt.Errorf("missing recipient field %q", toField)
+	}
+	to, err := ParseAddressList(value)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := newMessage(to, job.Subject, job.Cc, job.Bcc, job.Attachments)
+	msg.From, _ = m.GetCredentials()
+
+	switch strings.ToLower(filepath.Ext(job.Template)) {
+	case ".html", ".htm":
+		if err := msg.LoadHTMLTemplate(job.Template, row); err != nil {
+			return nil, err
+		}
+	default:
+		content, err := os.ReadFile(job.Template)
+		if err != nil {
+			return nil, fmt.Errorf("error reading template: %v", err)
+		}
+		if msg.Text, err = RenderText("body", string(content), row); err != nil {
+			return nil, err
+		}
+		if msg.Subject, err = RenderText("subject", job.Subject, row); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// lookupField finds a row value by name, ignoring case
+func lookupField(row map[string]interface{}, name string) (string, bool) {
+	if v, ok := row[name]; ok {
+		return fmt.Sprint(v), true
+	}
+	for key, v := range row {
+		if strings.EqualFold(key, name) {
+			return fmt.Sprint(v), true
+		}
+	}
+	return "", false
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._@-]+`)
+
+// writeMergeFile renders msg into an .eml file for a dry run
+func writeMergeFile(dir string, row int, msg *Message) (string, error) {
+	recipients, err := msg.Recipients()
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%04d-%s.eml", row, unsafeFileChars.ReplaceAllString(strings.Join(recipients, "_"), "_"))
+	path := filepath.Join(dir, name)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", fmt.Errorf("error creating %s: %v", name, err)
+	}
+	if _, err := msg.WriteTo(file); err != nil {
+		file.Close()
+		os.Remove(path)
+		return "", err
+	}
+	return path, file.Close()
+}
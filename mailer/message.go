@@ -0,0 +1,497 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message is an email message that can be rendered with WriteTo or
+// delivered with Mailer.Send
+type Message struct {
+	From    string
+	To      []string
+	Cc      []string
+	Bcc     []string
+	ReplyTo []string
+	Subject string
+
+	// MessageID and Date are generated when the message is rendered if
+	// they are empty
+	MessageID string
+	Date      time.Time
+
+	// InReplyTo and References hold the Message-IDs of the thread being
+	// replied to. References defaults to InReplyTo.
+	InReplyTo  string
+	References []string
+
+	// Headers holds extra header fields such as X-Mailer
+	Headers map[string]string
+
+	// Text and HTML are the message bodies. HTML messages are sent as
+	// multipart/alternative; when Text is empty the plain-text part is
+	// generated from the HTML with HTMLToText.
+	Text string
+	HTML string
+
+	Attachments []Attachment
+	// Inline parts are referenced from the HTML body by Content-ID
+	Inline []Attachment
+
+	// Sign and Encrypt protect the message with PGP/MIME using the keys in
+	// Keyring, which Mailer.Send fills in from the Mailer's keyring
+	Sign    bool
+	Encrypt bool
+	Keyring *Keyring
+	// SMIME signs the message with an X.509 certificate instead. Mailer.Send
+	// fills it in from the Mailer unless PGP is used.
+	SMIME *SMIMESigner
+}
+
+// Attachment is a file attached to or embedded in a message. The content
+// is read from Path when it is set, otherwise Data is used.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Path        string
+	Data        []byte
+}
+
+// Attach adds a file from disk as an attachment
+func (msg *Message) Attach(path string) {
+	msg.Attachments = append(msg.Attachments, Attachment{
+		Filename: filepath.Base(path),
+		Path:     path,
+	})
+}
+
+// AttachData adds in-memory content as an attachment
+func (msg *Message) AttachData(filename string, data []byte) {
+	msg.Attachments = append(msg.Attachments, Attachment{
+		Filename: filename,
+		Data:     data,
+	})
+}
+
+// Embed adds a file from disk as an inline part and returns its Content-ID,
+// which the HTML body can reference as "cid:<id>"
+func (msg *Message) Embed(path string) string {
+	cid := fmt.Sprintf("img%d.%s@gomail", len(msg.Inline)+1, randomID())
+	msg.Inline = append(msg.Inline, Attachment{
+		Filename:    filepath.Base(path),
+		ContentType: imageContentType(path),
+		ContentID:   cid,
+		Path:        path,
+	})
+	return cid
+}
+
+// LoadHTMLTemplate renders an HTML template file into the HTML body and
+// the Subject as a text template, both with the given data (a map or
+// struct). Images referenced with paths relative to the file are embedded
+// inline.
+func (msg *Message) LoadHTMLTemplate(htmlFile string, data interface{}) error {
+	body, err := RenderHTMLFile(htmlFile, data)
+	if err != nil {
+		return err
+	}
+	subject, err := RenderText("subject", msg.Subject, data)
+	if err != nil {
+		return err
+	}
+	msg.HTML = body
+	msg.Subject = subject
+	msg.EmbedImages(filepath.Dir(htmlFile))
+	return nil
+}
+
+// Recipients returns the bare envelope addresses of the To, Cc and Bcc
+// recipients
+func (msg *Message) Recipients() ([]string, error) {
+	recipients := append(append([]string{}, msg.To...), msg.Cc...)
+	return envelopeAddresses(append(recipients, msg.Bcc...))
+}
+
+// WriteTo renders the message in RFC 5322 format. Bcc recipients are not
+// written to the headers. An empty MessageID or Date is filled in on msg.
+func (msg *Message) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	if err := msg.write(cw); err != nil {
+		return cw.n, err
+	}
+	return cw.n, bw.Flush()
+}
+
+func (msg *Message) write(w io.Writer) error {
+	if strings.TrimSpace(msg.From) == "" {
+		return fmt.Errorf("message has no From address")
+	}
+	if msg.MessageID == "" {
+		msg.MessageID = generateMessageID(msg.From)
+	}
+	if msg.Date.IsZero() {
+		msg.Date = time.Now()
+	}
+
+	var header strings.Builder
+	writeHeader := func(key, value string) {
+		header.WriteString(foldHeader(key, value))
+	}
+	writeAddresses := func(key string, list []string) error {
+		if len(list) == 0 {
+			return nil
+		}
+		value, err := formatAddressList(list)
+		if err != nil {
+			return err
+		}
+		writeHeader(key, value)
+		return nil
+	}
+
+	writeHeader("Date", formatDate(msg.Date))
+	if err := writeAddresses("From", []string{msg.From}); err != nil {
+		return err
+	}
+	if err := writeAddresses("To", msg.To); err != nil {
+		return err
+	}
+	if err := writeAddresses("Cc", msg.Cc); err != nil {
+		return err
+	}
+	if err := writeAddresses("Reply-To", msg.ReplyTo); err != nil {
+		return err
+	}
+	writeHeader("Subject", encodeHeader(msg.Subject))
+	writeHeader("Message-ID", normalizeMessageID(msg.MessageID))
+
+	if msg.InReplyTo != "" {
+		writeHeader("In-Reply-To", normalizeMessageID(msg.InReplyTo))
+	}
+	references := msg.References
+	if len(references) == 0 && msg.InReplyTo != "" {
+		references = []string{msg.InReplyTo}
+	}
+	if len(references) > 0 {
+		ids := make([]string, 0, len(references))
+		for _, id := range references {
+			ids = append(ids, normalizeMessageID(id))
+		}
+		writeHeader("References", strings.Join(ids, " "))
+	}
+
+	keys := make([]string, 0, len(msg.Headers))
+	for key := range msg.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := textproto.CanonicalMIMEHeaderKey(key)
+		if reservedHeaders[name] {
+			return fmt.Errorf("header %s cannot be set as a custom header", name)
+		}
+		writeHeader(name, encodeHeader(msg.Headers[key]))
+	}
+	writeHeader("MIME-Version", "1.0")
+
+	// The top-level part shares its header block with the message headers
+	create := func(h textproto.MIMEHeader) (io.Writer, error) {
+		if _, err := io.WriteString(w, header.String()); err != nil {
+			return nil, err
+		}
+		if err := writeMIMEHeader(w, h); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	if msg.Sign || msg.Encrypt || msg.SMIME != nil {
+		return msg.writeProtected(create)
+	}
+	return msg.writeMixed(create)
+}
+
+// mimeEntity is a rendered MIME part: its header and encoded body
+type mimeEntity struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// bytes returns the entity exactly as it is written into the message
+func (e mimeEntity) bytes() []byte {
+	var buf bytes.Buffer
+	writeMIMEHeader(&buf, e.header)
+	buf.Write(e.body)
+	return buf.Bytes()
+}
+
+// writeProtected renders the body signed with S/MIME, or as PGP/MIME
+// (RFC 3156): multipart/signed when signing, multipart/encrypted when
+// encrypting, and a signed entity inside an encrypted one when doing both.
+// The body is held in memory because it is signed or encrypted as a whole.
+func (msg *Message) writeProtected(create partCreator) error {
+	if msg.SMIME != nil && (msg.Sign || msg.Encrypt) {
+		return fmt.Errorf("a message cannot use both S/MIME and PGP")
+	}
+	if msg.SMIME == nil && msg.Keyring == nil {
+		return fmt.Errorf("PGP signing and encryption need a keyring")
+	}
+
+	var entity mimeEntity
+	var body bytes.Buffer
+	err := msg.writeMixed(func(h textproto.MIMEHeader) (io.Writer, error) {
+		entity.header = h
+		return &body, nil
+	})
+	if err != nil {
+		return err
+	}
+	entity.body = body.Bytes()
+
+	if msg.SMIME != nil {
+		entity, err = msg.SMIME.signEntity(entity, msg.Date)
+	}
+	if msg.Sign && err == nil {
+		entity, err = msg.signEntity(entity)
+	}
+	if msg.Encrypt && err == nil {
+		entity, err = msg.encryptEntity(entity)
+	}
+	if err != nil {
+		return err
+	}
+
+	w, err := create(entity.header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(entity.body)
+	return err
+}
+
+// multipartSigned builds a multipart/signed entity (RFC 1847) from the
+// signed entity and its detached signature. The first part is written by
+// hand because it must appear exactly as it was signed, header included.
+func multipartSigned(signed []byte, protocol, micalg string, sigHeader textproto.MIMEHeader, sig []byte) mimeEntity {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	var body bytes.Buffer
+	body.WriteString("--" + boundary + "\r\n")
+	body.Write(signed)
+	body.WriteString("\r\n--" + boundary + "\r\n")
+	writeMIMEHeader(&body, sigHeader)
+	body.Write(sig)
+	body.WriteString("\r\n--" + boundary + "--\r\n")
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", mime.FormatMediaType("multipart/signed", map[string]string{
+		"boundary": boundary,
+		"micalg":   micalg,
+		"protocol": protocol,
+	}))
+	return mimeEntity{header: h, body: body.Bytes()}
+}
+
+// partCreator starts a MIME part with the given header and returns a
+// writer for its body
+type partCreator func(textproto.MIMEHeader) (io.Writer, error)
+
+func (msg *Message) writeMixed(create partCreator) error {
+	if len(msg.Attachments) == 0 {
+		return msg.writeAlternative(create)
+	}
+	return writeMultipart(create, "mixed", func(mw *multipart.Writer) error {
+		if err := msg.writeAlternative(mw.CreatePart); err != nil {
+			return err
+		}
+		for _, a := range msg.Attachments {
+			if err := writeAttachment(mw.CreatePart, a, "attachment"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (msg *Message) writeAlternative(create partCreator) error {
+	if msg.HTML == "" {
+		return writeTextPart(create, "text/plain", msg.Text)
+	}
+	text := msg.Text
+	if text == "" {
+		text = HTMLToText(msg.HTML)
+	}
+	return writeMultipart(create, "alternative", func(mw *multipart.Writer) error {
+		if err := writeTextPart(mw.CreatePart, "text/plain", text); err != nil {
+			return err
+		}
+		return msg.writeRelated(mw.CreatePart)
+	})
+}
+
+func (msg *Message) writeRelated(create partCreator) error {
+	if len(msg.Inline) == 0 {
+		return writeTextPart(create, "text/html", msg.HTML)
+	}
+	return writeMultipart(create, "related", func(mw *multipart.Writer) error {
+		if err := writeTextPart(mw.CreatePart, "text/html", msg.HTML); err != nil {
+			return err
+		}
+		for _, a := range msg.Inline {
+			if err := writeAttachment(mw.CreatePart, a, "inline"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func writeMultipart(create partCreator, subtype string, fn func(*multipart.Writer) error) error {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary}))
+	w, err := create(h)
+	if err != nil {
+		return fmt.Errorf("error creating %s part: %v", subtype, err)
+	}
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+	if err := fn(mw); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+func writeTextPart(create partCreator, mediaType, content string) error {
+	encoding := chooseTextEncoding(content)
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", mediaType+`; charset="UTF-8"`)
+	h.Set("Content-Transfer-Encoding", encoding)
+	w, err := create(h)
+	if err != nil {
+		return fmt.Errorf("error creating body part: %v", err)
+	}
+
+	if encoding == "base64" {
+		err = writeBase64(w, strings.NewReader(canonicalLineBreaks(content)))
+	} else {
+		err = writeQuotedPrintable(w, content)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing body part: %v", err)
+	}
+	return nil
+}
+
+func writeAttachment(create partCreator, a Attachment, disposition string) error {
+	var content io.Reader = bytes.NewReader(a.Data)
+	if a.Path != "" {
+		file, err := os.Open(a.Path)
+		if err != nil {
+			return fmt.Errorf("error opening file: %v", err)
+		}
+		defer file.Close()
+		content = file
+	}
+
+	filename := a.Filename
+	if filename == "" && a.Path != "" {
+		filename = filepath.Base(a.Path)
+	}
+	contentType := a.ContentType
+	if contentType == "" {
+		detected, r, err := detectContentType(filename, content)
+		if err != nil {
+			return fmt.Errorf("error reading file: %v", err)
+		}
+		contentType, content = detected, r
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", formatDisposition(disposition, filename))
+	h.Set("Content-Type", withNameParam(contentType, filename))
+	h.Set("Content-Transfer-Encoding", "base64")
+	if a.ContentID != "" {
+		h.Set("Content-ID", "<"+a.ContentID+">")
+	}
+	w, err := create(h)
+	if err != nil {
+		return fmt.Errorf("error creating part: %v", err)
+	}
+	if err := writeBase64(w, content); err != nil {
+		return fmt.Errorf("error writing part: %v", err)
+	}
+	return nil
+}
+
+// checkFiles makes sure every attachment read from disk can be opened, so
+// a missing file is reported before delivery starts
+func (msg *Message) checkFiles() error {
+	for _, list := range [][]Attachment{msg.Attachments, msg.Inline} {
+		for _, a := range list {
+			if a.Path == "" {
+				continue
+			}
+			info, err := os.Stat(a.Path)
+			if err != nil {
+				return fmt.Errorf("error attaching file: %v", err)
+			}
+			if info.IsDir() {
+				return fmt.Errorf("error attaching file: %s is a directory", a.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// writeMIMEHeader writes h followed by the blank line that ends a header block
+func writeMIMEHeader(w io.Writer, h textproto.MIMEHeader) error {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range h[key] {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", key, value); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// randomID returns a random hex string for Content-IDs and boundaries
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
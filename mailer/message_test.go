@@ -0,0 +1,237 @@
+package mailer_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// leafPart is a decoded single part of a parsed message
+type leafPart struct {
+	contentType string
+	encoding    string
+	filename    string
+	data        string
+}
+
+var goldenTests = []struct {
+	name  string
+	msg   mailer.Message
+	check func(t *testing.T, parts []leafPart)
+}{
+	{
+		// Latin text with a few 8-bit characters is cheaper as QP
+		name: "qp-8bit",
+		msg:  mailer.Message{Subject: "Grüße aus Köln", Text: "Grüße aus Köln, naïve café, 100 % sure.\r\nZweite Zeile = gleich.\r\n"},
+		check: func(t *testing.T, parts []leafPart) {
+			wantParts(t, parts, leafPart{"text/plain", "quoted-printable", "", "Grüße aus Köln, naïve café, 100 % sure.\r\nZweite Zeile = gleich.\r\n"})
+		},
+	},
+	{
+		// Cyrillic is almost all 8-bit, so base64 is smaller
+		name: "base64-cyrillic",
+		msg:  mailer.Message{Subject: "Привет", Text: "Привет, мир! Это почти полностью не-ASCII текст.\r\nВторая строка.\r\n"},
+		check: func(t *testing.T, parts []leafPart) {
+			wantParts(t, parts, leafPart{"text/plain", "base64", "", "Привет, мир! Это почти полностью не-ASCII текст.\r\nВторая строка.\r\n"})
+		},
+	},
+	{
+		name: "long-lines",
+		msg: mailer.Message{
+			Subject: "A subject line that is long enough that it has to be folded onto a second header line",
+			Text:    strings.Repeat("word ", 60) + "end\r\n" + strings.Repeat("x", 200) + "\r\n",
+		},
+		check: func(t *testing.T, parts []leafPart) {
+			wantParts(t, parts, leafPart{"text/plain", "quoted-printable", "", strings.Repeat("word ", 60) + "end\r\n" + strings.Repeat("x", 200) + "\r\n"})
+		},
+	},
+	{
+		// Trailing whitespace must be encoded or transports strip it
+		name: "trailing-space",
+		msg: mailer.Message{
+			Subject: "Trailing space",
+			Text:    "Signature follows\r\n-- \r\ntab at the end\t\r\nlast line with space ",
+			HTML:    "<p>Signature follows</p>\r\n<p>-- </p>\r\n",
+		},
+		check: func(t *testing.T, parts []leafPart) {
+			wantParts(t, parts,
+				leafPart{"text/plain", "quoted-printable", "", "Signature follows\r\n-- \r\ntab at the end\t\r\nlast line with space "},
+				leafPart{"text/html", "quoted-printable", "", "<p>Signature follows</p>\r\n<p>-- </p>\r\n"},
+			)
+		},
+	},
+	{
+		name: "attachments",
+		msg: mailer.Message{
+			Subject: "Files",
+			Text:    "See the attached files.\r\n",
+			Attachments: []mailer.Attachment{
+				{Filename: "Übersicht 2024.csv", ContentType: "text/csv", Data: []byte("a,b\r\n1,2\r\n")},
+				{Filename: "blob.bin", ContentType: "application/octet-stream", Data: bytes.Repeat([]byte{0, 1, 2, 0xff}, 40)},
+			},
+		},
+		check: func(t *testing.T, parts []leafPart) {
+			wantParts(t, parts,
+				leafPart{"text/plain", "quoted-printable", "", "See the attached files.\r\n"},
+				leafPart{"text/csv", "base64", "Übersicht 2024.csv", "a,b\r\n1,2\r\n"},
+				leafPart{"application/octet-stream", "base64", "blob.bin", string(bytes.Repeat([]byte{0, 1, 2, 0xff}, 40))},
+			)
+		},
+	},
+}
+
+func TestGoldenMessages(t *testing.T) {
+	for _, tt := range goldenTests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.msg
+			msg.From = "Jörg Sender <sender@example.com>"
+			msg.To = []string{"bob@example.com"}
+			msg.MessageID = "<golden@example.com>"
+			msg.Date = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+			var buf bytes.Buffer
+			if _, err := msg.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			got := normalizeBoundaries(buf.Bytes())
+
+			path := filepath.Join("testdata", "golden", tt.name+".eml")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("rendered message differs from %s (run go test -update after checking the change):\n%s", path, got)
+			}
+
+			parsed, err := mail.ReadMessage(bytes.NewReader(got))
+			if err != nil {
+				t.Fatal(err)
+			}
+			subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+			if err != nil || subject != tt.msg.Subject {
+				t.Errorf("Subject decodes to %q (%v), want %q", subject, err, tt.msg.Subject)
+			}
+			from, err := parsed.Header.AddressList("From")
+			if err != nil || len(from) != 1 || from[0].Name != "Jörg Sender" {
+				t.Errorf("From parses as %v (%v)", from, err)
+			}
+			for i, line := range strings.Split(string(got), "\r\n") {
+				if len(line) > 78 {
+					t.Errorf("line %d is %d characters long: %q", i+1, len(line), line)
+				}
+			}
+			tt.check(t, leafParts(t, textprotoHeader(parsed.Header), parsed.Body))
+		})
+	}
+}
+
+// normalizeBoundaries replaces the random multipart boundaries with
+// numbered ones, so renderings can be compared
+func normalizeBoundaries(data []byte) []byte {
+	for i, m := range regexp.MustCompile(`boundary=([0-9a-f]+)`).FindAllSubmatch(data, -1) {
+		data = bytes.ReplaceAll(data, m[1], []byte(fmt.Sprintf("BOUNDARY-%d", i+1)))
+	}
+	return data
+}
+
+func textprotoHeader(h mail.Header) map[string][]string {
+	return map[string][]string(h)
+}
+
+// leafParts walks a MIME tree and decodes every single part, checking that
+// encoded lines stay within 76 characters
+func leafParts(t *testing.T, header map[string][]string, body io.Reader) []leafPart {
+	t.Helper()
+	get := func(key string) string {
+		if v := header[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	mediaType, params, err := mime.ParseMediaType(get("Content-Type"))
+	if err != nil {
+		t.Fatalf("Content-Type %q: %v", get("Content-Type"), err)
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var parts []leafPart
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return parts
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts = append(parts, leafParts(t, p.Header, p)...)
+		}
+	}
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("%s: encoded line of %d characters", mediaType, len(line))
+		}
+		if strings.HasSuffix(line, " ") || strings.HasSuffix(line, "\t") {
+			t.Errorf("%s: encoded line ends in whitespace: %q", mediaType, line)
+		}
+	}
+	part := leafPart{contentType: mediaType, encoding: get("Content-Transfer-Encoding")}
+	var decoded []byte
+	switch part.encoding {
+	case "quoted-printable":
+		decoded, err = io.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+	case "base64":
+		decoded, err = base64.StdEncoding.DecodeString(strings.ReplaceAll(string(raw), "\r\n", ""))
+	default:
+		t.Fatalf("%s: unexpected Content-Transfer-Encoding %q", mediaType, part.encoding)
+	}
+	if err != nil {
+		t.Fatalf("decoding %s: %v", mediaType, err)
+	}
+	part.data = string(decoded)
+	if _, params, err := mime.ParseMediaType(get("Content-Disposition")); err == nil {
+		part.filename = params["filename"]
+	}
+	return []leafPart{part}
+}
+
+func wantParts(t *testing.T, got []leafPart, want ...leafPart) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d parts, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("part %d is %+q, want %+q", i+1, got[i], want[i])
+		}
+	}
+}
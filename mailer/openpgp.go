@@ -0,0 +1,1079 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512" // SHA-384 and SHA-512 self-signatures
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// This file implements the small subset of OpenPGP (RFC 4880) needed for
+// PGP/MIME: reading RSA keys from a keyring, making detached signatures and
+// encrypting to public keys. User IDs, subkeys and key flags are only
+// trusted when their self-signature verifies. Keyrings holding keys of
+// other algorithms, such as the Ed25519 and Cv25519 keys GnuPG creates by
+// default, are rejected when they are loaded.
+//
+// Design notes
+//
+// Gomail depends on the standard library only, and golang.org/x/crypto/openpgp
+// is deprecated and frozen, so the code here covers exactly what sending
+// needs and nothing more. It never decrypts or verifies incoming mail, so
+// it holds no oracle an attacker could query.
+//
+// Parsing: a keyring is untrusted input. Packets are read from a
+// bytes.Reader and every length is checked against the bytes left before
+// anything is allocated or sliced (readN, readMPI), so malformed input is
+// an error and never a panic. FuzzReadKeyring exercises this. Packets and
+// signatures of unknown types are skipped.
+//
+// Trust: an address maps to a key only through a user ID whose
+// self-certification verifies, and a subkey is used only with a verifying
+// binding signature. Third-party certifications are ignored; the keyring
+// file itself is the statement of trust. Revocations and expiry times are
+// not evaluated either, so revoked or expired keys must be removed from
+// the keyring.
+//
+// Cryptography: all primitives come from crypto/*. Signatures are RSA
+// PKCS #1 v1.5 over SHA-256. Messages are encrypted with a random AES-256
+// session key in a SEIPD packet with a modification detection code, and
+// the session key with RSA PKCS #1 v1.5 for each recipient. Secret keys
+// are decrypted with a simple, salted or iterated S2K and checked with
+// their SHA-1 hash or checksum. Nothing is compressed.
+//
+// Privacy: every recipient's key ID is visible in the encrypted message,
+// which is why encrypted messages with Bcc recipients are refused.
+
+// OpenPGP packet tags
+const (
+	tagPKESK         = 1
+	tagSignature     = 2
+	tagSecretKey     = 5
+	tagPublicKey     = 6
+	tagSecretSubkey  = 7
+	tagLiteralData   = 11
+	tagUserID        = 13
+	tagUserAttribute = 17
+	tagPublicSubkey  = 14
+	tagSEIPD         = 18
+	tagMDC           = 19
+	pgpAlgoRSA       = 1
+	pgpAlgoRSASign   = 3
+	pgpAlgoRSAEnc    = 2
+	pgpHashSHA256    = 8
+	pgpCipherAES256  = 9
+	pgpFlagSign      = 0x02
+	pgpFlagEncrypt   = 0x04 | 0x08
+	pgpSigBinary     = 0x00
+	pgpSigSubkeyBind = 0x18
+	pgpSubKeyFlags   = 27
+)
+
+// Keyring holds OpenPGP keys for signing and encrypting messages. Only RSA
+// keys can be used.
+type Keyring struct {
+	entities []*pgpEntity
+}
+
+// pgpEntity is a primary key with its user IDs and subkeys
+type pgpEntity struct {
+	primary *pgpKey
+	subkeys []*pgpKey
+	emails  []string
+}
+
+// pgpKey is a public key, with its secret half when the keyring has it
+type pgpKey struct {
+	algo        byte
+	created     uint32
+	fingerprint [20]byte
+	// packet holds the public key fields, which self-signatures hash
+	packet  []byte
+	public  *rsa.PublicKey
+	private *rsa.PrivateKey
+	// bound is set for primary keys and for subkeys with a valid binding
+	// signature by their primary key
+	bound bool
+	// locked is set when the secret key is passphrase protected and could
+	// not be decrypted
+	locked bool
+	// flags holds the key flags from the binding signature; hasFlags is
+	// false when the key does not state its usage
+	flags    byte
+	hasFlags bool
+}
+
+func (k *pgpKey) keyID() []byte {
+	return k.fingerprint[12:]
+}
+
+func (k *pgpKey) canEncrypt() bool {
+	return k.bound && k.public != nil && k.algo != pgpAlgoRSASign && (!k.hasFlags || k.flags&pgpFlagEncrypt != 0)
+}
+
+func (k *pgpKey) canSign() bool {
+	return k.bound && k.public != nil && k.algo != pgpAlgoRSAEnc && (!k.hasFlags || k.flags&pgpFlagSign != 0)
+}
+
+func (k *pgpKey) isRSA() bool {
+	return k.algo == pgpAlgoRSA || k.algo == pgpAlgoRSAEnc || k.algo == pgpAlgoRSASign
+}
+
+// hashKey writes the key as self-signatures hash it
+func (k *pgpKey) hashKey(h hash.Hash) {
+	h.Write([]byte{0x99, byte(len(k.packet) >> 8), byte(len(k.packet))})
+	h.Write(k.packet)
+}
+
+// LoadKeyring reads an armored (or binary) keyring file holding public keys
+// and, for signing, the sender's secret key. The passphrase unlocks
+// protected secret keys and may be empty.
+func LoadKeyring(path, passphrase string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keyring: %v", err)
+	}
+	return ReadKeyring(bytes.NewReader(data), passphrase)
+}
+
+// ReadKeyring reads keys from r like LoadKeyring
+func ReadKeyring(r io.Reader, passphrase string) (*Keyring, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keyring: %v", err)
+	}
+
+	blocks := [][]byte{data}
+	if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		if blocks, err = decodeArmor(data); err != nil {
+			return nil, fmt.Errorf("error reading keyring: %v", err)
+		}
+	}
+
+	kr := &Keyring{}
+	for _, block := range blocks {
+		if err := kr.readPackets(block, passphrase); err != nil {
+			return nil, fmt.Errorf("error reading keyring: %v", err)
+		}
+	}
+	if len(kr.entities) == 0 {
+		return nil, fmt.Errorf("error reading keyring: no keys found")
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) readPackets(data []byte, passphrase string) error {
+	r := bytes.NewReader(data)
+	var entity *pgpEntity
+	// last is the key the following signatures refer to and uid the user
+	// ID certified by them, if any
+	var last *pgpKey
+	var uid []byte
+	for r.Len() > 0 {
+		tag, body, err := readPacket(r)
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case tagPublicKey, tagSecretKey, tagPublicSubkey, tagSecretSubkey:
+			primary := tag == tagPublicKey || tag == tagSecretKey
+			key, err := parseKey(body, tag == tagSecretKey || tag == tagSecretSubkey, passphrase)
+			if err != nil {
+				return err
+			}
+			uid = nil
+			if key == nil {
+				// Unsupported key version
+				last = nil
+				if primary {
+					entity = nil
+				}
+				continue
+			}
+			if !key.isRSA() {
+				owner := nextUserID(r)
+				if !primary && entity != nil && len(entity.emails) > 0 {
+					owner = entity.emails[0]
+				}
+				return unsupportedKeyError(key, owner)
+			}
+			if primary {
+				key.bound = true
+				entity = kr.merge(key)
+				last = entity.primary
+			} else if entity != nil {
+				last = entity.addSubkey(key)
+			}
+		case tagUserID:
+			if entity != nil {
+				last, uid = entity.primary, body
+			}
+		case tagUserAttribute:
+			uid, last = nil, nil
+		case tagSignature:
+			if last == nil || entity == nil {
+				continue
+			}
+			sig, ok := parseSignature(body)
+			if !ok {
+				continue
+			}
+			primary := entity.primary
+			switch {
+			case sig.sigType >= 0x10 && sig.sigType <= 0x13 && last == primary && uid != nil:
+				h := pgpHash(sig.hashAlgo)
+				if h == nil {
+					continue
+				}
+				hasher := h()
+				primary.hashKey(hasher)
+				hasher.Write([]byte{0xb4})
+				hasher.Write(appendUint32(nil, uint32(len(uid))))
+				hasher.Write(uid)
+				if primary.verify(sig, hasher) != nil {
+					continue
+				}
+				entity.addEmail(uidEmail(string(uid)))
+			case sig.sigType == pgpSigSubkeyBind && last != primary:
+				h := pgpHash(sig.hashAlgo)
+				if h == nil {
+					continue
+				}
+				hasher := h()
+				primary.hashKey(hasher)
+				last.hashKey(hasher)
+				if primary.verify(sig, hasher) != nil {
+					continue
+				}
+				last.bound = true
+			default:
+				// Third-party certifications, revocations and other
+				// signatures are not used
+				continue
+			}
+			if sig.hasFlags {
+				last.flags |= sig.flags
+				last.hasFlags = true
+			}
+		}
+	}
+	return nil
+}
+
+// nextUserID returns the address in the next user ID packet of the current
+// entity, to name a key in error messages, without consuming r
+func nextUserID(r *bytes.Reader) string {
+	rest := make([]byte, r.Len())
+	r.ReadAt(rest, r.Size()-int64(r.Len()))
+	ahead := bytes.NewReader(rest)
+	for ahead.Len() > 0 {
+		tag, body, err := readPacket(ahead)
+		if err != nil || tag == tagPublicKey || tag == tagSecretKey {
+			break
+		}
+		if tag == tagUserID {
+			return uidEmail(string(body))
+		}
+	}
+	return ""
+}
+
+// unsupportedKeyError explains that a keyring holds a key that cannot be
+// used, naming its owner when known
+func unsupportedKeyError(key *pgpKey, owner string) error {
+	names := map[byte]string{16: "ElGamal", 17: "DSA", 18: "ECDH (Cv25519 or NIST)", 19: "ECDSA", 22: "EdDSA (Ed25519)"}
+	name := names[key.algo]
+	if name == "" {
+		name = fmt.Sprintf("algorithm %d", key.algo)
+	}
+	if owner != "" {
+		owner = " of " + owner
+	}
+	return fmt.Errorf("key %X%s uses %s, but only RSA keys are supported; create one with 'gpg --quick-gen-key ADDRESS rsa3072' or remove this key", key.keyID(), owner, name)
+}
+
+// merge adds a primary key, combining it with an entry read earlier for the
+// same key so public and secret exports can share one file
+func (kr *Keyring) merge(key *pgpKey) *pgpEntity {
+	for _, e := range kr.entities {
+		if e.primary.fingerprint == key.fingerprint {
+			e.primary.mergeSecret(key)
+			return e
+		}
+	}
+	e := &pgpEntity{primary: key}
+	kr.entities = append(kr.entities, e)
+	return e
+}
+
+// addSubkey adds a subkey, or merges it with one read earlier, and returns
+// the entity's copy
+func (e *pgpEntity) addSubkey(key *pgpKey) *pgpKey {
+	for _, k := range e.subkeys {
+		if k.fingerprint == key.fingerprint {
+			k.mergeSecret(key)
+			return k
+		}
+	}
+	e.subkeys = append(e.subkeys, key)
+	return key
+}
+
+func (e *pgpEntity) addEmail(email string) {
+	if email == "" {
+		return
+	}
+	for _, addr := range e.emails {
+		if addr == email {
+			return
+		}
+	}
+	e.emails = append(e.emails, email)
+}
+
+// mergeSecret takes over the secret half of another copy of the same key
+func (k *pgpKey) mergeSecret(other *pgpKey) {
+	if other.private != nil {
+		k.private, k.locked = other.private, false
+	} else if other.locked && k.private == nil {
+		k.locked = true
+	}
+}
+
+// find returns the entity with a user ID for email
+func (kr *Keyring) find(email string) *pgpEntity {
+	email = strings.ToLower(email)
+	for _, e := range kr.entities {
+		for _, addr := range e.emails {
+			if addr == email {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// HasKey reports whether mail to email can be encrypted
+func (kr *Keyring) HasKey(email string) bool {
+	_, err := kr.encryptionKey(email)
+	return err == nil
+}
+
+// MissingKeys returns the addresses in list that mail cannot be encrypted to
+func (kr *Keyring) MissingKeys(list []string) []string {
+	var missing []string
+	for _, email := range list {
+		if !kr.HasKey(email) {
+			missing = append(missing, email)
+		}
+	}
+	return missing
+}
+
+// encryptionKey returns the key to encrypt mail to email with, preferring
+// the newest usable subkey
+func (kr *Keyring) encryptionKey(email string) (*pgpKey, error) {
+	e := kr.find(email)
+	if e == nil {
+		return nil, fmt.Errorf("no PGP key for %s", email)
+	}
+	for i := len(e.subkeys) - 1; i >= 0; i-- {
+		if e.subkeys[i].canEncrypt() {
+			return e.subkeys[i], nil
+		}
+	}
+	if e.primary.canEncrypt() {
+		return e.primary, nil
+	}
+	return nil, fmt.Errorf("no usable PGP encryption key for %s (only RSA keys are supported)", email)
+}
+
+// signingKey returns the secret key to sign mail from email with
+func (kr *Keyring) signingKey(email string) (*pgpKey, error) {
+	e := kr.find(email)
+	if e == nil {
+		return nil, fmt.Errorf("no PGP key for %s", email)
+	}
+	locked := false
+	for _, k := range append([]*pgpKey{e.primary}, e.subkeys...) {
+		if !k.canSign() {
+			continue
+		}
+		if k.private != nil {
+			return k, nil
+		}
+		locked = locked || k.locked
+	}
+	if locked {
+		return nil, fmt.Errorf("the PGP secret key for %s is passphrase protected; set the passphrase", email)
+	}
+	return nil, fmt.Errorf("no PGP secret key for %s (only RSA keys are supported)", email)
+}
+
+// uidEmail extracts the address from a user ID such as "Name <a@b.com>"
+func uidEmail(uid string) string {
+	if addr, err := mail.ParseAddress(uid); err == nil {
+		return strings.ToLower(addr.Address)
+	}
+	if i := strings.LastIndex(uid, "<"); i >= 0 {
+		if j := strings.Index(uid[i:], ">"); j > 0 {
+			return strings.ToLower(uid[i+1 : i+j])
+		}
+	}
+	if strings.Contains(uid, "@") && !strings.ContainsAny(uid, " <>") {
+		return strings.ToLower(uid)
+	}
+	return ""
+}
+
+// readPacket reads one packet in either the old or the new format
+func readPacket(r *bytes.Reader) (byte, []byte, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	if first&0x80 == 0 {
+		return 0, nil, errors.New("invalid OpenPGP packet")
+	}
+
+	if first&0x40 == 0 {
+		tag := (first >> 2) & 0x0f
+		var length int
+		switch first & 3 {
+		case 0:
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = int(b)
+		case 1:
+			var n uint16
+			if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+				return 0, nil, err
+			}
+			length = int(n)
+		case 2:
+			var n uint32
+			if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+				return 0, nil, err
+			}
+			length = int(n)
+		default:
+			length = r.Len()
+		}
+		body, err := readN(r, length)
+		return tag, body, err
+	}
+
+	tag := first & 0x3f
+	var body []byte
+	for {
+		length, partial, err := readNewLength(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		chunk, err := readN(r, length)
+		if err != nil {
+			return 0, nil, err
+		}
+		body = append(body, chunk...)
+		if !partial {
+			return tag, body, nil
+		}
+	}
+}
+
+func readNewLength(r *bytes.Reader) (int, bool, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch {
+	case b < 192:
+		return int(b), false, nil
+	case b < 224:
+		b2, err := r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return (int(b)-192)<<8 + int(b2) + 192, false, nil
+	case b == 255:
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return 0, false, err
+		}
+		return int(n), false, nil
+	default:
+		return 1 << (b & 0x1f), true, nil
+	}
+}
+
+func readN(r *bytes.Reader, n int) ([]byte, error) {
+	if n < 0 || n > r.Len() {
+		return nil, errors.New("truncated OpenPGP packet")
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+// readMPI reads a multiprecision integer
+func readMPI(r *bytes.Reader) (*big.Int, error) {
+	var bits uint16
+	if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+		return nil, errors.New("truncated OpenPGP key")
+	}
+	buf, err := readN(r, (int(bits)+7)/8)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
+
+// skipPublicFields skips the algorithm-specific public key fields of keys
+// that cannot be used, so their fingerprint and secret part can be found
+func skipPublicFields(r *bytes.Reader, algo byte) error {
+	skipOID := func() error {
+		n, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		_, err = readN(r, int(n))
+		return err
+	}
+	mpis := 0
+	switch algo {
+	case 16: // ElGamal
+		mpis = 3
+	case 17: // DSA
+		mpis = 4
+	case 18: // ECDH: OID, point and KDF parameters
+		if err := skipOID(); err != nil {
+			return err
+		}
+		if _, err := readMPI(r); err != nil {
+			return err
+		}
+		return skipOID()
+	case 19, 22: // ECDSA and EdDSA: OID and point
+		if err := skipOID(); err != nil {
+			return err
+		}
+		mpis = 1
+	default:
+		return fmt.Errorf("unknown public key algorithm %d", algo)
+	}
+	for i := 0; i < mpis; i++ {
+		if _, err := readMPI(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseKey parses a version 4 key packet. It returns nil for other versions.
+func parseKey(body []byte, secret bool, passphrase string) (*pgpKey, error) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, nil
+	}
+	key := &pgpKey{created: binary.BigEndian.Uint32(body[1:5]), algo: body[5]}
+	r := bytes.NewReader(body[6:])
+
+	isRSA := key.algo == pgpAlgoRSA || key.algo == pgpAlgoRSAEnc || key.algo == pgpAlgoRSASign
+	if isRSA {
+		n, err := readMPI(r)
+		if err != nil {
+			return nil, err
+		}
+		e, err := readMPI(r)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("unsupported RSA exponent")
+		}
+		key.public = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	} else if err := skipPublicFields(r, key.algo); err != nil {
+		return nil, err
+	}
+
+	publicLen := len(body) - r.Len()
+	h := sha1.New()
+	h.Write([]byte{0x99, byte(publicLen >> 8), byte(publicLen)})
+	h.Write(body[:publicLen])
+	copy(key.fingerprint[:], h.Sum(nil))
+	key.packet = body[:publicLen]
+
+	if secret && isRSA {
+		if err := key.parseSecret(r, passphrase); err != nil {
+			return nil, fmt.Errorf("secret key %X: %v", key.keyID(), err)
+		}
+	}
+	return key, nil
+}
+
+// parseSecret reads the secret part of an RSA key, decrypting it with
+// passphrase when it is protected
+func (k *pgpKey) parseSecret(r *bytes.Reader, passphrase string) error {
+	usage, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	rest := make([]byte, r.Len())
+	r.Read(rest)
+
+	var plain []byte
+	switch usage {
+	case 0:
+		if len(rest) < 2 {
+			return errors.New("truncated secret key")
+		}
+		plain = rest[:len(rest)-2]
+		if checksum16(plain) != binary.BigEndian.Uint16(rest[len(rest)-2:]) {
+			return errors.New("secret key checksum mismatch")
+		}
+	case 254, 255:
+		if len(rest) > 2 && rest[1] == 101 {
+			// GnuPG stub for a secret key kept elsewhere, e.g. a smartcard
+			return nil
+		}
+		if passphrase == "" {
+			k.locked = true
+			return nil
+		}
+		if plain, err = decryptSecret(rest, usage, passphrase); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported secret key protection %d", usage)
+	}
+
+	pr := bytes.NewReader(plain)
+	var mpis [4]*big.Int
+	for i := range mpis {
+		if mpis[i], err = readMPI(pr); err != nil {
+			return err
+		}
+	}
+	// OpenPGP stores d, p, q and u = p^-1 mod q
+	priv := &rsa.PrivateKey{PublicKey: *k.public, D: mpis[0], Primes: []*big.Int{mpis[1], mpis[2]}}
+	if err := priv.Validate(); err != nil {
+		return fmt.Errorf("invalid secret key: %v", err)
+	}
+	priv.Precompute()
+	k.private = priv
+	return nil
+}
+
+// decryptSecret decrypts passphrase protected secret key material
+func decryptSecret(data []byte, usage byte, passphrase string) ([]byte, error) {
+	r := bytes.NewReader(data)
+	cipherAlgo, _ := r.ReadByte()
+	keySize := map[byte]int{7: 16, 8: 24, 9: 32}[cipherAlgo]
+	if keySize == 0 {
+		return nil, fmt.Errorf("unsupported secret key cipher %d", cipherAlgo)
+	}
+	key, err := readS2K(r, passphrase, keySize)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := readN(r, aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, r.Len())
+	r.Read(plain)
+	cipher.NewCFBDecrypter(block, iv).XORKeyStream(plain, plain)
+
+	wrongPassphrase := errors.New("wrong passphrase")
+	if usage == 254 {
+		if len(plain) < sha1.Size {
+			return nil, wrongPassphrase
+		}
+		body := plain[:len(plain)-sha1.Size]
+		sum := sha1.Sum(body)
+		if !bytes.Equal(sum[:], plain[len(body):]) {
+			return nil, wrongPassphrase
+		}
+		return body, nil
+	}
+	if len(plain) < 2 || checksum16(plain[:len(plain)-2]) != binary.BigEndian.Uint16(plain[len(plain)-2:]) {
+		return nil, wrongPassphrase
+	}
+	return plain[:len(plain)-2], nil
+}
+
+// readS2K reads a string-to-key specifier and derives a key from the
+// passphrase (RFC 4880, section 3.7)
+func readS2K(r *bytes.Reader, passphrase string, keySize int) ([]byte, error) {
+	mode, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	hashAlgo, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	newHash := pgpHash(hashAlgo)
+	if newHash == nil {
+		return nil, fmt.Errorf("unsupported S2K hash %d", hashAlgo)
+	}
+
+	var salt []byte
+	count := 0
+	switch mode {
+	case 0:
+	case 1, 3:
+		if salt, err = readN(r, 8); err != nil {
+			return nil, err
+		}
+		if mode == 3 {
+			c, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			count = (16 + int(c&15)) << (uint(c>>4) + 6)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported S2K mode %d", mode)
+	}
+
+	input := append(salt, passphrase...)
+	if count < len(input) {
+		count = len(input)
+	}
+	var key []byte
+	for i := 0; len(key) < keySize; i++ {
+		h := newHash()
+		h.Write(make([]byte, i))
+		for n := count; n > 0; n -= len(input) {
+			if n < len(input) {
+				h.Write(input[:n])
+				break
+			}
+			h.Write(input)
+		}
+		key = h.Sum(key)
+	}
+	return key[:keySize], nil
+}
+
+func pgpHash(algo byte) func() hash.Hash {
+	if h := pgpCryptoHash(algo); h != 0 {
+		return h.New
+	}
+	return nil
+}
+
+func pgpCryptoHash(algo byte) crypto.Hash {
+	switch algo {
+	case 2:
+		return crypto.SHA1
+	case 8:
+		return crypto.SHA256
+	case 9:
+		return crypto.SHA384
+	case 10:
+		return crypto.SHA512
+	case 11:
+		return crypto.SHA224
+	default:
+		return 0
+	}
+}
+
+// pgpSignature is a parsed version 4 signature packet
+type pgpSignature struct {
+	sigType  byte
+	pubAlgo  byte
+	hashAlgo byte
+	// hashed is the signature data covered by the hash: the version, type,
+	// algorithms and hashed subpackets
+	hashed []byte
+	left16 []byte
+	value  []byte
+	// flags holds the key flags subpacket, if hasFlags
+	flags    byte
+	hasFlags bool
+}
+
+// parseSignature parses a version 4 signature packet
+func parseSignature(body []byte) (*pgpSignature, bool) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, false
+	}
+	sig := &pgpSignature{sigType: body[1], pubAlgo: body[2], hashAlgo: body[3]}
+	n := int(binary.BigEndian.Uint16(body[4:6]))
+	if 6+n+2 > len(body) {
+		return nil, false
+	}
+	sig.hashed = body[:6+n]
+
+	sub := bytes.NewReader(body[6 : 6+n])
+	for sub.Len() > 0 {
+		length, _, err := readNewLength(sub)
+		if err != nil || length == 0 {
+			return nil, false
+		}
+		packet, err := readN(sub, length)
+		if err != nil {
+			return nil, false
+		}
+		if packet[0]&0x7f == pgpSubKeyFlags && len(packet) > 1 {
+			sig.flags, sig.hasFlags = packet[1], true
+		}
+	}
+
+	r := bytes.NewReader(body[6+n:])
+	var unhashed uint16
+	if err := binary.Read(r, binary.BigEndian, &unhashed); err != nil {
+		return nil, false
+	}
+	if _, err := readN(r, int(unhashed)); err != nil {
+		return nil, false
+	}
+	left16, err := readN(r, 2)
+	if err != nil {
+		return nil, false
+	}
+	value, err := readMPI(r)
+	if err != nil {
+		return nil, false
+	}
+	sig.left16, sig.value = left16, value.Bytes()
+	return sig, true
+}
+
+// verify checks an RSA signature by k. h must already hold the signed data.
+func (k *pgpKey) verify(sig *pgpSignature, h hash.Hash) error {
+	if k.public == nil || (sig.pubAlgo != pgpAlgoRSA && sig.pubAlgo != pgpAlgoRSASign) {
+		return errors.New("unsupported signature algorithm")
+	}
+	h.Write(sig.hashed)
+	h.Write([]byte{4, 0xff})
+	h.Write(appendUint32(nil, uint32(len(sig.hashed))))
+	digest := h.Sum(nil)
+	if !bytes.Equal(digest[:2], sig.left16) {
+		return errors.New("signature digest mismatch")
+	}
+	value := sig.value
+	if size := k.public.Size(); len(value) < size {
+		value = append(make([]byte, size-len(value)), value...)
+	}
+	return rsa.VerifyPKCS1v15(k.public, pgpCryptoHash(sig.hashAlgo), digest, value)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func checksum16(b []byte) uint16 {
+	var sum uint16
+	for _, c := range b {
+		sum += uint16(c)
+	}
+	return sum
+}
+
+// sign makes a detached binary signature over data and returns the
+// signature packet
+func (k *pgpKey) sign(data []byte, now time.Time) ([]byte, error) {
+	hashed := []byte{4, pgpSigBinary, pgpAlgoRSA, pgpHashSHA256, 0, 0}
+	// Signature creation time and issuer fingerprint
+	hashed = append(hashed, 5, 2)
+	hashed = appendUint32(hashed, uint32(now.Unix()))
+	hashed = append(hashed, 22, 33, 4)
+	hashed = append(hashed, k.fingerprint[:]...)
+	binary.BigEndian.PutUint16(hashed[4:6], uint16(len(hashed)-6))
+
+	h := sha256.New()
+	h.Write(data)
+	h.Write(hashed)
+	h.Write([]byte{4, 0xff})
+	binary.Write(h, binary.BigEndian, uint32(len(hashed)))
+	digest := h.Sum(nil)
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k.private, crypto.SHA256, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	body := append(hashed, 0, 10, 9, 16)
+	body = append(body, k.keyID()...)
+	body = append(body, digest[:2]...)
+	body = append(body, mpi(sig)...)
+	return packet(tagSignature, body), nil
+}
+
+// encrypt encrypts data as a literal data packet to every key and returns
+// the public-key encrypted session key packets and the encrypted data packet
+func encryptTo(keys []*pgpKey, data []byte, now time.Time) ([]byte, error) {
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, err
+	}
+	material := append([]byte{pgpCipherAES256}, sessionKey...)
+	sum := checksum16(sessionKey)
+	material = append(material, byte(sum>>8), byte(sum))
+
+	var out bytes.Buffer
+	for _, k := range keys {
+		enc, err := rsa.EncryptPKCS1v15(rand.Reader, k.public, material)
+		if err != nil {
+			return nil, err
+		}
+		body := append([]byte{3}, k.keyID()...)
+		body = append(body, pgpAlgoRSA)
+		body = append(body, mpi(enc)...)
+		out.Write(packet(tagPKESK, body))
+	}
+
+	literal := []byte{'b', 0}
+	literal = appendUint32(literal, uint32(now.Unix()))
+	literal = packet(tagLiteralData, append(literal, data...))
+
+	// The random prefix repeats its last two bytes so a wrong key is
+	// detected, and the modification detection code hashes everything
+	prefix := make([]byte, aes.BlockSize+2)
+	if _, err := rand.Read(prefix[:aes.BlockSize]); err != nil {
+		return nil, err
+	}
+	copy(prefix[aes.BlockSize:], prefix[aes.BlockSize-2:aes.BlockSize])
+
+	plain := append(append(prefix, literal...), 0xd3, 0x14)
+	mdc := sha1.Sum(plain)
+	plain = append(plain, mdc[:]...)
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCFBEncrypter(block, make([]byte, aes.BlockSize)).XORKeyStream(plain, plain)
+	out.Write(packet(tagSEIPD, append([]byte{1}, plain...)))
+	return out.Bytes(), nil
+}
+
+// packet frames body as a new format packet
+func packet(tag byte, body []byte) []byte {
+	out := []byte{0xc0 | tag}
+	switch n := len(body); {
+	case n < 192:
+		out = append(out, byte(n))
+	case n < 8384:
+		n -= 192
+		out = append(out, byte(n>>8)+192, byte(n))
+	default:
+		out = append(out, 0xff)
+		out = appendUint32(out, uint32(n))
+	}
+	return append(out, body...)
+}
+
+// mpi encodes b as a multiprecision integer
+func mpi(b []byte) []byte {
+	n := new(big.Int).SetBytes(b)
+	out := []byte{byte(n.BitLen() >> 8), byte(n.BitLen())}
+	return append(out, n.Bytes()...)
+}
+
+// armor encodes data in ASCII armor with CRLF line breaks
+func armor(blockType string, data []byte) string {
+	var b strings.Builder
+	b.WriteString("-----BEGIN " + blockType + "-----\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 64 {
+		b.WriteString(encoded[:64] + "\r\n")
+		encoded = encoded[64:]
+	}
+	b.WriteString(encoded + "\r\n")
+	crc := crc24(data)
+	b.WriteString("=" + base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) + "\r\n")
+	b.WriteString("-----END " + blockType + "-----\r\n")
+	return b.String()
+}
+
+// decodeArmor returns the contents of every armored block in data
+func decodeArmor(data []byte) ([][]byte, error) {
+	var blocks [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	inBlock, inBody := false, false
+	var encoded strings.Builder
+	var checksum string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "-----BEGIN PGP"):
+			inBlock, inBody = true, false
+			encoded.Reset()
+			checksum = ""
+		case strings.HasPrefix(line, "-----END PGP") && inBlock:
+			block, err := base64.StdEncoding.DecodeString(encoded.String())
+			if err != nil {
+				return nil, fmt.Errorf("invalid armor: %v", err)
+			}
+			if checksum != "" {
+				want, err := base64.StdEncoding.DecodeString(checksum)
+				crc := crc24(block)
+				if err != nil || len(want) != 3 || !bytes.Equal(want, []byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) {
+					return nil, errors.New("armor checksum mismatch")
+				}
+			}
+			blocks = append(blocks, block)
+			inBlock = false
+		case !inBlock:
+		case !inBody:
+			// Armor headers end with a blank line
+			if line == "" {
+				inBody = true
+			} else if !strings.Contains(line, ":") {
+				inBody = true
+				encoded.WriteString(line)
+			}
+		case strings.HasPrefix(line, "=") && len(line) == 5:
+			checksum = line[1:]
+		default:
+			encoded.WriteString(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// crc24 is the armor checksum (RFC 4880, section 6.1)
+func crc24(data []byte) uint32 {
+	crc := uint32(0xb704ce)
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1864cfb
+			}
+		}
+	}
+	return crc & 0xffffff
+}
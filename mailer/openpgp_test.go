@@ -0,0 +1,503 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The keys in testdata/pgp were made with GnuPG 2.2: RSA 2048 primary keys
+// for signing with an RSA encryption subkey for Alice (protected with
+// "alice-passphrase"), Bob and Mallory, and GnuPG's default Ed25519 and
+// Cv25519 keys for Carol.
+
+const alicePassphrase = "alice-passphrase"
+
+func loadTestKeyring(t *testing.T, passphrase string, names ...string) *Keyring {
+	t.Helper()
+	var data []byte
+	for _, name := range names {
+		data = append(data, readTestFile(t, "pgp/"+name)...)
+	}
+	kr, err := ReadKeyring(bytes.NewReader(data), passphrase)
+	if err != nil {
+		t.Fatalf("ReadKeyring(%v): %v", names, err)
+	}
+	return kr
+}
+
+func readTestFile(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// testPackets returns the packets of an armored test key as tags and bodies
+func testPackets(t *testing.T, name string) ([]byte, [][]byte) {
+	t.Helper()
+	blocks, err := decodeArmor(readTestFile(t, "pgp/"+name))
+	if err != nil || len(blocks) != 1 {
+		t.Fatalf("decodeArmor(%s): %v", name, err)
+	}
+	var tags []byte
+	var bodies [][]byte
+	r := bytes.NewReader(blocks[0])
+	for r.Len() > 0 {
+		tag, body, err := readPacket(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, tag)
+		bodies = append(bodies, body)
+	}
+	return tags, bodies
+}
+
+func TestReadKeyringGnuPG(t *testing.T) {
+	kr := loadTestKeyring(t, alicePassphrase, "alice.sec.asc", "bob.pub.asc")
+
+	sign, err := kr.signingKey("Alice@Example.com")
+	if err != nil {
+		t.Fatalf("signingKey: %v", err)
+	}
+	alice := kr.find("alice@example.com")
+	if sign != alice.primary {
+		t.Errorf("signing with a subkey, but only the primary key is flagged for signing")
+	}
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		key, err := kr.encryptionKey(email)
+		if err != nil {
+			t.Fatalf("encryptionKey(%s): %v", email, err)
+		}
+		if e := kr.find(email); len(e.subkeys) != 1 || key != e.subkeys[0] {
+			t.Errorf("%s: not encrypting to the encryption subkey", email)
+		}
+	}
+	if _, err := kr.signingKey("bob@example.com"); err == nil {
+		t.Errorf("signing as bob without his secret key succeeded")
+	}
+}
+
+func TestReadKeyringPassphrase(t *testing.T) {
+	if _, err := ReadKeyring(bytes.NewReader(readTestFile(t, "pgp/alice.sec.asc")), "wrong"); err == nil ||
+		!strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("wrong passphrase: %v", err)
+	}
+
+	kr := loadTestKeyring(t, "", "alice.sec.asc")
+	if _, err := kr.signingKey("alice@example.com"); err == nil || !strings.Contains(err.Error(), "passphrase protected") {
+		t.Errorf("signingKey without passphrase: %v", err)
+	}
+	if !kr.HasKey("alice@example.com") {
+		t.Errorf("public half unusable without the passphrase")
+	}
+}
+
+func TestReadKeyringRejectsNonRSA(t *testing.T) {
+	data := append(readTestFile(t, "pgp/bob.pub.asc"), readTestFile(t, "pgp/carol.pub.asc")...)
+	_, err := ReadKeyring(bytes.NewReader(data), "")
+	if err == nil {
+		t.Fatal("keyring with an Ed25519 key was accepted")
+	}
+	for _, want := range []string{"carol@example.com", "EdDSA", "only RSA keys are supported"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestReadKeyringIgnoresForgedSignatures(t *testing.T) {
+	bobTags, bob := testPackets(t, "bob.pub.asc")
+	malloryTags, mallory := testPackets(t, "mallory.pub.asc")
+	if string(bobTags) != string([]byte{tagPublicKey, tagUserID, tagSignature, tagPublicSubkey, tagSignature}) ||
+		string(malloryTags) != string(bobTags) {
+		t.Fatalf("unexpected fixture layout %v %v", bobTags, malloryTags)
+	}
+	build := func(tags []byte, bodies [][]byte) *Keyring {
+		var data []byte
+		for i, body := range bodies {
+			data = append(data, packet(tags[i], body)...)
+		}
+		kr, err := ReadKeyring(bytes.NewReader(data), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return kr
+	}
+
+	// Mallory's subkey with her binding signature, attached to Bob's key
+	kr := build(
+		[]byte{tagPublicKey, tagUserID, tagSignature, tagPublicSubkey, tagSignature},
+		[][]byte{bob[0], bob[1], bob[2], mallory[3], mallory[4]},
+	)
+	if kr.HasKey("bob@example.com") {
+		t.Errorf("encrypting to a subkey whose binding signature is not Bob's")
+	}
+
+	// The forged subkey must not win over Bob's own, although it is newer
+	kr = build(
+		[]byte{tagPublicKey, tagUserID, tagSignature, tagPublicSubkey, tagSignature, tagPublicSubkey, tagSignature},
+		[][]byte{bob[0], bob[1], bob[2], bob[3], bob[4], mallory[3], mallory[4]},
+	)
+	key, err := kr.encryptionKey("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.fingerprint == kr.find("bob@example.com").subkeys[1].fingerprint {
+		t.Errorf("encrypting to Mallory's subkey")
+	}
+
+	// A user ID certified by someone else's signature is not Bob's
+	kr = build(
+		[]byte{tagPublicKey, tagUserID, tagSignature, tagUserID, tagSignature},
+		[][]byte{bob[0], bob[1], bob[2], []byte("Eve <eve@example.com>"), mallory[2]},
+	)
+	if kr.find("eve@example.com") != nil {
+		t.Errorf("accepted a user ID without a valid self-certification")
+	}
+
+	// Key flags from a tampered binding signature are not used
+	sig := append([]byte{}, bob[4]...)
+	sig[len(sig)-1] ^= 1
+	kr = build(
+		[]byte{tagPublicKey, tagUserID, tagSignature, tagPublicSubkey, tagSignature},
+		[][]byte{bob[0], bob[1], bob[2], bob[3], sig},
+	)
+	if kr.HasKey("bob@example.com") {
+		t.Errorf("encrypting to a subkey with a tampered binding signature")
+	}
+}
+
+func TestSignRoundTrip(t *testing.T) {
+	kr := loadTestKeyring(t, alicePassphrase, "alice.sec.asc")
+	key, err := kr.signingKey("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("Content-Type: text/plain\r\n\r\nSigned text\r\n")
+	pkt, err := key.sign(data, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag, body, err := readPacket(bytes.NewReader(pkt))
+	if err != nil || tag != tagSignature {
+		t.Fatalf("signature packet: tag %d, %v", tag, err)
+	}
+	sig, ok := parseSignature(body)
+	if !ok || sig.sigType != pgpSigBinary {
+		t.Fatalf("cannot parse signature %x", body)
+	}
+	h := sha256.New()
+	h.Write(data)
+	if err := key.verify(sig, h); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+	h = sha256.New()
+	h.Write(append(data, '!'))
+	if err := key.verify(sig, h); err == nil {
+		t.Errorf("signature verifies for different data")
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	kr := loadTestKeyring(t, alicePassphrase, "alice.sec.asc", "bob.sec.asc")
+	bob, err := kr.encryptionKey("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := kr.encryptionKey("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("Secret line\r\n"), 1000)
+	encrypted, err := encryptTo([]*pgpKey{bob, alice}, data, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []*pgpKey{bob, alice} {
+		got, err := decryptForTest(encrypted, key)
+		if err != nil {
+			t.Fatalf("decrypting with %X: %v", key.keyID(), err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("decrypted data differs")
+		}
+	}
+
+	encrypted[len(encrypted)-30] ^= 1
+	if _, err := decryptForTest(encrypted, bob); err == nil {
+		t.Errorf("tampered message decrypted without error")
+	}
+}
+
+func TestEncryptRefusesBcc(t *testing.T) {
+	m := New()
+	m.SetCredentials("alice@example.com", "secret")
+	m.SetKeyring(loadTestKeyring(t, alicePassphrase, "alice.sec.asc", "bob.pub.asc", "mallory.pub.asc"))
+	transport := &MemoryTransport{}
+	m.SetTransport(transport)
+
+	msg := &Message{To: []string{"bob@example.com"}, Bcc: []string{"mallory@example.com"}, Subject: "Secret", Text: "x", Encrypt: true}
+	if _, err := m.Send(context.Background(), msg); !errors.Is(err, ErrEncryptedBcc) {
+		t.Fatalf("Send returned %v, want ErrEncryptedBcc", err)
+	}
+	if n := len(transport.Messages()); n != 0 {
+		t.Errorf("%d messages sent", n)
+	}
+
+	// Rendering directly must refuse as well
+	msg.From = "alice@example.com"
+	if _, err := msg.WriteTo(io.Discard); !errors.Is(err, ErrEncryptedBcc) {
+		t.Errorf("WriteTo returned %v, want ErrEncryptedBcc", err)
+	}
+
+	// Without Bcc the message is encrypted and sent
+	msg.Bcc = nil
+	if _, err := m.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if n := len(transport.Messages()); n != 1 {
+		t.Errorf("%d messages sent, want 1", n)
+	}
+}
+
+// decryptForTest decrypts a message made by encryptTo with key
+func decryptForTest(data []byte, key *pgpKey) ([]byte, error) {
+	r := bytes.NewReader(data)
+	var sessionKey []byte
+	for r.Len() > 0 {
+		tag, body, err := readPacket(r)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case tagPKESK:
+			if !bytes.Equal(body[1:9], key.keyID()) {
+				continue
+			}
+			enc, err := readMPI(bytes.NewReader(body[10:]))
+			if err != nil {
+				return nil, err
+			}
+			material, err := rsa.DecryptPKCS1v15(rand.Reader, key.private, enc.Bytes())
+			if err != nil {
+				return nil, err
+			}
+			if material[0] != pgpCipherAES256 || checksum16(material[1:33]) != binary.BigEndian.Uint16(material[33:]) {
+				return nil, errBadSessionKey
+			}
+			sessionKey = material[1:33]
+		case tagSEIPD:
+			if sessionKey == nil {
+				return nil, errBadSessionKey
+			}
+			block, err := aes.NewCipher(sessionKey)
+			if err != nil {
+				return nil, err
+			}
+			plain := make([]byte, len(body)-1)
+			cipher.NewCFBDecrypter(block, make([]byte, aes.BlockSize)).XORKeyStream(plain, body[1:])
+			if !bytes.Equal(plain[14:16], plain[16:18]) {
+				return nil, errBadSessionKey
+			}
+			mdc := sha1.Sum(plain[:len(plain)-20])
+			if !bytes.Equal(mdc[:], plain[len(plain)-20:]) {
+				return nil, errModified
+			}
+			tag, literal, err := readPacket(bytes.NewReader(plain[18 : len(plain)-22]))
+			if err != nil || tag != tagLiteralData {
+				return nil, errModified
+			}
+			return literal[2+int(literal[1])+4:], nil
+		}
+	}
+	return nil, errBadSessionKey
+}
+
+var (
+	errBadSessionKey = testError("no session key for this key")
+	errModified      = testError("modification detected")
+)
+
+type testError string
+
+func (e testError) Error() string { return string(e) }
+
+// gnupg runs gpg with a fresh home directory holding the given test keys,
+// skipping the test when gpg is not installed
+func gnupg(t *testing.T, keys ...string) func(stdin []byte, args ...string) ([]byte, error) {
+	t.Helper()
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not installed")
+	}
+	home, err := os.MkdirTemp("", "gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(stdin []byte, args ...string) ([]byte, error) {
+		cmd := exec.Command("gpg", append([]string{"--homedir", home, "--batch", "--quiet", "--pinentry-mode", "loopback", "--passphrase", alicePassphrase, "--trust-model", "always"}, args...)...)
+		cmd.Stdin = bytes.NewReader(stdin)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return out, testError(err.Error() + ": " + stderr.String())
+		}
+		return out, nil
+	}
+	t.Cleanup(func() {
+		exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run()
+		os.RemoveAll(home)
+	})
+	for _, key := range keys {
+		if _, err := run(readTestFile(t, "pgp/"+key), "--import"); err != nil {
+			t.Fatalf("importing %s: %v", key, err)
+		}
+	}
+	return run
+}
+
+func TestGnuPGVerifiesSignature(t *testing.T) {
+	gpg := gnupg(t, "alice.pub.asc")
+	kr := loadTestKeyring(t, alicePassphrase, "alice.sec.asc")
+	key, err := kr.signingKey("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	data := []byte("Content-Type: text/plain; charset=utf-8\r\n\r\nSigned by gomail\r\n")
+	pkt, err := key.sign(data, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigPath, dataPath := filepath.Join(dir, "data.asc"), filepath.Join(dir, "data")
+	os.WriteFile(sigPath, []byte(armor("PGP SIGNATURE", pkt)), 0600)
+	os.WriteFile(dataPath, data, 0600)
+	if _, err := gpg(nil, "--verify", sigPath, dataPath); err != nil {
+		t.Errorf("gpg rejects the signature: %v", err)
+	}
+
+	os.WriteFile(dataPath, append(data, 'x'), 0600)
+	if _, err := gpg(nil, "--verify", sigPath, dataPath); err == nil {
+		t.Errorf("gpg accepts the signature for modified data")
+	}
+}
+
+func TestGnuPGDecrypts(t *testing.T) {
+	gpg := gnupg(t, "bob.sec.asc")
+	kr := loadTestKeyring(t, "", "bob.pub.asc")
+	key, err := kr.encryptionKey("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("Content-Type: text/plain\r\n\r\nFor Bob only\r\n")
+	encrypted, err := encryptTo([]*pgpKey{key}, data, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gpg([]byte(armor("PGP MESSAGE", encrypted)), "--decrypt")
+	if err != nil {
+		t.Fatalf("gpg cannot decrypt: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("gpg decrypted %q, want %q", got, data)
+	}
+}
+
+func TestVerifyGnuPGSignature(t *testing.T) {
+	gpg := gnupg(t, "bob.sec.asc")
+	kr := loadTestKeyring(t, "", "bob.pub.asc")
+	bob := kr.find("bob@example.com").primary
+
+	data := []byte("Signed by GnuPG\r\n")
+	armored, err := gpg(data, "--armor", "--detach-sign", "--digest-algo", "SHA512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := decodeArmor(armored)
+	if err != nil || len(blocks) != 1 {
+		t.Fatalf("decodeArmor: %v", err)
+	}
+	_, body, err := readPacket(bytes.NewReader(blocks[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, ok := parseSignature(body)
+	if !ok {
+		t.Fatalf("cannot parse gpg signature")
+	}
+	h := pgpHash(sig.hashAlgo)()
+	h.Write(data)
+	if err := bob.verify(sig, h); err != nil {
+		t.Errorf("gpg signature does not verify: %v", err)
+	}
+}
+
+func TestArmorRoundTrip(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	blocks, err := decodeArmor([]byte(armor("PGP MESSAGE", data)))
+	if err != nil || len(blocks) != 1 || !bytes.Equal(blocks[0], data) {
+		t.Fatalf("armor round trip: %v", err)
+	}
+	if got := mpi([]byte{0, 0x01, 0xff}); !bytes.Equal(got, []byte{0, 9, 1, 0xff}) {
+		t.Errorf("mpi = %x", got)
+	}
+	if n, _ := readMPI(bytes.NewReader([]byte{0, 9, 1, 0xff})); n.Cmp(big.NewInt(0x1ff)) != 0 {
+		t.Errorf("readMPI = %v", n)
+	}
+}
+
+// FuzzReadKeyring feeds binary and armored keyrings to the packet parser,
+// which must reject malformed input with an error and never panic
+func FuzzReadKeyring(f *testing.F) {
+	for _, name := range []string{"alice.sec.asc", "bob.pub.asc", "carol.pub.asc", "mallory.pub.asc"} {
+		data, err := os.ReadFile(filepath.Join("testdata", "pgp", name))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+		blocks, err := decodeArmor(data)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(blocks[0])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		kr, err := ReadKeyring(bytes.NewReader(data), alicePassphrase)
+		if err != nil {
+			return
+		}
+		// Whatever was accepted must be usable without panicking
+		for _, e := range kr.entities {
+			for _, email := range e.emails {
+				kr.encryptionKey(email)
+				kr.signingKey(email)
+			}
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// MissingKeyError is returned when an encrypted message cannot be sent
+// because the keyring has no usable key for some recipients
+type MissingKeyError struct {
+	Addresses []string
+}
+
+func (e *MissingKeyError) Error() string {
+	return "not sending encrypted email: no PGP key for " + strings.Join(e.Addresses, ", ")
+}
+
+// ErrEncryptedBcc is returned when an encrypted message has Bcc recipients.
+// The one ciphertext sent to everybody names the key of every recipient it
+// is encrypted to, so To and Cc recipients would learn who was on Bcc.
+var ErrEncryptedBcc = errors.New("not sending encrypted email: Bcc recipients would be revealed by their key IDs; send them a separate message")
+
+// signEntity wraps e in a multipart/signed entity with a detached
+// signature by the sender's key
+func (msg *Message) signEntity(e mimeEntity) (mimeEntity, error) {
+	from, err := envelopeAddresses([]string{msg.From})
+	if err != nil {
+		return mimeEntity{}, err
+	}
+	key, err := msg.Keyring.signingKey(from[0])
+	if err != nil {
+		return mimeEntity{}, err
+	}
+	signed := e.bytes()
+	sig, err := key.sign(signed, msg.Date)
+	if err != nil {
+		return mimeEntity{}, fmt.Errorf("error signing message: %v", err)
+	}
+
+	sigHeader := textproto.MIMEHeader{
+		"Content-Type":        {`application/pgp-signature; name="signature.asc"`},
+		"Content-Description": {"OpenPGP digital signature"},
+		"Content-Disposition": {`attachment; filename="signature.asc"`},
+	}
+	return multipartSigned(signed, "application/pgp-signature", "pgp-sha256", sigHeader, []byte(armor("PGP SIGNATURE", sig))), nil
+}
+
+// encryptEntity encrypts e to every recipient, and to the sender when the
+// keyring has their key so the sent copy stays readable
+func (msg *Message) encryptEntity(e mimeEntity) (mimeEntity, error) {
+	if len(msg.Bcc) > 0 {
+		return mimeEntity{}, ErrEncryptedBcc
+	}
+	recipients, err := msg.Recipients()
+	if err != nil {
+		return mimeEntity{}, err
+	}
+	var keys []*pgpKey
+	seen := make(map[[20]byte]bool)
+	for _, addr := range recipients {
+		key, err := msg.Keyring.encryptionKey(addr)
+		if err != nil {
+			return mimeEntity{}, err
+		}
+		if !seen[key.fingerprint] {
+			seen[key.fingerprint] = true
+			keys = append(keys, key)
+		}
+	}
+	if from, err := envelopeAddresses([]string{msg.From}); err == nil {
+		if key, err := msg.Keyring.encryptionKey(from[0]); err == nil && !seen[key.fingerprint] {
+			keys = append(keys, key)
+		}
+	}
+
+	data, err := encryptTo(keys, e.bytes(), msg.Date)
+	if err != nil {
+		return mimeEntity{}, fmt.Errorf("error encrypting message: %v", err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	w, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/pgp-encrypted"},
+		"Content-Description": {"PGP/MIME version identification"},
+	})
+	if err != nil {
+		return mimeEntity{}, err
+	}
+	io.WriteString(w, "Version: 1\r\n")
+	w, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {`application/octet-stream; name="encrypted.asc"`},
+		"Content-Description": {"OpenPGP encrypted message"},
+		"Content-Disposition": {`inline; filename="encrypted.asc"`},
+	})
+	if err != nil {
+		return mimeEntity{}, err
+	}
+	io.WriteString(w, armor("PGP MESSAGE", data))
+	if err := mw.Close(); err != nil {
+		return mimeEntity{}, err
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"boundary": mw.Boundary(),
+		"protocol": "application/pgp-encrypted",
+	}))
+	return mimeEntity{header: h, body: body.Bytes()}, nil
+}
+
+// preparePGP gives msg the Mailer's keyring and makes sure every key it
+// needs is available, so encrypted mail is refused before anything is sent
+func (m *Mailer) preparePGP(msg *Message, recipients []string) error {
+	if !msg.Sign && !msg.Encrypt {
+		return nil
+	}
+	if msg.Keyring == nil {
+		msg.Keyring = m.Keyring()
+	}
+	if msg.Keyring == nil {
+		return fmt.Errorf("PGP is not configured: no keyring loaded")
+	}
+	if msg.Encrypt {
+		if len(msg.Bcc) > 0 {
+			return ErrEncryptedBcc
+		}
+		if missing := msg.Keyring.MissingKeys(recipients); len(missing) > 0 {
+			return &MissingKeyError{Addresses: missing}
+		}
+	}
+	if msg.Sign {
+		from, err := envelopeAddresses([]string{msg.From})
+		if err != nil {
+			return err
+		}
+		if _, err := msg.Keyring.signingKey(from[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
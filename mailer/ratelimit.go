@@ -0,0 +1,199 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimit restricts how fast a Mailer hands messages to its transport.
+// A zero value for any field disables that limit.
+type RateLimit struct {
+	PerSecond int
+	PerMinute int
+	PerDay    int
+	// MaxConcurrent caps the number of deliveries in progress at once
+	MaxConcurrent int
+	// Wait makes callers block until the message may be sent. Otherwise
+	// delivery fails at once with a *RateLimitError.
+	Wait bool
+}
+
+// RateLimitError is returned when a limit is reached and the Mailer is not
+// configured to wait
+type RateLimitError struct {
+	// Limit names the exceeded limit: "second", "minute", "day" or
+	// "concurrency"
+	Limit string
+	// RetryAfter is how long until a message may be sent again. It is zero
+	// for the concurrency limit, which frees up when a delivery finishes.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Limit == "concurrency" {
+		return "rate limited: too many deliveries in progress"
+	}
+	return fmt.Sprintf("rate limited: per-%s limit reached, retry in %s", e.Limit, e.RetryAfter.Round(time.Second))
+}
+
+// IsRateLimited reports whether err was caused by the Mailer's rate limit
+func IsRateLimited(err error) bool {
+	var rlErr *RateLimitError
+	return errors.As(err, &rlErr)
+}
+
+// RateStats are the limiter counters reported by Mailer.RateStats.
+// Deliveries counts every delivery started, successful or not.
+type RateStats struct {
+	Deliveries int64 `json:"deliveries"`
+	Limited    int64 `json:"limited"`
+	InFlight   int   `json:"in_flight"`
+	LastSecond int   `json:"last_second"`
+	LastMinute int   `json:"last_minute"`
+	LastDay    int   `json:"last_day"`
+}
+
+// rateLimiter implements RateLimit with a sliding window of send times
+type rateLimiter struct {
+	mu     sync.Mutex
+	limits RateLimit
+	// sent holds the start times of deliveries within the last day, oldest
+	// first
+	sent     []time.Time
+	inFlight int
+	total    int64
+	limited  int64
+	// freed is closed and replaced whenever a delivery finishes, waking
+	// callers that wait for a concurrency slot
+	freed chan struct{}
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{freed: make(chan struct{})}
+}
+
+func (l *rateLimiter) setLimits(limits RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+}
+
+// acquire reserves a delivery slot, waiting if the limits ask for it. The
+// returned function must be called when the delivery is finished.
+func (l *rateLimiter) acquire(ctx context.Context) (func(), error) {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.prune(now)
+		wait, limitErr := l.check(now)
+		if limitErr == nil {
+			l.sent = append(l.sent, now)
+			l.inFlight++
+			l.total++
+			l.mu.Unlock()
+			return l.release, nil
+		}
+		if !l.limits.Wait {
+			l.limited++
+			l.mu.Unlock()
+			return nil, limitErr
+		}
+		freed := l.freed
+		l.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-freed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (l *rateLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+// check returns how long to wait and the limit that applies, or a nil
+// error if a delivery may start now
+func (l *rateLimiter) check(now time.Time) (time.Duration, *RateLimitError) {
+	if l.limits.MaxConcurrent > 0 && l.inFlight >= l.limits.MaxConcurrent {
+		return 0, &RateLimitError{Limit: "concurrency"}
+	}
+	windows := []struct {
+		name   string
+		limit  int
+		period time.Duration
+	}{
+		{"second", l.limits.PerSecond, time.Second},
+		{"minute", l.limits.PerMinute, time.Minute},
+		{"day", l.limits.PerDay, 24 * time.Hour},
+	}
+	for _, w := range windows {
+		if w.limit <= 0 {
+			continue
+		}
+		n := l.countSince(now.Add(-w.period))
+		if n >= w.limit {
+			// The window frees up when the oldest counted send leaves it
+			oldest := l.sent[len(l.sent)-w.limit]
+			wait := oldest.Add(w.period).Sub(now)
+			return wait, &RateLimitError{Limit: w.name, RetryAfter: wait}
+		}
+	}
+	return 0, nil
+}
+
+// countSince returns the number of sends after t
+func (l *rateLimiter) countSince(t time.Time) int {
+	n := 0
+	for i := len(l.sent) - 1; i >= 0 && l.sent[i].After(t); i-- {
+		n++
+	}
+	return n
+}
+
+// prune drops send times older than the longest window
+func (l *rateLimiter) prune(now time.Time) {
+	cutoff := now.Add(-24 * time.Hour)
+	i := 0
+	for i < len(l.sent) && !l.sent[i].After(cutoff) {
+		i++
+	}
+	if i > 0 {
+		l.sent = append(l.sent[:0], l.sent[i:]...)
+	}
+}
+
+func (l *rateLimiter) stats() RateStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+	return RateStats{
+		Deliveries: l.total,
+		Limited:    l.limited,
+		InFlight:   l.inFlight,
+		LastSecond: l.countSince(now.Add(-time.Second)),
+		LastMinute: l.countSince(now.Add(-time.Minute)),
+		LastDay:    len(l.sent),
+	}
+}
@@ -0,0 +1,286 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitWindowBoundary(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		limits  RateLimit
+		sent    []time.Duration // ages of earlier sends, oldest first
+		blocked string
+		wait    time.Duration
+	}{
+		{
+			// A send exactly one period old has left the window
+			name:   "minute edge",
+			limits: RateLimit{PerMinute: 3},
+			sent:   []time.Duration{time.Minute, 50 * time.Second, 10 * time.Second},
+		},
+		{
+			name:    "minute just inside",
+			limits:  RateLimit{PerMinute: 3},
+			sent:    []time.Duration{time.Minute - time.Millisecond, 50 * time.Second, 10 * time.Second},
+			blocked: "minute",
+			wait:    time.Millisecond,
+		},
+		{
+			// The wait is until the oldest of the last PerMinute sends expires
+			name:    "minute with older sends",
+			limits:  RateLimit{PerMinute: 2},
+			sent:    []time.Duration{55 * time.Second, 40 * time.Second, 30 * time.Second},
+			blocked: "minute",
+			wait:    20 * time.Second,
+		},
+		{
+			name:    "second",
+			limits:  RateLimit{PerSecond: 2, PerMinute: 100},
+			sent:    []time.Duration{900 * time.Millisecond, 100 * time.Millisecond},
+			blocked: "second",
+			wait:    100 * time.Millisecond,
+		},
+		{
+			name:   "second edge",
+			limits: RateLimit{PerSecond: 2},
+			sent:   []time.Duration{time.Second, 100 * time.Millisecond},
+		},
+		{
+			name:    "day",
+			limits:  RateLimit{PerDay: 2},
+			sent:    []time.Duration{23 * time.Hour, time.Hour},
+			blocked: "day",
+			wait:    time.Hour,
+		},
+		{
+			name:   "day edge",
+			limits: RateLimit{PerDay: 2},
+			sent:   []time.Duration{24 * time.Hour, time.Hour},
+		},
+		{
+			name:   "no limits",
+			limits: RateLimit{},
+			sent:   []time.Duration{3 * time.Millisecond, 2 * time.Millisecond, time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter()
+			l.setLimits(tt.limits)
+			for _, age := range tt.sent {
+				l.sent = append(l.sent, now.Add(-age))
+			}
+			l.prune(now)
+			wait, err := l.check(now)
+			if tt.blocked == "" {
+				if err != nil {
+					t.Fatalf("blocked: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("not blocked, want the per-%s limit", tt.blocked)
+			}
+			if err.Limit != tt.blocked || wait != tt.wait || err.RetryAfter != tt.wait {
+				t.Errorf("got per-%s limit, wait %v (retry after %v), want per-%s and %v", err.Limit, wait, err.RetryAfter, tt.blocked, tt.wait)
+			}
+		})
+	}
+}
+
+func TestRateLimitFailFast(t *testing.T) {
+	l := newRateLimiter()
+	l.setLimits(RateLimit{PerSecond: 2})
+	for i := 0; i < 2; i++ {
+		release, err := l.acquire(context.Background())
+		if err != nil {
+			t.Fatalf("send %d: %v", i+1, err)
+		}
+		release()
+	}
+
+	start := time.Now()
+	_, err := l.acquire(context.Background())
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("fail-fast limiter waited %v", time.Since(start))
+	}
+	var rlErr *RateLimitError
+	if !errors.As(err, &rlErr) || rlErr.Limit != "second" || rlErr.RetryAfter <= 0 || rlErr.RetryAfter > time.Second {
+		t.Fatalf("third send returned %v, want a per-second RateLimitError", err)
+	}
+	if !IsRateLimited(err) || !strings.Contains(err.Error(), "per-second") {
+		t.Errorf("error %q", err)
+	}
+	stats := l.stats()
+	if stats.Deliveries != 2 || stats.Limited != 1 || stats.LastSecond != 2 || stats.InFlight != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	// The concurrency limit fails fast too, without a retry time
+	l = newRateLimiter()
+	l.setLimits(RateLimit{MaxConcurrent: 1})
+	release, _ := l.acquire(context.Background())
+	if _, err := l.acquire(context.Background()); !errors.As(err, &rlErr) || rlErr.Limit != "concurrency" || rlErr.RetryAfter != 0 {
+		t.Errorf("second concurrent send returned %v", err)
+	}
+	release()
+	if _, err := l.acquire(context.Background()); err != nil {
+		t.Errorf("send after release: %v", err)
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	l := newRateLimiter()
+	l.setLimits(RateLimit{PerSecond: 1, Wait: true})
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	start := time.Now()
+	release, err = l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if waited := time.Since(start); waited < 900*time.Millisecond {
+		t.Errorf("second send went out after %v, want it to wait for the window", waited)
+	}
+	if stats := l.stats(); stats.Limited != 0 || stats.Deliveries != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestRateLimitWaitForSlot(t *testing.T) {
+	l := newRateLimiter()
+	l.setLimits(RateLimit{MaxConcurrent: 1, Wait: true})
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		release, err := l.acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("second send started while the first was in progress (%v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting send did not start when the slot was freed")
+	}
+}
+
+func TestRateLimitWaitCancelled(t *testing.T) {
+	l := newRateLimiter()
+	l.setLimits(RateLimit{PerMinute: 1, Wait: true})
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := l.acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled wait returned %v", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("cancelled wait returned after %v", waited)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait past the deadline returned %v", err)
+	}
+	if stats := l.stats(); stats.Deliveries != 1 || stats.InFlight != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestRateLimitConcurrent(t *testing.T) {
+	t.Run("fail fast", func(t *testing.T) {
+		l := newRateLimiter()
+		l.setLimits(RateLimit{PerMinute: 10})
+		var wg sync.WaitGroup
+		var sent, limited int32
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, err := l.acquire(context.Background())
+				if err != nil {
+					atomic.AddInt32(&limited, 1)
+					return
+				}
+				atomic.AddInt32(&sent, 1)
+				release()
+			}()
+		}
+		wg.Wait()
+		if sent != 10 || limited != 40 {
+			t.Errorf("%d sent and %d limited, want 10 and 40", sent, limited)
+		}
+		if stats := l.stats(); stats.Deliveries != 10 || stats.Limited != 40 || stats.LastMinute != 10 {
+			t.Errorf("stats %+v", stats)
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		l := newRateLimiter()
+		l.setLimits(RateLimit{MaxConcurrent: 3, Wait: true})
+		var wg sync.WaitGroup
+		var inFlight, peak int32
+		for i := 0; i < 30; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, err := l.acquire(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n := atomic.AddInt32(&inFlight, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&inFlight, -1)
+				release()
+			}()
+		}
+		wg.Wait()
+		if peak > 3 {
+			t.Errorf("%d deliveries ran at once, want at most 3", peak)
+		}
+		if stats := l.stats(); stats.Deliveries != 30 || stats.InFlight != 0 {
+			t.Errorf("stats %+v", stats)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"time"
+)
+
+// RawMessage is a complete message written by another program, such as the
+// input of the sendmail command. Its header can be inspected and amended
+// before it is sent with SendRaw; the body is passed on unchanged apart
+// from line endings, which are normalized to CRLF.
+type RawMessage struct {
+	// fields holds the header fields, each with its continuation lines
+	// and line breaks
+	fields []string
+	body   []byte
+}
+
+// ReadRawMessage reads an RFC 5322 message from r
+func ReadRawMessage(r io.Reader) (*RawMessage, error) {
+	br := bufio.NewReader(r)
+	_, fields, err := readHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading message: %v", err)
+	}
+	msg := &RawMessage{}
+	for _, field := range fields {
+		name, _, ok := strings.Cut(field, ":")
+		if !ok || strings.TrimSpace(name) == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("error reading message: invalid header line %q", strings.TrimRight(field, "\r\n"))
+		}
+		field = toCRLF(field)
+		if !strings.HasSuffix(field, "\r\n") {
+			field += "\r\n"
+		}
+		msg.fields = append(msg.fields, field)
+	}
+
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading message: %v", err)
+	}
+	msg.body = []byte(toCRLF(string(body)))
+	return msg, nil
+}
+
+// toCRLF converts bare LF line endings to CRLF
+func toCRLF(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// Get returns the unfolded value of the first header field called name, or
+// an empty string if there is none
+func (msg *RawMessage) Get(name string) string {
+	if values := msg.Values(name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns the unfolded values of every header field called name
+func (msg *RawMessage) Values(name string) []string {
+	var values []string
+	for _, field := range msg.fields {
+		if strings.EqualFold(fieldName(field), name) {
+			_, value, _ := strings.Cut(field, ":")
+			value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+			values = append(values, strings.TrimSpace(value))
+		}
+	}
+	return values
+}
+
+// Set replaces the header fields called name with a single field holding
+// value, keeping the position of the first one
+func (msg *RawMessage) Set(name, value string) {
+	field := foldHeader(name, value)
+	for i, f := range msg.fields {
+		if strings.EqualFold(fieldName(f), name) {
+			msg.fields[i] = field
+			msg.delFrom(i+1, name)
+			return
+		}
+	}
+	msg.fields = append(msg.fields, field)
+}
+
+// Del removes every header field called name
+func (msg *RawMessage) Del(name string) {
+	msg.delFrom(0, name)
+}
+
+func (msg *RawMessage) delFrom(start int, name string) {
+	kept := msg.fields[:start]
+	for _, f := range msg.fields[start:] {
+		if !strings.EqualFold(fieldName(f), name) {
+			kept = append(kept, f)
+		}
+	}
+	msg.fields = kept
+}
+
+// Recipients returns the bare addresses in the To, Cc and Bcc fields
+func (msg *RawMessage) Recipients() ([]string, error) {
+	var list []string
+	for _, name := range []string{"To", "Cc", "Bcc"} {
+		for _, value := range msg.Values(name) {
+			addrs, err := ParseAddressList(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s header: %v", name, err)
+			}
+			list = append(list, addrs...)
+		}
+	}
+	return envelopeAddresses(list)
+}
+
+// WriteTo writes the message with its current header to w
+func (msg *RawMessage) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, msg.reader())
+}
+
+func (msg *RawMessage) reader() io.Reader {
+	return io.MultiReader(
+		strings.NewReader(strings.Join(msg.fields, "")+"\r\n"),
+		bytes.NewReader(msg.body),
+	)
+}
+
+// PrepareRaw readies a message rendered elsewhere for sending to rcpts and
+// returns its envelope. from is the envelope sender and defaults to the
+// configured sender address. From, Date and Message-ID fields are added
+// when missing and Bcc fields are removed.
+func (m *Mailer) PrepareRaw(from string, rcpts []string, msg *RawMessage) (Envelope, error) {
+	if !m.IsConfigured() {
+		return Envelope{}, fmt.Errorf("email credentials not configured")
+	}
+	sender, _ := m.GetCredentials()
+	if from == "" {
+		from = sender
+	}
+	if len(rcpts) == 0 {
+		return Envelope{}, fmt.Errorf("no recipients specified")
+	}
+	recipients, err := envelopeAddresses(rcpts)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	if msg.Get("From") == "" {
+		value, err := formatAddressList([]string{sender})
+		if err != nil {
+			return Envelope{}, err
+		}
+		msg.Set("From", value)
+	}
+	if msg.Get("Date") == "" {
+		msg.Set("Date", formatDate(time.Now()))
+	}
+	id := msg.Get("Message-ID")
+	if id == "" {
+		id = generateMessageID(msg.Get("From"))
+		msg.Set("Message-ID", id)
+	}
+	msg.Del("Bcc")
+
+	subject := msg.Get("Subject")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	return Envelope{From: from, To: recipients, MessageID: id, Subject: subject}, nil
+}
+
+// SendRaw delivers a message rendered elsewhere to rcpts and returns its
+// Message-ID. The message is prepared as by PrepareRaw. Like Send, it
+// queues the message when delivery fails temporarily and a spooler is set.
+func (m *Mailer) SendRaw(ctx context.Context, from string, rcpts []string, msg *RawMessage) (string, error) {
+	env, err := m.PrepareRaw(from, rcpts, msg)
+	if err != nil {
+		return "", err
+	}
+	if sendErr := m.Deliver(ctx, env.From, env.To, msg.reader()); sendErr != nil {
+		return env.MessageID, m.spool(env, msg, sendErr)
+	}
+	return env.MessageID, nil
+}
@@ -0,0 +1,106 @@
+package mailer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sendAtLayouts are the absolute time formats accepted by ParseSendAt,
+// interpreted in the local time zone unless they carry an offset
+var sendAtLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+}
+
+// ParseSendAt parses a requested send time. It accepts an absolute time
+// ("2006-01-02 15:04", RFC 3339 or the HTML datetime-local format), a time
+// of day ("09:00", meaning the next occurrence) or a delay ("+2h30m").
+// An empty string returns the zero time, meaning "send now".
+func ParseSendAt(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if strings.HasPrefix(s, "+") {
+		d, err := time.ParseDuration(s[1:])
+		if err != nil || d <= 0 {
+			return time.Time{}, fmt.Errorf("invalid delay %q (want e.g. +30m or +2h)", s)
+		}
+		return now.Add(d), nil
+	}
+
+	if clock, err := time.ParseInLocation("15:04", s, now.Location()); err == nil {
+		at := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at, nil
+	}
+
+	for _, layout := range sendAtLayouts {
+		if at, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			if !at.After(now) {
+				return time.Time{}, fmt.Errorf("send time %s is in the past", at.Format("2006-01-02 15:04"))
+			}
+			return at, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid send time %q (want YYYY-MM-DD HH:MM, HH:MM or +DURATION)", s)
+}
+
+// Schedule stores msg in the spooler to be sent at the given time and
+// returns its Message-ID. The Date header is set to the send time.
+func (m *Mailer) Schedule(msg *Message, at time.Time) (string, error) {
+	m.mu.RLock()
+	spooler := m.spooler
+	m.mu.RUnlock()
+	if spooler == nil {
+		return "", fmt.Errorf("scheduled sending needs an outbox")
+	}
+	if !m.IsConfigured() {
+		return "", fmt.Errorf("email credentials not configured")
+	}
+
+	sender, _ := m.GetCredentials()
+	if msg.From == "" {
+		msg.From = sender
+	}
+	if msg.Date.IsZero() {
+		msg.Date = at
+	}
+	recipients, err := msg.Recipients()
+	if err != nil {
+		return "", err
+	}
+	if len(recipients) == 0 {
+		return "", fmt.Errorf("no recipients specified")
+	}
+	if err := msg.checkFiles(); err != nil {
+		return "", err
+	}
+	if err := m.preparePGP(msg, recipients); err != nil {
+		return "", err
+	}
+	if err := m.prepareSMIME(msg); err != nil {
+		return "", err
+	}
+	if msg.MessageID == "" {
+		msg.MessageID = generateMessageID(msg.From)
+	}
+
+	env := Envelope{
+		From:      sender,
+		To:        recipients,
+		MessageID: msg.MessageID,
+		Subject:   msg.Subject,
+		SendAt:    at,
+	}
+	if err := enqueue(spooler, env, msg); err != nil {
+		return "", fmt.Errorf("error scheduling email: %v", err)
+	}
+	return msg.MessageID, nil
+}
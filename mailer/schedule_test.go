@@ -0,0 +1,93 @@
+package mailer_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+func TestParseSendAt(t *testing.T) {
+	cet := time.FixedZone("CET", 3600)
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, cet)
+
+	tests := []struct {
+		in   string
+		want time.Time
+		err  bool
+	}{
+		{in: "", want: time.Time{}},
+		{in: "  ", want: time.Time{}},
+		{in: "+90m", want: now.Add(90 * time.Minute)},
+		{in: "+2h30m", want: now.Add(150 * time.Minute)},
+		{in: "+0s", err: true},
+		{in: "+-1h", err: true},
+		{in: "+soon", err: true},
+
+		// A time of day is its next occurrence in the local zone
+		{in: "09:00", want: time.Date(2024, 3, 1, 9, 0, 0, 0, cet)},
+		{in: "08:00", want: time.Date(2024, 3, 2, 8, 0, 0, 0, cet)},
+		{in: "07:59", want: time.Date(2024, 3, 2, 7, 59, 0, 0, cet)},
+		{in: "25:00", err: true},
+
+		// Absolute times without an offset are local
+		{in: "2024-03-02 10:00", want: time.Date(2024, 3, 2, 10, 0, 0, 0, cet)},
+		{in: "2024-03-02T10:00", want: time.Date(2024, 3, 2, 10, 0, 0, 0, cet)},
+		{in: "2024-03-02 10:00:30", want: time.Date(2024, 3, 2, 10, 0, 30, 0, cet)},
+		{in: "2024-03-01 07:00", err: true},
+		{in: "2024-03-01 08:00", err: true},
+
+		// RFC 3339 keeps its own offset: 07:30 UTC is 08:30 here
+		{in: "2024-03-01T07:30:00Z", want: time.Date(2024, 3, 1, 8, 30, 0, 0, cet)},
+		{in: "2024-03-01T06:30:00Z", err: true},
+		{in: "2024-03-01T02:30:00-05:00", want: time.Date(2024, 3, 1, 8, 30, 0, 0, cet)},
+		{in: "2024-03-01T09:30:00+03:00", err: true},
+
+		{in: "tomorrow", err: true},
+		{in: "2024-13-01 10:00", err: true},
+	}
+	for _, tt := range tests {
+		got, err := mailer.ParseSendAt(tt.in, now)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseSendAt(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSendAt(%q): %v", tt.in, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseSendAt(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	m := mailer.New()
+	m.SetCredentials("sender@example.com", "secret")
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	msg := &mailer.Message{To: []string{"bob@example.com"}, Subject: "Later", Text: "x"}
+	if _, err := m.Schedule(msg, at); err == nil {
+		t.Error("Schedule without an outbox succeeded")
+	}
+
+	spool := &recordingSpooler{}
+	m.SetSpooler(spool)
+	id, err := m.Schedule(msg, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spool.envelopes) != 1 {
+		t.Fatalf("%d messages queued, want 1", len(spool.envelopes))
+	}
+	env := spool.envelopes[0]
+	if !env.SendAt.Equal(at) || env.MessageID != id || env.LastError != "" {
+		t.Errorf("envelope %+v", env)
+	}
+	if !msg.Date.Equal(at) {
+		t.Errorf("Date is %v, want the send time %v", msg.Date, at)
+	}
+}
@@ -0,0 +1,321 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Object identifiers used in S/MIME signatures (RFC 5652, RFC 8551)
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// SMIMESigner signs messages with an X.509 certificate as S/MIME
+// multipart/signed messages with a detached application/pkcs7-signature
+type SMIMESigner struct {
+	// Certificates holds the signing certificate first, followed by any
+	// intermediate certificates to include in the signature
+	Certificates []*x509.Certificate
+	// Key is the RSA or ECDSA private key of the signing certificate
+	Key crypto.Signer
+}
+
+// LoadSMIME reads the signing certificate, with optional intermediates
+// after it, and its private key from PEM files
+func LoadSMIME(certPath, keyPath string) (*SMIMESigner, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading S/MIME certificate: %v", err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing S/MIME certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("error reading S/MIME certificate: no certificate in %s", certPath)
+	}
+
+	data, err = os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading S/MIME key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("error reading S/MIME key: %s is not a PEM file", keyPath)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("error reading S/MIME key: unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing S/MIME key: %v", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported S/MIME key type %T", key)
+	}
+	s := &SMIMESigner{Certificates: certs, Key: signer}
+	if _, err := s.signatureAlgorithm(); err != nil {
+		return nil, err
+	}
+	if !publicKeysEqual(certs[0].PublicKey, signer.Public()) {
+		return nil, fmt.Errorf("S/MIME key does not belong to the certificate for %s", certs[0].Subject.CommonName)
+	}
+	return s, nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	ka, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && ka.Equal(b)
+}
+
+// CheckSender returns an error if the certificate is not issued for from.
+// Certificates without email addresses are accepted for any sender.
+func (s *SMIMESigner) CheckSender(from string) error {
+	cert := s.Certificates[0]
+	if len(cert.EmailAddresses) == 0 {
+		return nil
+	}
+	for _, addr := range cert.EmailAddresses {
+		if strings.EqualFold(addr, from) {
+			return nil
+		}
+	}
+	return fmt.Errorf("S/MIME certificate is for %s, not %s", strings.Join(cert.EmailAddresses, ", "), from)
+}
+
+func (s *SMIMESigner) signatureAlgorithm() (asn1.ObjectIdentifier, error) {
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		return oidRSAEncryption, nil
+	case *ecdsa.PrivateKey:
+		return oidECDSAWithSHA256, nil
+	default:
+		return nil, fmt.Errorf("unsupported S/MIME key type %T (want RSA or ECDSA)", s.Key)
+	}
+}
+
+// signEntity wraps e in a multipart/signed entity with a detached PKCS#7
+// signature
+func (s *SMIMESigner) signEntity(e mimeEntity, now time.Time) (mimeEntity, error) {
+	signed := e.bytes()
+	sig, err := s.sign(signed, now)
+	if err != nil {
+		return mimeEntity{}, fmt.Errorf("error signing message: %v", err)
+	}
+
+	var encoded bytes.Buffer
+	if err := writeBase64(&encoded, bytes.NewReader(sig)); err != nil {
+		return mimeEntity{}, err
+	}
+	sigHeader := textproto.MIMEHeader{
+		"Content-Type":              {`application/pkcs7-signature; name="smime.p7s"`},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {`attachment; filename="smime.p7s"`},
+		"Content-Description":       {"S/MIME Cryptographic Signature"},
+	}
+	return multipartSigned(signed, "application/pkcs7-signature", "sha-256", sigHeader, encoded.Bytes()), nil
+}
+
+// ASN.1 structures of a detached SignedData (RFC 5652, section 5)
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []signerInfo `asn1:"set"`
+}
+
+type encapContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// sign returns a DER encoded detached SignedData over data
+func (s *SMIMESigner) sign(data []byte, now time.Time) ([]byte, error) {
+	sigAlgo, err := s.signatureAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+	cert := s.Certificates[0]
+	digest := sha256.Sum256(data)
+
+	attrs, err := signedAttributes(digest[:], now)
+	if err != nil {
+		return nil, err
+	}
+	// The signature covers the attributes encoded as a SET, while the
+	// SignerInfo stores them under an implicit [0] tag
+	attrsDigest := sha256.Sum256(derTLV(0x31, attrs))
+	sig, err := s.Key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []byte
+	for _, c := range s.Certificates {
+		certs = append(certs, c.Raw...)
+	}
+	sha256Algo := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	signatureAlgo := pkix.AlgorithmIdentifier{Algorithm: sigAlgo}
+	if sigAlgo.Equal(oidRSAEncryption) {
+		signatureAlgo.Parameters = asn1.NullRawValue
+	}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algo},
+		EncapContentInfo: encapContentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{FullBytes: derTLV(0xa0, certs)},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			SID: issuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+				SerialNumber: cert.SerialNumber,
+			},
+			DigestAlgorithm:    sha256Algo,
+			SignedAttrs:        asn1.RawValue{FullBytes: derTLV(0xa0, attrs)},
+			SignatureAlgorithm: signatureAlgo,
+			Signature:          sig,
+		}},
+	}
+	inner, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{FullBytes: derTLV(0xa0, inner)},
+	})
+}
+
+// signedAttributes returns the DER contents of the signed attributes set:
+// content type, signing time and message digest, sorted as DER requires
+func signedAttributes(digest []byte, now time.Time) ([]byte, error) {
+	values := []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, oidData},
+		{oidSigningTime, now.UTC()},
+		{oidMessageDigest, digest},
+	}
+	var encoded [][]byte
+	for _, v := range values {
+		value, err := asn1.Marshal(v.value)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(attribute{Type: v.oid, Values: asn1.RawValue{FullBytes: derTLV(0x31, value)}})
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, attr)
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+	return bytes.Join(encoded, nil), nil
+}
+
+// derTLV encodes a DER element with the given tag byte and contents
+func derTLV(tag byte, content []byte) []byte {
+	n := len(content)
+	out := []byte{tag}
+	if n < 0x80 {
+		out = append(out, byte(n))
+		return append(out, content...)
+	}
+	// Long form: 0x80 plus the number of length bytes, then the length
+	// big-endian in as few bytes as possible
+	var length []byte
+	for ; n > 0; n >>= 8 {
+		length = append([]byte{byte(n)}, length...)
+	}
+	out = append(out, 0x80|byte(len(length)))
+	out = append(out, length...)
+	return append(out, content...)
+}
+
+// prepareSMIME gives msg the Mailer's S/MIME signer unless it is protected
+// with PGP, and checks that the certificate matches the sender
+func (m *Mailer) prepareSMIME(msg *Message) error {
+	if msg.SMIME == nil && !msg.Sign && !msg.Encrypt {
+		m.mu.RLock()
+		msg.SMIME = m.smime
+		m.mu.RUnlock()
+	}
+	if msg.SMIME == nil {
+		return nil
+	}
+	from, err := envelopeAddresses([]string{msg.From})
+	if err != nil {
+		return err
+	}
+	return msg.SMIME.CheckSender(from[0])
+}
@@ -0,0 +1,336 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"mime"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPKI is a CA and a leaf certificate for alice@example.com issued by it
+type testPKI struct {
+	ca     *x509.Certificate
+	caKey  crypto.Signer
+	leaf   *x509.Certificate
+	signer *SMIMESigner
+}
+
+func newTestPKI(t *testing.T, leafKey crypto.Signer) *testPKI {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafTemplate := &x509.Certificate{
+		SerialNumber:   big.NewInt(1000),
+		Subject:        pkix.Name{CommonName: "Alice"},
+		EmailAddresses: []string{"alice@example.com"},
+		NotBefore:      now.Add(-time.Hour),
+		NotAfter:       now.Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err = x509.CreateCertificate(rand.Reader, leafTemplate, ca, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testPKI{
+		ca:     ca,
+		caKey:  caKey,
+		leaf:   leaf,
+		signer: &SMIMESigner{Certificates: []*x509.Certificate{leaf, ca}, Key: leafKey},
+	}
+}
+
+func testKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"RSA": rsaKey, "ECDSA": ecKey}
+}
+
+// splitSigned returns the signed part, byte for byte, and the decoded
+// signature of a multipart/signed message
+func splitSigned(t *testing.T, raw []byte) (signed, sig []byte) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/signed" || params["protocol"] != "application/pkcs7-signature" || params["micalg"] != "sha-256" {
+		t.Fatalf("Content-Type is %q", msg.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delim := []byte("--" + params["boundary"])
+	parts := bytes.Split(body, delim)
+	if len(parts) != 4 || !bytes.HasPrefix(parts[3], []byte("--")) {
+		t.Fatalf("multipart/signed body has %d parts:\n%s", len(parts)-2, body)
+	}
+	// The CRLF before each delimiter belongs to the delimiter
+	signed = bytes.TrimSuffix(bytes.TrimPrefix(parts[1], []byte("\r\n")), []byte("\r\n"))
+
+	sigPart := bytes.TrimSuffix(bytes.TrimPrefix(parts[2], []byte("\r\n")), []byte("\r\n"))
+	i := bytes.Index(sigPart, []byte("\r\n\r\n"))
+	if i < 0 || !bytes.Contains(sigPart[:i], []byte("application/pkcs7-signature")) {
+		t.Fatalf("signature part:\n%s", sigPart)
+	}
+	sig, err = base64.StdEncoding.DecodeString(strings.NewReplacer("\r", "", "\n", "").Replace(string(sigPart[i+4:])))
+	if err != nil {
+		t.Fatalf("decoding smime.p7s: %v", err)
+	}
+	return signed, sig
+}
+
+// verifyP7S checks a detached SignedData over content the way a mail client
+// does and returns the signer's certificate
+func verifyP7S(p7s, content []byte, roots *x509.CertPool) (*x509.Certificate, error) {
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(p7s, &ci); err != nil || len(rest) != 0 {
+		return nil, testError("not a ContentInfo")
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, testError("not SignedData")
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+	if len(sd.SignerInfos) != 1 || !sd.EncapContentInfo.ContentType.Equal(oidData) {
+		return nil, testError("unexpected SignedData layout")
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	si := sd.SignerInfos[0]
+	var leaf *x509.Certificate
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		if c.SerialNumber.Cmp(si.SID.SerialNumber) == 0 && bytes.Equal(c.RawIssuer, si.SID.Issuer.FullBytes) {
+			leaf = c
+		} else {
+			intermediates.AddCert(c)
+		}
+	}
+	if leaf == nil {
+		return nil, testError("signer certificate not included")
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}); err != nil {
+		return nil, err
+	}
+
+	// Check the messageDigest attribute against the content
+	var digest []byte
+	var contentType asn1.ObjectIdentifier
+	for rest := si.SignedAttrs.Bytes; len(rest) > 0; {
+		var attr attribute
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return nil, err
+		}
+		switch {
+		case attr.Type.Equal(oidMessageDigest):
+			_, err = asn1.Unmarshal(attr.Values.Bytes, &digest)
+		case attr.Type.Equal(oidContentType):
+			_, err = asn1.Unmarshal(attr.Values.Bytes, &contentType)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	want := sha256.Sum256(content)
+	if !bytes.Equal(digest, want[:]) {
+		return nil, testError("messageDigest does not match the content")
+	}
+	if !contentType.Equal(oidData) {
+		return nil, testError("contentType attribute is not id-data")
+	}
+
+	// The signature covers the attributes with a SET OF tag instead of
+	// the implicit [0]
+	attrs := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	algo := x509.SHA256WithRSA
+	if si.SignatureAlgorithm.Algorithm.Equal(oidECDSAWithSHA256) {
+		algo = x509.ECDSAWithSHA256
+	}
+	if err := leaf.CheckSignature(algo, attrs, si.Signature); err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+func TestSMIMESign(t *testing.T) {
+	for name, key := range testKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			pki := newTestPKI(t, key)
+			roots := x509.NewCertPool()
+			roots.AddCert(pki.ca)
+
+			msg := &Message{
+				From:    "alice@example.com",
+				To:      []string{"bob@example.com"},
+				Subject: "Signed",
+				Text:    "Signed text with a trailing space \r\nand ümlauts\r\n",
+				HTML:    "<p>Signed</p>",
+				SMIME:   pki.signer,
+			}
+			msg.AttachData("notes.txt", []byte("attached"))
+			var buf bytes.Buffer
+			if _, err := msg.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+
+			signed, p7s := splitSigned(t, buf.Bytes())
+			leaf, err := verifyP7S(p7s, signed, roots)
+			if err != nil {
+				t.Fatalf("signature does not verify: %v\n%s", err, buf.Bytes())
+			}
+			if !leaf.Equal(pki.leaf) {
+				t.Errorf("signed by %s", leaf.Subject)
+			}
+
+			tampered := bytes.Replace(signed, []byte("Signed"), []byte("Singed"), 1)
+			if _, err := verifyP7S(p7s, tampered, roots); err == nil {
+				t.Errorf("signature verifies for modified content")
+			}
+			if _, err := verifyP7S(p7s, signed, x509.NewCertPool()); err == nil {
+				t.Errorf("signature verifies without the CA as a root")
+			}
+		})
+	}
+}
+
+func TestSMIMEOpenSSLVerify(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not installed")
+	}
+	for name, key := range testKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			pki := newTestPKI(t, key)
+			dir := t.TempDir()
+			caPath := filepath.Join(dir, "ca.pem")
+			os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.ca.Raw}), 0600)
+
+			msg := &Message{From: "alice@example.com", To: []string{"bob@example.com"}, Subject: "Signed", Text: "Hello Bob\r\n", SMIME: pki.signer}
+			var buf bytes.Buffer
+			if _, err := msg.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			msgPath := filepath.Join(dir, "msg.eml")
+			os.WriteFile(msgPath, buf.Bytes(), 0600)
+
+			out, err := exec.Command("openssl", "smime", "-verify", "-in", msgPath, "-CAfile", caPath, "-purpose", "smimesign").CombinedOutput()
+			if err != nil {
+				t.Fatalf("openssl rejects the signature: %v\n%s", err, out)
+			}
+			if !bytes.Contains(out, []byte("Hello Bob")) {
+				t.Errorf("openssl output:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestLoadSMIME(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki := newTestPKI(t, key)
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certs := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.leaf.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.ca.Raw})...)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certPath, certs, 0600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	s, err := LoadSMIME(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Certificates) != 2 || !s.Certificates[0].Equal(pki.leaf) {
+		t.Errorf("loaded %d certificates", len(s.Certificates))
+	}
+	if err := s.CheckSender("Alice@Example.com"); err != nil {
+		t.Errorf("CheckSender: %v", err)
+	}
+	if err := s.CheckSender("mallory@example.com"); err == nil {
+		t.Errorf("certificate accepted for another sender")
+	}
+
+	// The CA key does not belong to the leaf certificate
+	der, _ = x509.MarshalPKCS8PrivateKey(pki.caKey)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if _, err := LoadSMIME(certPath, keyPath); err == nil || !strings.Contains(err.Error(), "does not belong") {
+		t.Errorf("mismatched key: %v", err)
+	}
+}
+
+func TestDERLength(t *testing.T) {
+	for _, n := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000, 1<<24 - 1, 1 << 24, 1<<24 + 1} {
+		content := make([]byte, n)
+		encoded := derTLV(0x04, content)
+		var raw asn1.RawValue
+		rest, err := asn1.Unmarshal(encoded, &raw)
+		if err != nil || len(rest) != 0 || raw.Tag != asn1.TagOctetString || len(raw.Bytes) != n {
+			t.Errorf("length %d: %v, %d bytes left, %d bytes of content", n, err, len(rest), len(raw.Bytes))
+		}
+	}
+}
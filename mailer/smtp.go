@@ -0,0 +1,383 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TLSMode selects how the connection to the SMTP server is secured
+type TLSMode string
+
+const (
+	// TLSStartTLS connects in plain text and upgrades with STARTTLS (port 587)
+	TLSStartTLS TLSMode = "starttls"
+	// TLSImplicit connects over TLS from the start (port 465)
+	TLSImplicit TLSMode = "implicit"
+	// TLSNone never encrypts the connection (local relays only)
+	TLSNone TLSMode = "none"
+)
+
+// ParseTLSMode converts a configuration value into a TLSMode
+func ParseTLSMode(s string) (TLSMode, error) {
+	switch mode := TLSMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case TLSStartTLS, TLSImplicit, TLSNone:
+		return mode, nil
+	case "":
+		return TLSStartTLS, nil
+	default:
+		return "", fmt.Errorf("unknown TLS mode %q (want starttls, implicit or none)", s)
+	}
+}
+
+// SMTPTransport delivers messages through an SMTP server. Connections are
+// kept open and reused for later messages when MaxIdle is above zero; call
+// Close to shut them down.
+type SMTPTransport struct {
+	Host     string
+	Port     string
+	TLS      TLSMode
+	Username string
+	Password string
+	// Auth selects the login mechanism; empty or AuthAuto negotiates one
+	// from the server's capabilities
+	Auth AuthMechanism
+	// TokenSource supplies OAuth2 access tokens for AuthXOAuth2
+	TokenSource TokenSource
+	// RootCAs verifies the server certificate instead of the system roots,
+	// for servers with a certificate from a private CA
+	RootCAs *x509.CertPool
+
+	// MaxIdle is the number of authenticated connections kept open between
+	// sends. Zero opens a new connection for every message.
+	MaxIdle int
+	// IdleTimeout closes pooled connections that have not been used for
+	// this long (default 30 seconds)
+	IdleTimeout time.Duration
+
+	// Timeout bounds connecting, the TLS handshake and logging in
+	// (default 30 seconds)
+	Timeout time.Duration
+	// CommandTimeout bounds every read and write on the connection, so a
+	// stalled server fails the current command (default 60 seconds)
+	CommandTimeout time.Duration
+
+	mu      sync.Mutex
+	idle    []*smtpConn
+	reaping bool
+	closed  bool
+}
+
+// smtpConn is an authenticated SMTP session that can carry more messages
+type smtpConn struct {
+	client   *smtp.Client
+	conn     *deadlineConn
+	lastUsed time.Time
+}
+
+// Send delivers msg over a pooled connection, or a new one when none is
+// available. A reused connection that turns out to be dead is replaced once.
+// Cancelling ctx aborts the delivery at once, even mid-command.
+func (t *SMTPTransport) Send(ctx context.Context, from string, rcpts []string, msg io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	conn, reused := t.get()
+	if conn == nil {
+		var err error
+		if conn, err = t.dial(ctx); err != nil {
+			return err
+		}
+	}
+
+	sent, err := t.transact(ctx, conn, from, rcpts, msg)
+	if err != nil && reused && !sent && brokenConn(err) && ctx.Err() == nil {
+		conn.client.Close()
+		if conn, err = t.dial(ctx); err != nil {
+			return err
+		}
+		sent, err = t.transact(ctx, conn, from, rcpts, msg)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		conn.client.Close()
+		return ctx.Err()
+	}
+	if err != nil {
+		// A rejected command leaves the session usable after RSET
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) && !brokenConn(err) && conn.client.Reset() == nil {
+			t.put(conn)
+		} else {
+			conn.client.Close()
+		}
+		return err
+	}
+	t.put(conn)
+	return nil
+}
+
+// transact runs one mail transaction while ctx can interrupt it
+func (t *SMTPTransport) transact(ctx context.Context, conn *smtpConn, from string, rcpts []string, msg io.Reader) (bool, error) {
+	stop := conn.conn.watch(ctx)
+	defer stop()
+	return t.sendMail(conn, from, rcpts, msg)
+}
+
+// sendMail runs one mail transaction. It reports whether the message body
+// was started, after which the transaction cannot be retried.
+func (t *SMTPTransport) sendMail(conn *smtpConn, from string, rcpts []string, msg io.Reader) (bool, error) {
+	c := conn.client
+	if err := c.Mail(from); err != nil {
+		return false, err
+	}
+	for _, rcpt := range rcpts {
+		if err := c.Rcpt(rcpt); err != nil {
+			return false, err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(w, msg); err != nil {
+		// Closing w would send the final dot and commit a truncated
+		// message. Dropping the connection makes the server discard it.
+		c.Close()
+		return true, err
+	}
+	return true, w.Close()
+}
+
+// dial opens, secures and authenticates a new connection within Timeout
+func (t *SMTPTransport) dial(ctx context.Context) (*smtpConn, error) {
+	conn, err := t.connect(ctx)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return conn, err
+}
+
+func (t *SMTPTransport) connect(ctx context.Context) (*smtpConn, error) {
+	addr := net.JoinHostPort(t.Host, t.Port)
+	tlsConfig := &tls.Config{ServerName: t.Host, RootCAs: t.RootCAs}
+
+	ctx, cancel := context.WithTimeout(ctx, durationOr(t.Timeout, 30*time.Second))
+	defer cancel()
+
+	var dialer net.Dialer
+	raw, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", addr, err)
+	}
+	dc := &deadlineConn{Conn: raw, timeout: durationOr(t.CommandTimeout, time.Minute)}
+	stop := dc.watch(ctx)
+	defer stop()
+
+	var conn net.Conn = dc
+	if t.TLS == TLSImplicit {
+		tlsConn := tls.Client(dc, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			raw.Close()
+			return nil, fmt.Errorf("error connecting to %s: %w", addr, err)
+		}
+		conn = tlsConn
+	}
+
+	c, err := smtp.NewClient(conn, t.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error starting SMTP session: %w", err)
+	}
+
+	if t.TLS == TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("server %s does not support STARTTLS", addr)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("error starting TLS: %w", err)
+		}
+	}
+
+	if err := t.authenticate(ctx, c); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error authenticating: %w", err)
+	}
+	return &smtpConn{client: c, conn: dc}, nil
+}
+
+// get takes the most recently used idle connection from the pool, checking
+// with RSET that the server still answers
+func (t *SMTPTransport) get() (*smtpConn, bool) {
+	for {
+		t.mu.Lock()
+		n := len(t.idle)
+		if n == 0 {
+			t.mu.Unlock()
+			return nil, false
+		}
+		conn := t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		t.mu.Unlock()
+
+		if time.Since(conn.lastUsed) < t.idleTimeout() && conn.client.Reset() == nil {
+			return conn, true
+		}
+		conn.client.Close()
+	}
+}
+
+// put returns a connection to the pool, or closes it when the pool is full
+// or the transport was closed
+func (t *SMTPTransport) put(conn *smtpConn) {
+	conn.lastUsed = time.Now()
+
+	t.mu.Lock()
+	if t.closed || len(t.idle) >= t.MaxIdle {
+		t.mu.Unlock()
+		conn.client.Quit()
+		return
+	}
+	t.idle = append(t.idle, conn)
+	startReaper := !t.reaping
+	t.reaping = true
+	t.mu.Unlock()
+
+	if startReaper {
+		go t.reapIdle()
+	}
+}
+
+// reapIdle closes connections that stayed idle past the timeout. It exits
+// once the pool is empty.
+func (t *SMTPTransport) reapIdle() {
+	timeout := t.idleTimeout()
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.mu.Lock()
+		var expired []*smtpConn
+		kept := t.idle[:0]
+		for _, conn := range t.idle {
+			if time.Since(conn.lastUsed) >= timeout {
+				expired = append(expired, conn)
+			} else {
+				kept = append(kept, conn)
+			}
+		}
+		t.idle = kept
+		empty := len(t.idle) == 0
+		if empty {
+			t.reaping = false
+		}
+		t.mu.Unlock()
+
+		for _, conn := range expired {
+			conn.client.Quit()
+		}
+		if empty {
+			return
+		}
+	}
+}
+
+// Close ends every idle connection. Connections in use are closed when
+// their current message is done, and later sends no longer pool theirs.
+func (t *SMTPTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	idle := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.client.Quit()
+	}
+	return nil
+}
+
+func (t *SMTPTransport) idleTimeout() time.Duration {
+	return durationOr(t.IdleTimeout, 30*time.Second)
+}
+
+// durationOr returns d, or def when d is not set
+func durationOr(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// deadlineConn gives every read and write its own deadline and can be
+// aborted from another goroutine when a context is cancelled
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+	aborted int32
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.extend(c.Conn.SetReadDeadline)
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.extend(c.Conn.SetWriteDeadline)
+	return c.Conn.Write(b)
+}
+
+// extend pushes the deadline out by the timeout unless the connection was
+// aborted. The flag is checked after setting so a concurrent abort always
+// wins.
+func (c *deadlineConn) extend(set func(time.Time) error) {
+	set(time.Now().Add(c.timeout))
+	if atomic.LoadInt32(&c.aborted) != 0 {
+		set(time.Unix(1, 0))
+	}
+}
+
+// abort makes pending and future I/O fail immediately
+func (c *deadlineConn) abort() {
+	atomic.StoreInt32(&c.aborted, 1)
+	c.Conn.SetDeadline(time.Unix(1, 0))
+}
+
+// watch aborts the connection if ctx is done before stop is called
+func (c *deadlineConn) watch(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.abort()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// brokenConn reports whether err means the connection itself can no
+// longer be used, as opposed to the server rejecting a command
+func brokenConn(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		// 421: the server is closing the connection
+		return protoErr.Code == 421
+	}
+	return true
+}
@@ -0,0 +1,331 @@
+package mailer_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/pranavKharche24/mail/mailer"
+	"github.com/pranavKharche24/mail/mailtest"
+)
+
+// selfSigned returns a certificate for 127.0.0.1 and a pool trusting it
+func selfSigned(t testing.TB) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mailtest"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// transportFor returns a transport logging in to srv with the given TLS mode
+func transportFor(srv *mailtest.Server, mode mailer.TLSMode, roots *x509.CertPool) *mailer.SMTPTransport {
+	host, port, _ := net.SplitHostPort(srv.Addr)
+	return &mailer.SMTPTransport{
+		Host:     host,
+		Port:     port,
+		TLS:      mode,
+		Username: srv.Username,
+		Password: srv.Password,
+		RootCAs:  roots,
+		Timeout:  5 * time.Second,
+	}
+}
+
+func sendVia(tr mailer.Transport) error {
+	return tr.Send(context.Background(), "sender@example.com", []string{"bob@example.com"},
+		strings.NewReader("Subject: TLS\r\n\r\nHello\r\n"))
+}
+
+func TestTLSModes(t *testing.T) {
+	cert, roots := selfSigned(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	tests := []struct {
+		mode     mailer.TLSMode
+		setup    func(*mailtest.Server)
+		tls      bool
+		commands string
+	}{
+		{
+			mode:     mailer.TLSStartTLS,
+			setup:    func(s *mailtest.Server) { s.TLSConfig = tlsConfig },
+			tls:      true,
+			commands: "EHLO localhost|STARTTLS|EHLO localhost|AUTH PLAIN|MAIL",
+		},
+		{
+			mode:     mailer.TLSImplicit,
+			setup:    func(s *mailtest.Server) { s.TLSConfig, s.ImplicitTLS = tlsConfig, true },
+			tls:      true,
+			commands: "EHLO localhost|AUTH PLAIN|MAIL",
+		},
+		{
+			mode:     mailer.TLSNone,
+			setup:    func(s *mailtest.Server) {},
+			commands: "EHLO localhost|AUTH PLAIN|MAIL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			srv := mailtest.NewUnstartedServer()
+			srv.AuthMechanisms = []string{"PLAIN"}
+			srv.RequireAuth = true
+			tt.setup(srv)
+			srv.Start()
+			defer srv.Close()
+
+			if err := sendVia(transportFor(srv, tt.mode, roots)); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			msg := srv.LastMessage(t)
+			if msg.TLS != tt.tls {
+				t.Errorf("message sent with TLS %v, want %v", msg.TLS, tt.tls)
+			}
+			if msg.User != "sender@example.com" {
+				t.Errorf("logged in as %q", msg.User)
+			}
+			if got := strings.Join(srv.Commands(), "|"); !strings.HasPrefix(got, tt.commands) {
+				t.Errorf("commands %q, want them to start with %q", got, tt.commands)
+			}
+		})
+	}
+}
+
+func TestTLSFailures(t *testing.T) {
+	cert, roots := selfSigned(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	t.Run("no STARTTLS", func(t *testing.T) {
+		srv := mailtest.NewServer()
+		defer srv.Close()
+		err := sendVia(transportFor(srv, mailer.TLSStartTLS, roots))
+		if err == nil || !strings.Contains(err.Error(), "does not support STARTTLS") {
+			t.Fatalf("send returned %v", err)
+		}
+		if cmds := srv.Commands(); len(cmds) > 1 {
+			t.Errorf("continued in plain text: %q", cmds)
+		}
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		srv := mailtest.NewUnstartedServer()
+		srv.TLSConfig = tlsConfig
+		srv.Start()
+		defer srv.Close()
+		err := sendVia(transportFor(srv, mailer.TLSStartTLS, nil))
+		if err == nil || !strings.Contains(err.Error(), "certificate") {
+			t.Fatalf("send returned %v, want a certificate error", err)
+		}
+		srv.AssertCount(t, 0)
+	})
+
+	t.Run("implicit TLS to a plain server", func(t *testing.T) {
+		srv := mailtest.NewServer()
+		defer srv.Close()
+		if err := sendVia(transportFor(srv, mailer.TLSImplicit, roots)); err == nil {
+			t.Fatal("TLS handshake with a plain-text server succeeded")
+		}
+		srv.AssertCount(t, 0)
+	})
+}
+
+func TestCloseDuringSend(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	srv.Delay("EOM", 200*time.Millisecond)
+	tr := transportFor(srv, mailer.TLSNone, nil)
+	tr.MaxIdle = 2
+
+	done := make(chan error, 1)
+	go func() { done <- sendVia(tr) }()
+	time.Sleep(50 * time.Millisecond)
+	tr.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	// The connection returned after Close must be ended, not pooled
+	cmds := srv.Commands()
+	if len(cmds) == 0 || cmds[len(cmds)-1] != "QUIT" {
+		t.Errorf("connection left open after Close: %q", cmds)
+	}
+}
+
+// BenchmarkSend compares 1,000 sends over a new connection each with the
+// same sends over a pool of kept-open connections
+func BenchmarkSend(b *testing.B) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+
+	for _, maxIdle := range []int{0, 2} {
+		name := "unpooled"
+		if maxIdle > 0 {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tr := transportFor(srv, mailer.TLSNone, nil)
+				tr.MaxIdle = maxIdle
+				for j := 0; j < 1000; j++ {
+					if err := sendVia(tr); err != nil {
+						b.Fatal(err)
+					}
+				}
+				tr.Close()
+				srv.Reset()
+			}
+		})
+	}
+}
+
+func TestReaderErrorAbortsMessage(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	tr := transportFor(srv, mailer.TLSNone, nil)
+	tr.MaxIdle = 2
+	defer tr.Close()
+
+	// A message whose rendering fails after part of the body was written
+	readErr := errors.New("error reading file")
+	msg := io.MultiReader(strings.NewReader("Subject: Broken\r\n\r\nfirst half"), iotest.ErrReader(readErr))
+	err := tr.Send(context.Background(), "sender@example.com", []string{"bob@example.com"}, msg)
+	if !errors.Is(err, readErr) {
+		t.Fatalf("send returned %v, want the reader's error", err)
+	}
+	srv.AssertCount(t, 0)
+
+	// The aborted connection must not be pooled
+	if err := sendVia(tr); err != nil {
+		t.Fatalf("send after the failure: %v", err)
+	}
+	srv.AssertCount(t, 1)
+	if got := strings.Count(strings.Join(srv.Commands(), "|"), "EHLO"); got != 2 {
+		t.Errorf("%d connections opened, want 2", got)
+	}
+}
+
+func TestSendCancelled(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	tr := transportFor(srv, mailer.TLSNone, nil)
+	tr.MaxIdle = 2
+	defer tr.Close()
+
+	// A context that is already done never reaches the server
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := tr.Send(ctx, "sender@example.com", []string{"bob@example.com"}, strings.NewReader("x")); !errors.Is(err, context.Canceled) {
+		t.Errorf("send returned %v", err)
+	}
+	if cmds := srv.Commands(); len(cmds) != 0 {
+		t.Errorf("cancelled send ran %q", cmds)
+	}
+
+	// Cancelling while the server holds back its reply to the message
+	// interrupts the send, without waiting for CommandTimeout
+	srv.Delay("EOM", time.Second)
+	tr.CommandTimeout = time.Minute
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	err := tr.Send(ctx, "sender@example.com", []string{"bob@example.com"}, strings.NewReader("Subject: Slow\r\n\r\nx\r\n"))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("send returned %v, want context.Canceled", err)
+	}
+	if waited := time.Since(start); waited > 900*time.Millisecond {
+		t.Errorf("cancelled send returned after %v", waited)
+	}
+
+	// The interrupted connection is not reused
+	srv.Delay("EOM", 0)
+	if err := sendVia(tr); err != nil {
+		t.Fatalf("send after cancelling: %v", err)
+	}
+	if got := strings.Count(strings.Join(srv.Commands(), "|"), "EHLO"); got != 2 {
+		t.Errorf("%d connections opened, want 2", got)
+	}
+}
+
+func TestSendDeadline(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	srv.Delay("CONNECT", time.Second)
+	tr := transportFor(srv, mailer.TLSNone, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := tr.Send(ctx, "sender@example.com", []string{"bob@example.com"}, strings.NewReader("x")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("send returned %v, want context.DeadlineExceeded", err)
+	}
+	if waited := time.Since(start); waited > 900*time.Millisecond {
+		t.Errorf("send returned %v after starting", waited)
+	}
+}
+
+func TestSendTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		set     func(*mailer.SMTPTransport)
+	}{
+		// Timeout covers connecting, including waiting for the greeting
+		{"greeting", "CONNECT", func(tr *mailer.SMTPTransport) { tr.Timeout = 100 * time.Millisecond }},
+		{"login", "AUTH", func(tr *mailer.SMTPTransport) { tr.Timeout = 100 * time.Millisecond }},
+		// CommandTimeout covers each command of the transaction
+		{"recipient", "RCPT", func(tr *mailer.SMTPTransport) { tr.CommandTimeout = 100 * time.Millisecond }},
+		{"message", "EOM", func(tr *mailer.SMTPTransport) { tr.CommandTimeout = 100 * time.Millisecond }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := mailtest.NewServer()
+			defer srv.Close()
+			srv.Delay(tt.command, time.Second)
+			tr := transportFor(srv, mailer.TLSNone, nil)
+			tt.set(tr)
+
+			start := time.Now()
+			err := sendVia(tr)
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Errorf("send returned %v, want a timeout", err)
+			}
+			if waited := time.Since(start); waited > 900*time.Millisecond {
+				t.Errorf("send returned after %v", waited)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"time"
+)
+
+// ErrQueued is wrapped by the error returned from Send when delivery failed
+// temporarily and the message was handed to the spooler for a later retry
+var ErrQueued = errors.New("message queued for retry")
+
+// Envelope describes a rendered message handed to a Spooler
+type Envelope struct {
+	From      string
+	To        []string
+	MessageID string
+	// Subject is kept for listings only
+	Subject string
+	// LastError is the delivery error that caused the message to be spooled
+	LastError string
+	// SendAt delays the first delivery attempt for scheduled messages
+	SendAt time.Time
+}
+
+// Spooler stores messages that could not be delivered right away so they
+// can be retried later, for example by the outbox package
+type Spooler interface {
+	Enqueue(env Envelope, msg io.Reader) error
+}
+
+// enqueue renders msg straight into the spooler
+func enqueue(spooler Spooler, env Envelope, msg io.WriterTo) error {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := msg.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	err := spooler.Enqueue(env, pr)
+	pr.Close()
+	return err
+}
+
+// TransportFunc adapts an ordinary function to the Transport interface
+type TransportFunc func(ctx context.Context, from string, rcpts []string, msg io.Reader) error
+
+// Send calls f
+func (f TransportFunc) Send(ctx context.Context, from string, rcpts []string, msg io.Reader) error {
+	return f(ctx, from, rcpts, msg)
+}
+
+// IsTemporary reports whether err is a transient delivery failure that is
+// worth retrying: a 4xx SMTP reply, a network error or a dropped connection.
+// 5xx replies and everything else are treated as permanent.
+func IsTemporary(err error) bool {
+	if err == nil {
+		return false
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
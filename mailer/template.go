@@ -0,0 +1,82 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// defaultTemplateData is used when a template is rendered without data
+var defaultTemplateData = map[string]interface{}{"Name": "User"}
+
+// RenderHTMLFile executes an HTML template file with data
+func RenderHTMLFile(htmlFile string, data interface{}) (string, error) {
+	t, err := htmltemplate.ParseFiles(htmlFile)
+	if err != nil {
+		return "", fmt.Errorf("error parsing HTML file: %v", err)
+	}
+	var body bytes.Buffer
+	if err := t.Execute(&body, templateData(data)); err != nil {
+		return "", fmt.Errorf("error executing template: %v", err)
+	}
+	return body.String(), nil
+}
+
+// RenderText executes a plain-text template such as a subject line
+func RenderText(name, text string, data interface{}) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	t, err := texttemplate.New(name).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing %s template: %v", name, err)
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, templateData(data)); err != nil {
+		return "", fmt.Errorf("error executing %s template: %v", name, err)
+	}
+	return out.String(), nil
+}
+
+// ParseTemplateFields turns "key=value" pairs into template data
+func ParseTemplateFields(pairs []string) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	for _, pair := range pairs {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid field %q (want key=value)", pair)
+		}
+		data[key] = strings.TrimSpace(value)
+	}
+	return data, nil
+}
+
+// LoadTemplateData reads template data from a JSON file
+func LoadTemplateData(jsonFile string) (map[string]interface{}, error) {
+	content, err := os.ReadFile(jsonFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading data file: %v", err)
+	}
+	data := make(map[string]interface{})
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("error parsing data file %s: %v", filepath.Base(jsonFile), err)
+	}
+	return data, nil
+}
+
+func templateData(data interface{}) interface{} {
+	if data == nil {
+		return defaultTemplateData
+	}
+	return data
+}
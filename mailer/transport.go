@@ -0,0 +1,177 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport delivers a fully rendered message to its recipients
+type Transport interface {
+	Send(ctx context.Context, from string, rcpts []string, msg io.Reader) error
+}
+
+// Transport names accepted by NewTransport
+const (
+	TransportSMTP     = "smtp"
+	TransportSendmail = "sendmail"
+	TransportFile     = "file"
+	TransportMemory   = "memory"
+)
+
+// TransportOptions holds the settings used by NewTransport
+type TransportOptions struct {
+	SendmailPath string
+	DropDir      string
+}
+
+// NewTransport creates one of the built-in transports by name. The SMTP
+// transport is represented by nil, which makes the Mailer use its own
+// server settings and credentials.
+func NewTransport(name string, opts TransportOptions) (Transport, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", TransportSMTP:
+		return nil, nil
+	case TransportSendmail:
+		return &SendmailTransport{Path: opts.SendmailPath}, nil
+	case TransportFile:
+		return &FileTransport{Dir: opts.DropDir}, nil
+	case TransportMemory:
+		return &MemoryTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q (want smtp, sendmail, file or memory)", name)
+	}
+}
+
+// SendmailTransport pipes messages to a local sendmail-compatible binary.
+// Envelope recipients are passed as arguments rather than relying on -t,
+// so Bcc recipients (which never appear in the headers) are still reached.
+type SendmailTransport struct {
+	Path string
+	Args []string
+}
+
+// Send runs sendmail with the message on stdin
+func (t *SendmailTransport) Send(ctx context.Context, from string, rcpts []string, msg io.Reader) error {
+	path := t.Path
+	if path == "" {
+		path = "/usr/sbin/sendmail"
+	}
+
+	args := append([]string{"-i"}, t.Args...)
+	if from != "" {
+		args = append(args, "-f", from)
+	}
+	args = append(args, "--")
+	args = append(args, rcpts...)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("sendmail failed: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("sendmail failed: %v", err)
+	}
+	if _, err := io.Copy(stdin, msg); err != nil {
+		// Closing stdin would make sendmail queue the truncated message
+		cmd.Process.Kill()
+		stdin.Close()
+		cmd.Wait()
+		return fmt.Errorf("sendmail aborted: %v", err)
+	}
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		if out := strings.TrimSpace(stderr.String()); out != "" {
+			return fmt.Errorf("sendmail failed: %v: %s", err, out)
+		}
+		return fmt.Errorf("sendmail failed: %v", err)
+	}
+	return nil
+}
+
+// FileTransport writes each message as an .eml file into a directory
+// instead of delivering it
+type FileTransport struct {
+	Dir string
+}
+
+// Send writes msg to a new file in the drop directory
+func (t *FileTransport) Send(ctx context.Context, from string, rcpts []string, msg io.Reader) error {
+	dir := t.Dir
+	if dir == "" {
+		dir = "maildrop"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating drop directory: %v", err)
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), hex.EncodeToString(suffix))
+
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating message file: %v", err)
+	}
+	if _, err := io.Copy(file, msg); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("error writing message file: %v", err)
+	}
+	return file.Close()
+}
+
+// SentMessage is a message captured by MemoryTransport
+type SentMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// MemoryTransport records messages in memory instead of delivering them
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []SentMessage
+}
+
+// Send records msg
+func (t *MemoryTransport) Send(ctx context.Context, from string, rcpts []string, msg io.Reader) error {
+	data, err := io.ReadAll(msg)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = append(t.messages, SentMessage{
+		From: from,
+		To:   append([]string{}, rcpts...),
+		Data: data,
+	})
+	return nil
+}
+
+// Messages returns a copy of the recorded messages
+func (t *MemoryTransport) Messages() []SentMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]SentMessage{}, t.messages...)
+}
+
+// Reset discards the recorded messages
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = nil
+}
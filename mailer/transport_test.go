@@ -0,0 +1,266 @@
+package mailer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+// fakeSendmail writes a script that saves its arguments and, once stdin is
+// complete, the message into dir
+func fakeSendmail(t *testing.T, dir string) string {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	script := "#!/bin/sh\n" +
+		"printf '%s\\n' \"$@\" > '" + filepath.Join(dir, "args") + "'\n" +
+		"data=$(cat; echo .)\n" +
+		"printf '%s' \"${data%.}\" > '" + filepath.Join(dir, "message") + "'\n"
+	return writeExecutable(t, dir, "sendmail", script)
+}
+
+func writeExecutable(t *testing.T, dir, name, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// brokenMessage returns part of a message and then fails, as a message
+// with an unreadable attachment does
+func brokenMessage(err error) io.Reader {
+	return io.MultiReader(strings.NewReader("Subject: Broken\r\n\r\nfirst half"), iotest.ErrReader(err))
+}
+
+func TestSendmailTransportAbortsOnReaderError(t *testing.T) {
+	dir := t.TempDir()
+	tr := &mailer.SendmailTransport{Path: fakeSendmail(t, dir)}
+
+	readErr := errors.New("error reading file")
+	err := tr.Send(context.Background(), "sender@example.com", []string{"bob@example.com"}, brokenMessage(readErr))
+	if err == nil || !strings.Contains(err.Error(), readErr.Error()) {
+		t.Fatalf("send returned %v, want the reader's error", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "message")); err == nil {
+		t.Error("sendmail was given a clean end of input for a truncated message")
+	}
+}
+
+func TestFileTransportAbortsOnReaderError(t *testing.T) {
+	dir := t.TempDir()
+	tr := &mailer.FileTransport{Dir: dir}
+
+	if err := tr.Send(context.Background(), "", nil, brokenMessage(errors.New("error reading file"))); err == nil {
+		t.Fatal("send succeeded")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("truncated message left in the drop directory: %v", entries)
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	opts := mailer.TransportOptions{SendmailPath: "/opt/bin/sendmail", DropDir: "out"}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"", "<nil>"},
+		{"smtp", "<nil>"},
+		{" SMTP ", "<nil>"},
+		{"sendmail", "*mailer.SendmailTransport"},
+		{"file", "*mailer.FileTransport"},
+		{"Memory", "*mailer.MemoryTransport"},
+	}
+	for _, tt := range tests {
+		tr, err := mailer.NewTransport(tt.name, opts)
+		if err != nil {
+			t.Errorf("NewTransport(%q): %v", tt.name, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", tr); tr == nil && tt.want != "<nil>" || tr != nil && got != tt.want {
+			t.Errorf("NewTransport(%q) = %v, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	tr, _ := mailer.NewTransport("sendmail", opts)
+	if tr.(*mailer.SendmailTransport).Path != opts.SendmailPath {
+		t.Errorf("sendmail path %q", tr.(*mailer.SendmailTransport).Path)
+	}
+	tr, _ = mailer.NewTransport("file", opts)
+	if tr.(*mailer.FileTransport).Dir != opts.DropDir {
+		t.Errorf("drop directory %q", tr.(*mailer.FileTransport).Dir)
+	}
+	if _, err := mailer.NewTransport("pigeon", opts); err == nil {
+		t.Error("unknown transport accepted")
+	}
+}
+
+func TestSendmailTransport(t *testing.T) {
+	dir := t.TempDir()
+	tr := &mailer.SendmailTransport{Path: fakeSendmail(t, dir), Args: []string{"-oem"}}
+
+	msg := "Subject: Hello\r\n\r\nHi Bob\r\n.\r\nStill here\r\n"
+	rcpts := []string{"bob@example.com", "-carol@example.com"}
+	if err := tr.Send(context.Background(), "sender@example.com", rcpts, strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recipients follow "--" so none can be taken for an option
+	args, _ := os.ReadFile(filepath.Join(dir, "args"))
+	want := "-i\n-oem\n-f\nsender@example.com\n--\nbob@example.com\n-carol@example.com\n"
+	if string(args) != want {
+		t.Errorf("arguments\n%s\nwant\n%s", args, want)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "message")); string(got) != msg {
+		t.Errorf("message %q, want %q", got, msg)
+	}
+
+	// Without a sender there is no -f
+	if err := tr.Send(context.Background(), "", rcpts[:1], strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if args, _ := os.ReadFile(filepath.Join(dir, "args")); string(args) != "-i\n-oem\n--\nbob@example.com\n" {
+		t.Errorf("arguments without a sender: %q", args)
+	}
+}
+
+func TestSendmailTransportFailure(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	dir := t.TempDir()
+	path := writeExecutable(t, dir, "sendmail", "#!/bin/sh\ncat > /dev/null\necho 'bob@example.com... User unknown' >&2\nexit 67\n")
+	tr := &mailer.SendmailTransport{Path: path}
+
+	err := sendVia(tr)
+	if err == nil || !strings.Contains(err.Error(), "User unknown") || !strings.Contains(err.Error(), "exit status 67") {
+		t.Errorf("send returned %v, want the exit status and sendmail's output", err)
+	}
+
+	tr.Path = filepath.Join(dir, "missing")
+	if err := sendVia(tr); err == nil {
+		t.Error("send through a missing binary succeeded")
+	}
+}
+
+func TestSendmailTransportCancel(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	dir := t.TempDir()
+	tr := &mailer.SendmailTransport{Path: writeExecutable(t, dir, "sendmail", "#!/bin/sh\ncat > /dev/null\nexec sleep 10\n")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := tr.Send(ctx, "sender@example.com", []string{"bob@example.com"}, strings.NewReader("Subject: Slow\r\n\r\nx\r\n"))
+	if err == nil {
+		t.Fatal("send succeeded after the deadline")
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Errorf("send returned %v after the deadline", waited)
+	}
+}
+
+func TestFileTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "drop")
+	tr := &mailer.FileTransport{Dir: dir}
+
+	msgs := []string{"Subject: One\r\n\r\n1\r\n", "Subject: Two\r\n\r\n2\r\n"}
+	for _, msg := range msgs {
+		if err := tr.Send(context.Background(), "sender@example.com", []string{"bob@example.com"}, strings.NewReader(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Messages sent within the same second still get their own files
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(msgs) {
+		t.Fatalf("%d files written, want %d", len(entries), len(msgs))
+	}
+	var got []string
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".eml" {
+			t.Errorf("file %s does not end in .eml", entry.Name())
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, entry.Name()))
+		got = append(got, string(data))
+		if info, _ := entry.Info(); runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+			t.Errorf("file %s has mode %v, want 0600", entry.Name(), info.Mode().Perm())
+		}
+	}
+	sort.Strings(got)
+	if strings.Join(got, "") != strings.Join(msgs, "") {
+		t.Errorf("files hold %q, want %q", got, msgs)
+	}
+}
+
+func TestMemoryTransport(t *testing.T) {
+	tr := &mailer.MemoryTransport{}
+	rcpts := []string{"bob@example.com", "carol@example.com"}
+	if err := tr.Send(context.Background(), "sender@example.com", rcpts, strings.NewReader("Subject: Hi\r\n\r\nx\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	rcpts[0] = "mallory@example.com"
+
+	msgs := tr.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("%d messages recorded, want 1", len(msgs))
+	}
+	if msgs[0].From != "sender@example.com" || strings.Join(msgs[0].To, ",") != "bob@example.com,carol@example.com" ||
+		string(msgs[0].Data) != "Subject: Hi\r\n\r\nx\r\n" {
+		t.Errorf("recorded %+v", msgs[0])
+	}
+
+	readErr := errors.New("error reading file")
+	if err := tr.Send(context.Background(), "", nil, brokenMessage(readErr)); !errors.Is(err, readErr) {
+		t.Errorf("send returned %v, want the reader's error", err)
+	}
+	if len(tr.Messages()) != 1 {
+		t.Error("failed send was recorded")
+	}
+	tr.Reset()
+	if len(tr.Messages()) != 0 {
+		t.Error("Reset kept messages")
+	}
+}
+
+func TestMailerUsesTransport(t *testing.T) {
+	tr := &mailer.MemoryTransport{}
+	m := mailer.New()
+	m.SetCredentials("sender@example.com", "secret")
+	m.SetTransport(tr)
+
+	msg := &mailer.Message{To: []string{"bob@example.com"}, Bcc: []string{"carol@example.com"}, Subject: "Hi", Text: "Hello"}
+	if _, err := m.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	msgs := tr.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("%d messages recorded, want 1", len(msgs))
+	}
+	if msgs[0].From != "sender@example.com" || strings.Join(msgs[0].To, ",") != "bob@example.com,carol@example.com" {
+		t.Errorf("envelope %s -> %v", msgs[0].From, msgs[0].To)
+	}
+	if data := string(msgs[0].Data); !strings.Contains(data, "Subject: Hi\r\n") || strings.Contains(data, "carol@example.com") {
+		t.Errorf("message\n%s", data)
+	}
+}
@@ -0,0 +1,166 @@
+package mailtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTB records the failures reported by the assertion helpers
+type fakeTB struct {
+	errors []string
+	fatal  bool
+}
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeTB) Fatalf(format string, args ...interface{}) {
+	f.Errorf(format, args...)
+	f.fatal = true
+}
+
+// sendSample sends a message with a Cc, a Bcc and an attachment
+func sendSample(t *testing.T, srv *Server) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(path, []byte("attached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := srv.Mailer().SendHTMLContent([]string{"bob@example.com"}, "Sample", "<p>Hello <b>Bob</b></p>",
+		[]string{"carol@example.com"}, []string{"dave@example.com"}, []string{path})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+func TestAssertionsPass(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	sendSample(t, srv)
+
+	tb := &fakeTB{}
+	srv.AssertCount(tb, 1)
+	msg := srv.LastMessage(tb)
+	msg.AssertFrom(tb, "sender@example.com")
+	msg.AssertRecipients(tb, "dave@example.com", "bob@example.com", "carol@example.com")
+	msg.AssertHeader(tb, "subject", "Sample")
+	msg.AssertNoHeader(tb, "Bcc")
+	msg.AssertHTMLContains(tb, "Hello <b>Bob</b>")
+	msg.AssertTextContains(tb, "Hello Bob")
+	msg.AssertAttachment(tb, "notes.txt", []byte("attached"))
+	msg.AssertAttachment(tb, "notes.txt", nil)
+	if len(tb.errors) != 0 {
+		t.Errorf("passing assertions reported failures: %q", tb.errors)
+	}
+}
+
+func TestAssertionsFail(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	sendSample(t, srv)
+	msg := srv.LastMessage(t)
+
+	checks := map[string]func(TB){
+		"AssertCount":        func(tb TB) { srv.AssertCount(tb, 2) },
+		"AssertFrom":         func(tb TB) { msg.AssertFrom(tb, "other@example.com") },
+		"AssertRecipients":   func(tb TB) { msg.AssertRecipients(tb, "bob@example.com") },
+		"AssertHeader":       func(tb TB) { msg.AssertHeader(tb, "Subject", "Other") },
+		"AssertNoHeader":     func(tb TB) { msg.AssertNoHeader(tb, "Subject") },
+		"AssertTextContains": func(tb TB) { msg.AssertTextContains(tb, "Goodbye") },
+		"AssertHTMLContains": func(tb TB) { msg.AssertHTMLContains(tb, "<i>") },
+		"AssertAttachment":   func(tb TB) { msg.AssertAttachment(tb, "missing.txt", nil) },
+		"AssertAttachment data": func(tb TB) {
+			msg.AssertAttachment(tb, "notes.txt", []byte("other"))
+		},
+	}
+	for name, check := range checks {
+		tb := &fakeTB{}
+		check(tb)
+		if len(tb.errors) != 1 {
+			t.Errorf("%s reported %d failures, want 1: %q", name, len(tb.errors), tb.errors)
+		}
+	}
+
+	srv.Reset()
+	tb := &fakeTB{}
+	if msg := srv.LastMessage(tb); msg != nil || !tb.fatal {
+		t.Errorf("LastMessage on an empty server returned %v, fatal %v", msg, tb.fatal)
+	}
+}
+
+func TestFailureTimes(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	m := srv.Mailer()
+
+	srv.Fail(Failure{Command: "rcpt", Code: 452, Message: "4.5.3 Too many recipients", Times: 2})
+	for i := 0; i < 2; i++ {
+		_, err := m.SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, nil)
+		if err == nil || !strings.Contains(err.Error(), "452") {
+			t.Fatalf("attempt %d returned %v, want the injected 452", i+1, err)
+		}
+	}
+	if _, err := m.SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, nil); err != nil {
+		t.Fatalf("third attempt: %v", err)
+	}
+
+	srv.Fail(Failure{Command: "DATA", Code: 554, Message: "5.3.4 No"})
+	srv.Reset()
+	if _, err := m.SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, nil); err != nil {
+		t.Fatalf("send after Reset: %v", err)
+	}
+	srv.AssertCount(t, 1)
+}
+
+func TestCommandsHideCredentials(t *testing.T) {
+	srv := NewUnstartedServer()
+	srv.AuthMechanisms = []string{"PLAIN"}
+	srv.Start()
+	defer srv.Close()
+
+	if _, err := srv.Mailer().SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	commands := srv.Commands()
+	want := []string{"EHLO localhost", "AUTH PLAIN", "MAIL FROM:<sender@example.com> BODY=8BITMIME", "RCPT TO:<bob@example.com>", "DATA", "QUIT"}
+	if strings.Join(commands, "|") != strings.Join(want, "|") {
+		t.Errorf("commands are %q, want %q", commands, want)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	srv := NewUnstartedServer()
+	srv.AuthMechanisms = nil
+	srv.RequireAuth = true
+	srv.Start()
+	defer srv.Close()
+
+	_, err := srv.Mailer().SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "530") {
+		t.Fatalf("send without AUTH returned %v, want 530", err)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	m := srv.Mailer()
+
+	srv.Delay("DATA", 300*time.Millisecond)
+	m.SetTimeouts(0, 100*time.Millisecond)
+	start := time.Now()
+	_, err := m.SendPlain([]string{"bob@example.com"}, "x", "x", nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("send returned %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("timeout took %v", elapsed)
+	}
+}
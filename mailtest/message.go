@@ -0,0 +1,153 @@
+package mailtest
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/pranavKharche24/mail/catcher"
+)
+
+// TB is the part of testing.TB used by the assertion helpers
+type TB interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// Message is a message accepted by the server, with its envelope and the
+// decoded header, bodies and attachments
+type Message struct {
+	From string
+	To   []string
+	// Helo is the name the client gave in EHLO or HELO
+	Helo string
+	// User is the name the client logged in with, if any
+	User string
+	// TLS reports whether the message was sent over TLS
+	TLS  bool
+	Data []byte
+	*catcher.Parsed
+}
+
+func newMessage(from string, to []string, data []byte) *Message {
+	return &Message{
+		From:   from,
+		To:     append([]string{}, to...),
+		Data:   data,
+		Parsed: (&catcher.Message{Raw: data}).Parse(),
+	}
+}
+
+// Header returns the decoded value of the first header field called name,
+// or an empty string
+func (m *Message) Header(name string) string {
+	for _, field := range m.Parsed.Header {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Attachment returns the attachment or inline part called filename, or nil
+func (m *Message) Attachment(filename string) *catcher.Part {
+	for i := range m.Parts {
+		if m.Parts[i].Filename == filename {
+			return &m.Parts[i]
+		}
+	}
+	return nil
+}
+
+// LastMessage returns the most recent message, failing the test if there
+// is none
+func (s *Server) LastMessage(t TB) *Message {
+	t.Helper()
+	messages := s.Messages()
+	if len(messages) == 0 {
+		t.Fatalf("mailtest: no message was received")
+		return nil
+	}
+	return messages[len(messages)-1]
+}
+
+// AssertCount checks that n messages were received
+func (s *Server) AssertCount(t TB, n int) {
+	t.Helper()
+	if got := len(s.Messages()); got != n {
+		t.Errorf("mailtest: received %d message(s), want %d", got, n)
+	}
+}
+
+// AssertFrom checks the envelope sender
+func (m *Message) AssertFrom(t TB, want string) {
+	t.Helper()
+	if m.From != want {
+		t.Errorf("mailtest: envelope sender is %q, want %q", m.From, want)
+	}
+}
+
+// AssertRecipients checks the envelope recipients, in any order
+func (m *Message) AssertRecipients(t TB, want ...string) {
+	t.Helper()
+	got := append([]string{}, m.To...)
+	want = append([]string{}, want...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("mailtest: envelope recipients are %v, want %v", m.To, want)
+	}
+}
+
+// AssertHeader checks the decoded value of a header field
+func (m *Message) AssertHeader(t TB, name, want string) {
+	t.Helper()
+	if got := m.Header(name); got != want {
+		t.Errorf("mailtest: header %s is %q, want %q", name, got, want)
+	}
+}
+
+// AssertNoHeader checks that a header field is absent, as Bcc should be
+func (m *Message) AssertNoHeader(t TB, name string) {
+	t.Helper()
+	for _, field := range m.Parsed.Header {
+		if strings.EqualFold(field.Name, name) {
+			t.Errorf("mailtest: unexpected header %s: %q", field.Name, field.Value)
+		}
+	}
+}
+
+// AssertTextContains checks that the plain text body contains substr
+func (m *Message) AssertTextContains(t TB, substr string) {
+	t.Helper()
+	if !strings.Contains(m.Text, substr) {
+		t.Errorf("mailtest: text body does not contain %q:\n%s", substr, m.Text)
+	}
+}
+
+// AssertHTMLContains checks that the HTML body contains substr
+func (m *Message) AssertHTMLContains(t TB, substr string) {
+	t.Helper()
+	if !strings.Contains(m.HTML, substr) {
+		t.Errorf("mailtest: HTML body does not contain %q:\n%s", substr, m.HTML)
+	}
+}
+
+// AssertAttachment checks that an attachment called filename exists and,
+// unless want is nil, that it holds want
+func (m *Message) AssertAttachment(t TB, filename string, want []byte) {
+	t.Helper()
+	part := m.Attachment(filename)
+	if part == nil {
+		var names []string
+		for _, p := range m.Parts {
+			names = append(names, p.Filename)
+		}
+		t.Errorf("mailtest: no attachment %q (have %q)", filename, names)
+		return
+	}
+	if want != nil && !bytes.Equal(part.Data, want) {
+		t.Errorf("mailtest: attachment %q holds %d bytes that differ from the %d expected", filename, len(part.Data), len(want))
+	}
+}
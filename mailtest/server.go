@@ -0,0 +1,592 @@
+// Package mailtest provides an in-process fake SMTP server for testing code
+// that sends mail, so no real account is needed. The server records every
+// message it accepts and can be told to offer particular extensions and
+// login mechanisms, to reject credentials, to answer commands with injected
+// errors and to reply slowly:
+//
+//	srv := mailtest.NewServer()
+//	defer srv.Close()
+//
+//	m := srv.Mailer()
+//	if _, err := m.SendPlain([]string{"bob@example.com"}, "Hi", "Hello", nil, nil, nil); err != nil {
+//		t.Fatal(err)
+//	}
+//	msg := srv.LastMessage(t)
+//	msg.AssertRecipients(t, "bob@example.com")
+//	msg.AssertTextContains(t, "Hello")
+package mailtest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+// Failure is an SMTP reply injected in place of the normal handling of a
+// command
+type Failure struct {
+	// Command is the verb to fail, such as "MAIL", "RCPT", "DATA" or
+	// "AUTH". "CONNECT" replaces the greeting and "EOM" the reply to the
+	// message body, after it has been read.
+	Command string
+	Code    int
+	Message string
+	// Times limits how often the failure is returned; zero means always
+	Times int
+}
+
+// Server is a fake SMTP server. Fields may be changed between
+// NewUnstartedServer and Start.
+type Server struct {
+	// Addr is the address the server listens on, set by Start
+	Addr string
+	// Hostname is announced in the greeting and EHLO reply
+	Hostname string
+	// Extensions are the EHLO keywords offered besides STARTTLS and AUTH
+	Extensions []string
+	// AuthMechanisms are offered in the AUTH keyword; empty disables AUTH
+	AuthMechanisms []string
+	// Username and Password are the accepted credentials. Password is also
+	// the accepted XOAUTH2 token.
+	Username string
+	Password string
+	// RequireAuth rejects MAIL until the client has logged in
+	RequireAuth bool
+	// TLSConfig enables STARTTLS
+	TLSConfig *tls.Config
+	// ImplicitTLS makes the server expect TLS from the first byte, as on
+	// port 465, using TLSConfig
+	ImplicitTLS bool
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	closed   bool
+	messages []*Message
+	commands []string
+	failures []*Failure
+	delays   map[string]time.Duration
+}
+
+// NewServer starts a server on a random port of the loopback interface
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a server with the default settings, which can
+// be changed before calling Start
+func NewUnstartedServer() *Server {
+	return &Server{
+		Hostname:       "mailtest.local",
+		Extensions:     []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES"},
+		AuthMechanisms: []string{"PLAIN", "LOGIN", "CRAM-MD5", "XOAUTH2"},
+		Username:       "sender@example.com",
+		Password:       "secret",
+	}
+}
+
+// Start starts listening; it panics if no port is available
+func (s *Server) Start() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("mailtest: failed to listen: %v", err))
+	}
+	s.listener = l
+	s.Addr = l.Addr().String()
+	s.conns = make(map[net.Conn]bool)
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Close stops the server and waits for open sessions to end
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Mailer returns a mailer that sends to this server as Username, opening a
+// new connection for every message
+func (s *Server) Mailer() *mailer.Mailer {
+	host, port, _ := net.SplitHostPort(s.Addr)
+	m := mailer.New()
+	m.SetCredentials(s.Username, s.Password)
+	m.SetServer(host, port, mailer.TLSNone)
+	m.SetPool(0, 0)
+	return m
+}
+
+// Fail injects a failure; see Failure
+func (s *Server) Fail(f Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f.Command = strings.ToUpper(f.Command)
+	s.failures = append(s.failures, &f)
+}
+
+// Delay makes the server wait d before answering command, or every command
+// if command is empty. "CONNECT" delays the greeting and "EOM" the reply to
+// the message body.
+func (s *Server) Delay(command string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.delays == nil {
+		s.delays = make(map[string]time.Duration)
+	}
+	s.delays[strings.ToUpper(command)] = d
+}
+
+// Messages returns the messages received so far
+func (s *Server) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message{}, s.messages...)
+}
+
+// Commands returns the commands received so far, without the credentials
+// of AUTH
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+// Reset discards the recorded messages and commands and removes injected
+// failures and delays
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+	s.commands = nil
+	s.failures = nil
+	s.delays = nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				c.Close()
+				s.mu.Lock()
+				delete(s.conns, c)
+				s.mu.Unlock()
+			}()
+			sess := &session{server: s, conn: c, text: textproto.NewConn(c)}
+			if s.ImplicitTLS {
+				tlsConn := tls.Server(c, s.TLSConfig)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				sess.conn, sess.text, sess.tls = tlsConn, textproto.NewConn(tlsConn), true
+			}
+			sess.serve()
+		}()
+	}
+}
+
+// failure returns the injected failure for command, if any
+func (s *Server) failure(command string) *Failure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.failures {
+		if f.Command != command {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+func (s *Server) wait(command string) {
+	s.mu.Lock()
+	d, ok := s.delays[command]
+	if !ok {
+		d = s.delays[""]
+	}
+	s.mu.Unlock()
+	time.Sleep(d)
+}
+
+func (s *Server) record(command string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, command)
+}
+
+// offers reports whether mech is one of the AuthMechanisms
+func (s *Server) offers(mech string) bool {
+	for _, m := range s.AuthMechanisms {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// session is one client connection
+type session struct {
+	server *Server
+	conn   net.Conn
+	text   *textproto.Conn
+	tls    bool
+	helo   string
+	user   string
+	from   string
+	to     []string
+	inMail bool
+}
+
+func (c *session) serve() {
+	s := c.server
+	s.wait("CONNECT")
+	if f := s.failure("CONNECT"); f != nil {
+		c.reply(f.Code, f.Message)
+		return
+	}
+	c.reply(220, s.Hostname+" ESMTP mailtest")
+
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		if verb == "AUTH" {
+			mech, _, _ := strings.Cut(arg, " ")
+			s.record("AUTH " + mech)
+		} else {
+			s.record(line)
+		}
+
+		s.wait(verb)
+		if f := s.failure(verb); f != nil {
+			c.reply(f.Code, f.Message)
+			if f.Code == 421 {
+				return
+			}
+			continue
+		}
+
+		switch verb {
+		case "HELO":
+			c.helo = arg
+			c.reset()
+			c.reply(250, s.Hostname)
+		case "EHLO":
+			c.helo = arg
+			c.reset()
+			c.ehlo()
+		case "STARTTLS":
+			if s.TLSConfig == nil || c.tls {
+				c.reply(502, "5.5.1 STARTTLS not available")
+				continue
+			}
+			c.reply(220, "2.0.0 Ready to start TLS")
+			tlsConn := tls.Server(c.conn, s.TLSConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			c.conn = tlsConn
+			c.text = textproto.NewConn(tlsConn)
+			c.tls = true
+			c.helo = ""
+			c.reset()
+		case "AUTH":
+			c.auth(arg)
+		case "MAIL":
+			c.mail(arg)
+		case "RCPT":
+			c.rcpt(arg)
+		case "DATA":
+			if !c.data() {
+				return
+			}
+		case "RSET":
+			c.reset()
+			c.reply(250, "2.0.0 OK")
+		case "NOOP":
+			c.reply(250, "2.0.0 OK")
+		case "VRFY":
+			c.reply(252, "2.5.0 Cannot verify user")
+		case "QUIT":
+			c.reply(221, "2.0.0 Bye")
+			return
+		default:
+			c.reply(502, "5.5.2 Command not recognized")
+		}
+	}
+}
+
+func (c *session) ehlo() {
+	s := c.server
+	lines := []string{s.Hostname}
+	lines = append(lines, s.Extensions...)
+	if s.TLSConfig != nil && !c.tls {
+		lines = append(lines, "STARTTLS")
+	}
+	if len(s.AuthMechanisms) > 0 {
+		lines = append(lines, "AUTH "+strings.Join(s.AuthMechanisms, " "))
+	}
+	c.reply(250, lines...)
+}
+
+func (c *session) auth(arg string) {
+	s := c.server
+	mech, initial, _ := strings.Cut(arg, " ")
+	mech = strings.ToUpper(mech)
+	switch {
+	case c.user != "":
+		c.reply(503, "5.5.1 Already authenticated")
+		return
+	case c.inMail:
+		c.reply(503, "5.5.1 AUTH not allowed during a mail transaction")
+		return
+	case !s.offers(mech):
+		c.reply(504, "5.5.4 Unrecognized authentication type")
+		return
+	}
+
+	var user, password string
+	var ok bool
+	switch mech {
+	case "PLAIN":
+		resp, cont := c.challenge(initial, "")
+		if !cont {
+			return
+		}
+		parts := strings.Split(string(resp), "\x00")
+		if len(parts) == 3 {
+			user, password, ok = parts[1], parts[2], true
+		}
+	case "LOGIN":
+		var name, pass []byte
+		cont := true
+		if initial != "" {
+			name, cont = c.decode(initial)
+		} else {
+			name, cont = c.challenge("", "Username:")
+		}
+		if !cont {
+			return
+		}
+		if pass, cont = c.challenge("", "Password:"); !cont {
+			return
+		}
+		user, password, ok = string(name), string(pass), true
+	case "CRAM-MD5":
+		nonce := fmt.Sprintf("<%d@%s>", time.Now().UnixNano(), s.Hostname)
+		resp, cont := c.challenge("", nonce)
+		if !cont {
+			return
+		}
+		name, digest, found := strings.Cut(string(resp), " ")
+		h := hmac.New(md5.New, []byte(s.Password))
+		h.Write([]byte(nonce))
+		if found && hmac.Equal([]byte(digest), []byte(hex.EncodeToString(h.Sum(nil)))) {
+			user, password, ok = name, s.Password, true
+		}
+	case "XOAUTH2":
+		resp, cont := c.challenge(initial, "")
+		if !cont {
+			return
+		}
+		for _, field := range strings.Split(string(resp), "\x01") {
+			if strings.HasPrefix(field, "user=") {
+				user = field[len("user="):]
+			}
+			if strings.HasPrefix(field, "auth=Bearer ") {
+				password, ok = field[len("auth=Bearer "):], true
+			}
+		}
+	}
+
+	if !ok || (s.Username != "" && user != s.Username) || password != s.Password {
+		c.reply(535, "5.7.8 Authentication credentials invalid")
+		return
+	}
+	c.user = user
+	c.reply(235, "2.7.0 Authentication successful")
+}
+
+// challenge returns the decoded initial response, or sends prompt and
+// reads the client's answer. It returns false if the exchange failed and
+// has been answered.
+func (c *session) challenge(initial, prompt string) ([]byte, bool) {
+	if initial != "" {
+		return c.decode(initial)
+	}
+	c.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt)))
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return nil, false
+	}
+	if line == "*" {
+		c.reply(501, "5.0.0 Authentication cancelled")
+		return nil, false
+	}
+	return c.decode(line)
+}
+
+func (c *session) decode(s string) ([]byte, bool) {
+	if s == "=" {
+		return nil, true
+	}
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		c.reply(501, "5.5.2 Invalid base64 data")
+		return nil, false
+	}
+	return data, true
+}
+
+func (c *session) mail(arg string) {
+	switch {
+	case c.helo == "":
+		c.reply(503, "5.5.1 Send EHLO first")
+		return
+	case c.server.RequireAuth && c.user == "":
+		c.reply(530, "5.7.0 Authentication required")
+		return
+	case c.inMail:
+		c.reply(503, "5.5.1 Nested MAIL command")
+		return
+	}
+	addr, ok := pathArg(arg, "FROM:")
+	if !ok {
+		c.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	c.from = addr
+	c.inMail = true
+	c.reply(250, "2.1.0 OK")
+}
+
+func (c *session) rcpt(arg string) {
+	if !c.inMail {
+		c.reply(503, "5.5.1 Send MAIL first")
+		return
+	}
+	addr, ok := pathArg(arg, "TO:")
+	if !ok || addr == "" {
+		c.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	c.to = append(c.to, addr)
+	c.reply(250, "2.1.5 OK")
+}
+
+// data reads a message and reports whether the session can go on
+func (c *session) data() bool {
+	if len(c.to) == 0 {
+		c.reply(503, "5.5.1 Send RCPT first")
+		return true
+	}
+	c.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+	data, err := c.text.ReadDotBytes()
+	if err != nil {
+		return false
+	}
+	data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+
+	s := c.server
+	s.wait("EOM")
+	if f := s.failure("EOM"); f != nil {
+		c.reset()
+		c.reply(f.Code, f.Message)
+		return f.Code != 421
+	}
+
+	msg := newMessage(c.from, c.to, data)
+	msg.Helo, msg.User, msg.TLS = c.helo, c.user, c.tls
+	s.mu.Lock()
+	s.messages = append(s.messages, msg)
+	n := len(s.messages)
+	s.mu.Unlock()
+
+	c.reset()
+	c.reply(250, fmt.Sprintf("2.0.0 OK: queued as %d", n))
+	return true
+}
+
+func (c *session) reset() {
+	c.from = ""
+	c.to = nil
+	c.inMail = false
+}
+
+// reply sends a reply, with one line per element of lines
+func (c *session) reply(code int, lines ...string) {
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if c.text.PrintfLine("%d%s%s", code, sep, line) != nil {
+			return
+		}
+	}
+}
+
+// pathArg extracts the address from "FROM:<addr> params" or "TO:<addr>"
+func pathArg(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", false
+	}
+	end := strings.Index(rest, ">")
+	if end < 0 {
+		return "", false
+	}
+	return rest[1:end], true
+}
@@ -1,34 +1,81 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/pranavKharche24/mail/catcher"
 	"github.com/pranavKharche24/mail/cli"
 	"github.com/pranavKharche24/mail/config"
 	"github.com/pranavKharche24/mail/mailer"
+	"github.com/pranavKharche24/mail/outbox"
+	"github.com/pranavKharche24/mail/smtpd"
 	"github.com/pranavKharche24/mail/web"
 )
 
 const version = "1.0.0"
 
 func main() {
+	// Installed as /usr/sbin/sendmail, gomail only speaks the sendmail interface
+	if filepath.Base(os.Args[0]) == "sendmail" {
+		os.Exit(runSendmail(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sendmail" {
+		os.Exit(runSendmail(os.Args[2:]))
+	}
+
 	// Load configuration
 	cfg := config.Load()
 
+	// Key management must work before signing is configured
+	if len(os.Args) > 1 && os.Args[1] == "dkim" {
+		os.Exit(cli.RunDKIM(cfg, os.Args[2:]))
+	}
+
+	// Scripts need configuration errors reported with their own exit code
+	if len(os.Args) > 1 && os.Args[1] == "send" {
+		os.Exit(runSend(cfg, os.Args[2:]))
+	}
+
 	// Create mailer instance
-	m := mailer.New()
-	m.SetCredentials(cfg.EmailFrom, cfg.EmailPassword)
+	m, err := newMailer(cfg)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	// Open the outbox that keeps temporarily failed messages
+	ob, err := outbox.Open(filepath.Join(cfg.DataDir, "outbox"))
+	if err != nil {
+		log.Fatalf("Outbox error: %v", err)
+	}
+	m.SetSpooler(ob)
 
 	// Check command line arguments
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
 		case "cli", "-c", "--cli":
+			startOutbox(ob, m)
 			runCLI(m)
 		case "web", "-w", "--web":
-			runWeb(cfg, m)
+			startOutbox(ob, m)
+			runWeb(cfg, m, ob)
+		case "relay":
+			startOutbox(ob, m)
+			runRelay(cfg, m, ob)
+		case "catcher":
+			runCatcher(cfg, m)
+		case "merge":
+			exit(m, cli.RunMerge(m, os.Args[2:]))
+		case "queue":
+			exit(m, cli.RunQueue(m, ob, os.Args[2:]))
 		case "version", "-v", "--version":
 			fmt.Printf("Gomail v%s\n", version)
 		case "help", "-h", "--help":
@@ -40,16 +87,278 @@ func main() {
 		}
 	} else {
 		// Default: launch both web server and CLI
-		runBoth(cfg, m)
+		startOutbox(ob, m)
+		runBoth(cfg, m, ob)
+	}
+}
+
+// exit closes the mailer's pooled connections and exits with code
+func exit(m *mailer.Mailer, code int) {
+	m.Close()
+	os.Exit(code)
+}
+
+// newMailer creates a mailer from the loaded configuration
+func newMailer(cfg *config.Config) (*mailer.Mailer, error) {
+	m := mailer.New()
+	m.SetCredentials(cfg.EmailFrom, cfg.EmailPassword)
+
+	tlsMode, err := mailer.ParseTLSMode(cfg.SMTPTLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_TLS: %v", err)
+	}
+	m.SetServer(cfg.SMTPHost, cfg.SMTPPort, tlsMode)
+
+	authMech, err := mailer.ParseAuthMechanism(cfg.SMTPAuth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_AUTH: %v", err)
+	}
+	m.SetAuth(authMech)
+	switch {
+	case cfg.SMTPOAuthTokenCmd != "":
+		m.SetTokenSource(tokenCommand(cfg.SMTPOAuthTokenCmd))
+	case cfg.SMTPOAuthToken != "":
+		m.SetTokenSource(mailer.StaticToken(cfg.SMTPOAuthToken))
+	case authMech == mailer.AuthXOAuth2:
+		return nil, fmt.Errorf("SMTP_AUTH=xoauth2 needs SMTP_OAUTH_TOKEN or SMTP_OAUTH_TOKEN_CMD")
+	}
+
+	poolSize, err := strconv.Atoi(cfg.SMTPPoolSize)
+	if err != nil || poolSize < 0 {
+		return nil, fmt.Errorf("invalid SMTP_POOL_SIZE: %q", cfg.SMTPPoolSize)
+	}
+	idleTimeout, err := time.ParseDuration(cfg.SMTPIdleTimeout)
+	if err != nil || idleTimeout <= 0 {
+		return nil, fmt.Errorf("invalid SMTP_IDLE_TIMEOUT: %q", cfg.SMTPIdleTimeout)
+	}
+	m.SetPool(poolSize, idleTimeout)
+
+	timeout, err := time.ParseDuration(cfg.SMTPTimeout)
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid SMTP_TIMEOUT: %q", cfg.SMTPTimeout)
+	}
+	commandTimeout, err := time.ParseDuration(cfg.SMTPCommandTimeout)
+	if err != nil || commandTimeout <= 0 {
+		return nil, fmt.Errorf("invalid SMTP_COMMAND_TIMEOUT: %q", cfg.SMTPCommandTimeout)
+	}
+	m.SetTimeouts(timeout, commandTimeout)
+
+	transport, err := mailer.NewTransport(cfg.Transport, mailer.TransportOptions{
+		SendmailPath: cfg.SendmailPath,
+		DropDir:      cfg.DropDir,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAIL_TRANSPORT: %v", err)
+	}
+	m.SetTransport(transport)
+
+	if cfg.DKIMKeyPath != "" {
+		signer, err := mailer.NewDKIMSigner(cfg.DKIMDomain, cfg.DKIMSelector, cfg.DKIMKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DKIM settings: %v", err)
+		}
+		m.SetDKIM(signer)
+	}
+
+	if cfg.PGPKeyring != "" {
+		keyring, err := mailer.LoadKeyring(cfg.PGPKeyring, cfg.PGPPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PGP_KEYRING: %v", err)
+		}
+		m.SetKeyring(keyring)
+	}
+
+	if cfg.SMIMECert != "" || cfg.SMIMEKey != "" {
+		if cfg.SMIMECert == "" || cfg.SMIMEKey == "" {
+			return nil, fmt.Errorf("invalid S/MIME settings: SMIME_CERT and SMIME_KEY must both be set")
+		}
+		signer, err := mailer.LoadSMIME(cfg.SMIMECert, cfg.SMIMEKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S/MIME settings: %v", err)
+		}
+		if err := signer.CheckSender(cfg.EmailFrom); err != nil {
+			return nil, fmt.Errorf("invalid S/MIME settings: %v", err)
+		}
+		m.SetSMIME(signer)
+	}
+
+	limits, err := rateLimit(cfg)
+	if err != nil {
+		return nil, err
+	}
+	m.SetRateLimit(limits)
+
+	return m, nil
+}
+
+// tokenCommand returns a token source that runs a shell command and uses
+// its output as the OAuth2 access token, so an external helper can refresh
+// expired tokens
+func tokenCommand(command string) mailer.TokenSource {
+	return func(ctx context.Context) (string, error) {
+		out, err := exec.CommandContext(ctx, "sh", "-c", command).Output()
+		if err != nil {
+			return "", fmt.Errorf("error running SMTP_OAUTH_TOKEN_CMD: %v", err)
+		}
+		token := strings.TrimSpace(string(out))
+		if token == "" {
+			return "", fmt.Errorf("SMTP_OAUTH_TOKEN_CMD printed no token")
+		}
+		return token, nil
+	}
+}
+
+// rateLimit parses the rate limit settings
+func rateLimit(cfg *config.Config) (mailer.RateLimit, error) {
+	var limits mailer.RateLimit
+	settings := []struct {
+		name  string
+		value string
+		dest  *int
+	}{
+		{"RATE_PER_SECOND", cfg.RatePerSecond, &limits.PerSecond},
+		{"RATE_PER_MINUTE", cfg.RatePerMinute, &limits.PerMinute},
+		{"RATE_PER_DAY", cfg.RatePerDay, &limits.PerDay},
+		{"MAX_CONCURRENT_SENDS", cfg.MaxConcurrent, &limits.MaxConcurrent},
+	}
+	for _, s := range settings {
+		if s.value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s.value)
+		if err != nil || n < 0 {
+			return limits, fmt.Errorf("invalid %s: %q", s.name, s.value)
+		}
+		*s.dest = n
+	}
+
+	switch cfg.RateLimitMode {
+	case "wait", "":
+		limits.Wait = true
+	case "fail":
+	default:
+		return limits, fmt.Errorf("invalid RATE_LIMIT_MODE: %q (want wait or fail)", cfg.RateLimitMode)
+	}
+	return limits, nil
+}
+
+// startOutbox sends scheduled messages and retries queued ones in the
+// background for as long as the process runs
+func startOutbox(ob *outbox.Outbox, m *mailer.Mailer) {
+	go ob.Run(context.Background(), mailer.TransportFunc(m.Deliver))
+}
+
+// newRelay creates the SMTP relay server from the loaded configuration
+func newRelay(cfg *config.Config, m *mailer.Mailer, ob *outbox.Outbox) (*smtpd.Server, error) {
+	addr := cfg.RelayAddr
+	if addr == "" {
+		addr = ":2525"
+	}
+	networks, err := smtpd.ParseNetworks(cfg.RelayNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RELAY_NETWORKS: %v", err)
+	}
+	users, err := smtpd.ParseUsers(cfg.RelayUsers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RELAY_USERS: %v", err)
+	}
+	maxSize, err := strconv.Atoi(cfg.RelayMaxSize)
+	if err != nil || maxSize <= 0 {
+		return nil, fmt.Errorf("invalid RELAY_MAX_SIZE_MB: %q", cfg.RelayMaxSize)
+	}
+	hostname, _ := os.Hostname()
+
+	server := &smtpd.Server{
+		Addr:     addr,
+		Hostname: hostname,
+		Handler:  smtpd.RelayHandler(m, ob),
+		MaxSize:  int64(maxSize) << 20,
+		Networks: networks,
+	}
+	if len(users) > 0 {
+		server.Auth = users.Check
+	}
+	if cfg.RelayTLSCert != "" || cfg.RelayTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.RelayTLSCert, cfg.RelayTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RELAY_TLS_CERT or RELAY_TLS_KEY: %v", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	return server, nil
+}
+
+func runRelay(cfg *config.Config, m *mailer.Mailer, ob *outbox.Outbox) {
+	printBanner()
+	server, err := newRelay(cfg, m, ob)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	log.Printf("SMTP relay listening on %s", server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("Relay failed to start: %v", err)
 	}
 }
 
-func runBoth(cfg *config.Config, m *mailer.Mailer) {
+// runCatcher captures mail instead of sending it: messages received on
+// CATCHER_ADDR and those sent from the web and CLI interfaces are kept and
+// shown on the inbox page
+func runCatcher(cfg *config.Config, m *mailer.Mailer) {
 	printBanner()
+	store, err := catcher.New(cfg.CatcherDir)
+	if err != nil {
+		log.Fatalf("Catcher error: %v", err)
+	}
+	m.SetTransport(store)
+	m.SetSpooler(nil)
+	if email, _ := m.GetCredentials(); email == "" {
+		m.SetCredentials("gomail@localhost", "")
+	}
+
+	smtpServer := &smtpd.Server{
+		Addr:     cfg.CatcherAddr,
+		Hostname: "localhost",
+		Handler:  store.HandleSMTP,
+	}
+	go func() {
+		if err := smtpServer.ListenAndServe(); err != nil {
+			log.Fatalf("Catcher failed to start: %v", err)
+		}
+	}()
+
+	fmt.Println()
+	fmt.Println("  Catching all mail; nothing will be delivered:")
+	fmt.Printf("  - SMTP:  %s\n", cfg.CatcherAddr)
+	fmt.Printf("  - Inbox: http://localhost:%s/inbox\n", cfg.Port)
+	fmt.Println()
+
+	server := web.New(cfg.Port, m)
+	server.SetCatcher(store)
+	if err := server.Start(); err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+}
+
+func runBoth(cfg *config.Config, m *mailer.Mailer, ob *outbox.Outbox) {
+	printBanner()
+
+	// Start the SMTP relay in background when it is configured
+	if cfg.RelayAddr != "" {
+		relay, err := newRelay(cfg, m, ob)
+		if err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+		go func() {
+			if err := relay.ListenAndServe(); err != nil {
+				log.Printf("Relay error: %v", err)
+			}
+		}()
+	}
 
 	// Start web server in background
 	go func() {
 		server := web.New(cfg.Port, m)
+		server.SetOutbox(ob)
 		if err := server.Start(); err != nil {
 			log.Printf("Web server error: %v", err)
 		}
@@ -58,33 +367,85 @@ func runBoth(cfg *config.Config, m *mailer.Mailer) {
 	fmt.Println()
 	fmt.Println("  Services started:")
 	fmt.Printf("  - Web Interface: http://localhost:%s\n", cfg.Port)
+	fmt.Printf("  - Outbox:        http://localhost:%s/outbox\n", cfg.Port)
 	fmt.Printf("  - Admin Panel:   http://localhost:%s/admin\n", cfg.Port)
+	if cfg.RelayAddr != "" {
+		fmt.Printf("  - SMTP Relay:    %s\n", cfg.RelayAddr)
+	}
 	fmt.Println("  - CLI Interface: Active below")
 	fmt.Println()
 	fmt.Println(strings.Repeat("-", 50))
 
-	// Run CLI in foreground
+	// Run CLI in foreground, sharing the mailer with the web server
 	c := cli.New()
-	email, pass := m.GetCredentials()
-	if email != "" && pass != "" {
-		c.SetMailer(m)
-	}
+	c.SetMailer(m)
 	c.Run()
 }
 
+// runSend sets up the mailer and outbox for "gomail send" and returns its
+// exit code
+func runSend(cfg *config.Config, args []string) int {
+	m, err := newMailer(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		return cli.ExitConfig
+	}
+	defer m.Close()
+
+	ob, err := outbox.Open(filepath.Join(cfg.DataDir, "outbox"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Outbox error: %v\n", err)
+		return cli.ExitConfig
+	}
+	m.SetSpooler(ob)
+	return cli.RunSend(m, args)
+}
+
+// runSendmail runs the sendmail interface. Callers such as cron run it
+// from arbitrary directories, so settings also come from SystemEnvFile and
+// the outbox must be at an absolute path; when it cannot be used the caller
+// is told to try again later rather than risk losing a message that fails
+// temporarily.
+func runSendmail(args []string) int {
+	cfg, err := config.LoadSendmail()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: configuration error: %v\n", err)
+		return cli.ExitConfig
+	}
+	if !filepath.IsAbs(cfg.SendmailDataDir) {
+		fmt.Fprintf(os.Stderr, "sendmail: DATA_DIR must be an absolute path in sendmail mode, not %q\n", cfg.SendmailDataDir)
+		return cli.ExitConfig
+	}
+	ob, err := outbox.Open(filepath.Join(cfg.SendmailDataDir, "outbox"))
+	if err == nil {
+		err = ob.CheckWritable()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: outbox unavailable: %v\n", err)
+		return cli.ExitTemporary
+	}
+
+	m, err := newMailer(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: configuration error: %v\n", err)
+		return cli.ExitConfig
+	}
+	defer m.Close()
+	m.SetSpooler(ob)
+	return cli.RunSendmail(m, args)
+}
+
 func runCLI(m *mailer.Mailer) {
 	printBanner()
 	c := cli.New()
-	email, pass := m.GetCredentials()
-	if email != "" && pass != "" {
-		c.SetMailer(m)
-	}
+	c.SetMailer(m)
 	c.Run()
 }
 
-func runWeb(cfg *config.Config, m *mailer.Mailer) {
+func runWeb(cfg *config.Config, m *mailer.Mailer, ob *outbox.Outbox) {
 	printBanner()
 	server := web.New(cfg.Port, m)
+	server.SetOutbox(ob)
 	if err := server.Start(); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
@@ -110,15 +471,80 @@ func printHelp() {
 	fmt.Println("  (none)             Start both Web and CLI interfaces")
 	fmt.Println("  cli, -c, --cli     Start CLI interface only")
 	fmt.Println("  web, -w, --web     Start Web interface only")
+	fmt.Println("  relay              Accept mail from other programs over SMTP and send it on")
+	fmt.Println("  catcher            Capture mail sent to localhost:1025 and show it at /inbox")
+	fmt.Println("                     instead of delivering it, for testing applications")
+	fmt.Println("  send               Send one message from scripts, cron or CI")
+	fmt.Println("                     (gomail send --help for options)")
+	fmt.Println("  sendmail           Read a message from stdin like sendmail(8); also used when")
+	fmt.Println("                     gomail is installed as sendmail (-t, -i, -f, -F, -oi)")
+	fmt.Println("  merge              Send one personalised message per CSV/JSON row")
+	fmt.Println("                     (gomail merge --help for options)")
+	fmt.Println("  queue              Manage scheduled messages and messages waiting for a retry")
+	fmt.Println("                     (gomail queue list|retry|reschedule|cancel|purge)")
+	fmt.Println("  dkim               Create a DKIM signing key and print its DNS record")
+	fmt.Println("                     (gomail dkim keygen|record)")
 	fmt.Println("  version, -v        Show version")
 	fmt.Println("  help, -h, --help   Show this help")
 	fmt.Println()
 	fmt.Println("Configuration:")
-	fmt.Println("  Create a .env file with:")
+	fmt.Println("  Create a .env file (or /etc/gomail.env for sendmail use) with:")
 	fmt.Println("    EMAIL_FROM=your-email@gmail.com")
 	fmt.Println("    EMAIL_PASSWORD=your-app-password")
 	fmt.Println("    PORT=8080")
 	fmt.Println()
+	fmt.Println("  Optional SMTP server settings (default: Gmail):")
+	fmt.Println("    SMTP_HOST=smtp.gmail.com")
+	fmt.Println("    SMTP_PORT=587")
+	fmt.Println("    SMTP_TLS=starttls   (starttls, implicit or none)")
+	fmt.Println("    SMTP_AUTH=auto      (auto, plain, login, cram-md5 or xoauth2)")
+	fmt.Println("    SMTP_OAUTH_TOKEN=   (OAuth2 access token for xoauth2)")
+	fmt.Println("    SMTP_OAUTH_TOKEN_CMD= (command printing a fresh token)")
+	fmt.Println("    SMTP_POOL_SIZE=2    (connections kept open, 0 to disable)")
+	fmt.Println("    SMTP_IDLE_TIMEOUT=30s")
+	fmt.Println("    SMTP_TIMEOUT=30s    (connect, TLS handshake and login)")
+	fmt.Println("    SMTP_COMMAND_TIMEOUT=60s")
+	fmt.Println()
+	fmt.Println("  Optional delivery transport (default: smtp):")
+	fmt.Println("    MAIL_TRANSPORT=smtp (smtp, sendmail, file or memory)")
+	fmt.Println("    SENDMAIL_PATH=/usr/sbin/sendmail")
+	fmt.Println("    MAIL_DROP_DIR=maildrop")
+	fmt.Println()
+	fmt.Println("  Optional rate limits (default: unlimited):")
+	fmt.Println("    RATE_PER_SECOND=0")
+	fmt.Println("    RATE_PER_MINUTE=0")
+	fmt.Println("    RATE_PER_DAY=0")
+	fmt.Println("    MAX_CONCURRENT_SENDS=0")
+	fmt.Println("    RATE_LIMIT_MODE=wait (wait or fail)")
+	fmt.Println()
+	fmt.Println("  Optional DKIM signing (enabled by DKIM_KEY_PATH):")
+	fmt.Println("    DKIM_DOMAIN=        (default: domain of EMAIL_FROM)")
+	fmt.Println("    DKIM_SELECTOR=gomail")
+	fmt.Println("    DKIM_KEY_PATH=dkim.pem")
+	fmt.Println()
+	fmt.Println("  Optional PGP/MIME signing and encryption (RSA keys):")
+	fmt.Println("    PGP_KEYRING=keyring.asc")
+	fmt.Println("    PGP_PASSPHRASE=")
+	fmt.Println()
+	fmt.Println("  Optional S/MIME signing (RSA or ECDSA certificate):")
+	fmt.Println("    SMIME_CERT=smime.crt")
+	fmt.Println("    SMIME_KEY=smime.key")
+	fmt.Println()
+	fmt.Println("  Optional SMTP relay for other programs (started with gomail when set):")
+	fmt.Println("    RELAY_ADDR=:2525")
+	fmt.Println("    RELAY_USERS=        (user:password,... to require AUTH)")
+	fmt.Println("    RELAY_NETWORKS=127.0.0.0/8,::1")
+	fmt.Println("    RELAY_TLS_CERT=     (enables STARTTLS)")
+	fmt.Println("    RELAY_TLS_KEY=")
+	fmt.Println("    RELAY_MAX_SIZE_MB=25")
+	fmt.Println()
+	fmt.Println("  Mail catcher (gomail catcher):")
+	fmt.Println("    CATCHER_ADDR=localhost:1025")
+	fmt.Println("    CATCHER_DIR=        (keep captured mail on disk; default: memory only)")
+	fmt.Println()
+	fmt.Println("  Persistent state (outbox of messages awaiting retry):")
+	fmt.Println("    DATA_DIR=data")
+	fmt.Println()
 	fmt.Println("Documentation: https://github.com/pranavKharche24/mail")
 	fmt.Println()
 }
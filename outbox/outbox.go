@@ -0,0 +1,394 @@
+// Package outbox keeps messages that could not be delivered, or that are
+// scheduled for later, on disk and sends them until they are delivered or
+// fail permanently.
+//
+// Every message is stored as its own .eml file next to a JSON index holding
+// the envelope and retry state. Several processes may share an outbox: the
+// index is only changed while holding an exclusive lock on index.lock.
+//
+//	<dir>/index.json
+//	<dir>/index.lock
+//	<dir>/queue/<id>.eml
+//	<dir>/dead/<id>.eml
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+// Entry states. Scheduled messages become pending once their first
+// delivery attempt fails.
+const (
+	StatusScheduled = "scheduled"
+	StatusPending   = "pending"
+	StatusDead      = "dead"
+)
+
+// Entry is a queued message and its delivery state
+type Entry struct {
+	ID          string    `json:"id"`
+	MessageID   string    `json:"message_id,omitempty"`
+	From        string    `json:"from"`
+	To          []string  `json:"to"`
+	Subject     string    `json:"subject,omitempty"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	Created     time.Time `json:"created"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Outbox is a durable on-disk message queue. It implements mailer.Spooler.
+type Outbox struct {
+	dir string
+	mu  sync.Mutex
+	// wake interrupts the worker's sleep when the schedule changes
+	wake chan struct{}
+
+	// MaxAttempts is the number of failed deliveries after which a message
+	// is moved to the dead-letter folder
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry; it doubles with every
+	// further attempt up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// Open opens the outbox in dir, creating the directory layout if needed
+func Open(dir string) (*Outbox, error) {
+	for _, sub := range []string{"queue", "dead"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, fmt.Errorf("error creating outbox: %v", err)
+		}
+	}
+	return &Outbox{
+		dir:         dir,
+		wake:        make(chan struct{}, 1),
+		MaxAttempts: 10,
+		BaseDelay:   time.Minute,
+		MaxDelay:    4 * time.Hour,
+	}, nil
+}
+
+// CheckWritable returns an error if messages cannot be queued in the
+// outbox, for example because it belongs to another user
+func (o *Outbox) CheckWritable() error {
+	unlock, err := o.lock()
+	if err != nil {
+		return err
+	}
+	unlock()
+	f, err := os.CreateTemp(filepath.Join(o.dir, "queue"), "check-*")
+	if err != nil {
+		return fmt.Errorf("outbox is not writable: %v", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Dir returns the outbox directory
+func (o *Outbox) Dir() string {
+	return o.dir
+}
+
+// Enqueue stores msg for delivery on the next worker pass, or at
+// env.SendAt for scheduled messages
+func (o *Outbox) Enqueue(env mailer.Envelope, msg io.Reader) error {
+	_, err := o.Add(env, msg)
+	return err
+}
+
+// Add is Enqueue returning the queue ID of the stored message
+func (o *Outbox) Add(env mailer.Envelope, msg io.Reader) (string, error) {
+	id := newID()
+	path := o.messagePath(id, StatusPending)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("error creating queue file: %v", err)
+	}
+	if _, err := io.Copy(file, msg); err != nil {
+		file.Close()
+		os.Remove(path)
+		return "", fmt.Errorf("error writing queue file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("error writing queue file: %v", err)
+	}
+
+	now := time.Now()
+	entry := Entry{
+		ID:          id,
+		MessageID:   env.MessageID,
+		From:        env.From,
+		To:          env.To,
+		Subject:     env.Subject,
+		Status:      StatusPending,
+		Created:     now,
+		NextAttempt: now,
+		LastError:   env.LastError,
+	}
+	switch {
+	case !env.SendAt.IsZero():
+		entry.Status = StatusScheduled
+		entry.NextAttempt = env.SendAt
+	case env.LastError != "":
+		entry.Attempts = 1
+		entry.NextAttempt = now.Add(o.backoff(1))
+	}
+
+	err = o.update(func(entries map[string]*Entry) error {
+		entries[id] = &entry
+		return nil
+	})
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return id, nil
+}
+
+// List returns all queued and dead entries ordered by creation time
+func (o *Outbox) List() ([]Entry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entries, err := o.load()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+// Retry makes an entry due immediately, moving it back out of the
+// dead-letter folder if necessary. An empty id retries every entry. When
+// a message cannot be restored, nothing is changed.
+func (o *Outbox) Retry(id string) error {
+	return o.update(func(entries map[string]*Entry) error {
+		var matched []*Entry
+		for _, e := range entries {
+			if id == "" || e.ID == id {
+				matched = append(matched, e)
+			}
+		}
+		if id != "" && len(matched) == 0 {
+			return fmt.Errorf("no queued message with id %s", id)
+		}
+
+		var restored []*Entry
+		for _, e := range matched {
+			if e.Status != StatusDead {
+				continue
+			}
+			if err := os.Rename(o.messagePath(e.ID, StatusDead), o.messagePath(e.ID, StatusPending)); err != nil {
+				// Put back the files already moved, as the index is not saved
+				for _, r := range restored {
+					os.Rename(o.messagePath(r.ID, StatusPending), o.messagePath(r.ID, StatusDead))
+				}
+				return fmt.Errorf("error restoring %s: %v", e.ID, err)
+			}
+			restored = append(restored, e)
+		}
+
+		now := time.Now()
+		for _, e := range matched {
+			if e.Status == StatusDead {
+				e.Status = StatusPending
+				e.Attempts = 0
+			}
+			e.NextAttempt = now
+		}
+		return nil
+	})
+}
+
+// Reschedule changes when a scheduled or pending message is next sent
+func (o *Outbox) Reschedule(id string, at time.Time) error {
+	return o.update(func(entries map[string]*Entry) error {
+		e, ok := entries[id]
+		if !ok {
+			return fmt.Errorf("no queued message with id %s", id)
+		}
+		if e.Status == StatusDead {
+			return fmt.Errorf("message %s is in the dead-letter folder; use retry", id)
+		}
+		e.NextAttempt = at
+		return nil
+	})
+}
+
+// Purge deletes entries. An id removes that entry; otherwise status selects
+// which entries to remove (one of the Status constants, or "" for all).
+// Entries whose file cannot be removed are kept, so the index always
+// matches the files on disk, and the first such error is returned.
+func (o *Outbox) Purge(id, status string) (int, error) {
+	removed := 0
+	var removeErr error
+	err := o.update(func(entries map[string]*Entry) error {
+		matched := false
+		for key, e := range entries {
+			if id != "" && e.ID != id {
+				continue
+			}
+			if id == "" && status != "" && e.Status != status {
+				continue
+			}
+			matched = true
+			if err := os.Remove(o.messagePath(e.ID, e.Status)); err != nil && !os.IsNotExist(err) {
+				if removeErr == nil {
+					removeErr = fmt.Errorf("error removing %s: %v", e.ID, err)
+				}
+				continue
+			}
+			delete(entries, key)
+			removed++
+		}
+		if id != "" && !matched {
+			return fmt.Errorf("no queued message with id %s", id)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, removeErr
+}
+
+// messagePath returns the file holding an entry's message
+func (o *Outbox) messagePath(id, status string) string {
+	folder := "queue"
+	if status == StatusDead {
+		folder = "dead"
+	}
+	return filepath.Join(o.dir, folder, id+".eml")
+}
+
+// update loads the index, applies fn and writes the index back unless fn
+// fails, in which case the index is left as it was. It holds an exclusive
+// lock on the outbox for the whole read-modify-write, so changes made by
+// other processes sharing the outbox, such as queue commands or sendmail,
+// are neither missed nor overwritten.
+func (o *Outbox) update(fn func(map[string]*Entry) error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	unlock, err := o.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := o.load()
+	if err != nil {
+		return err
+	}
+	if err := fn(entries); err != nil {
+		return err
+	}
+	if err := o.save(entries); err != nil {
+		return err
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// lock takes the exclusive lock that guards the index across processes and
+// returns the function that releases it
+func (o *Outbox) lock() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(o.dir, "index.lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error locking outbox: %v", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error locking outbox: %v", err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+func (o *Outbox) load() (map[string]*Entry, error) {
+	entries := make(map[string]*Entry)
+	data, err := os.ReadFile(filepath.Join(o.dir, "index.json"))
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading outbox index: %v", err)
+	}
+
+	var list []*Entry
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error parsing outbox index: %v", err)
+	}
+	for _, e := range list {
+		entries[e.ID] = e
+	}
+	return entries, nil
+}
+
+// save writes the index atomically so a crash never leaves it half written
+func (o *Outbox) save(entries map[string]*Entry) error {
+	list := make([]*Entry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	// A unique temporary file, so concurrent writers never share one
+	tmp, err := os.CreateTemp(o.dir, "index-*.json.tmp")
+	if err != nil {
+		return fmt.Errorf("error writing outbox index: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing outbox index: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing outbox index: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(o.dir, "index.json")); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing outbox index: %v", err)
+	}
+	return nil
+}
+
+// newID returns a sortable unique id for a queued message
+func newID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b)
+}
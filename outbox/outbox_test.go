@@ -0,0 +1,161 @@
+package outbox
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+// TestSharedOutbox enqueues from several Outbox values on one directory,
+// as separate processes would, and checks that no index update is lost
+func TestSharedOutbox(t *testing.T) {
+	dir := t.TempDir()
+	const writers, perWriter = 4, 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*perWriter)
+	for i := 0; i < writers; i++ {
+		ob, err := Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				env := mailer.Envelope{From: "a@example.com", To: []string{"b@example.com"}}
+				errs <- ob.Enqueue(env, strings.NewReader("Subject: x\r\n\r\nx\r\n"))
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ob, _ := Open(dir)
+	list, err := ob.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != writers*perWriter {
+		t.Errorf("index holds %d entries, want %d", len(list), writers*perWriter)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "index-*"))
+	if len(files) != 0 {
+		t.Errorf("temporary index files left behind: %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.json.tmp")); !os.IsNotExist(err) {
+		t.Errorf("fixed temporary file used")
+	}
+}
+
+// testOutbox opens an outbox in a temporary directory
+func testOutbox(t *testing.T) *Outbox {
+	t.Helper()
+	ob, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ob
+}
+
+// add queues a small message and returns its ID
+func add(t *testing.T, ob *Outbox, env mailer.Envelope) string {
+	t.Helper()
+	if env.From == "" {
+		env.From = "sender@example.com"
+	}
+	if len(env.To) == 0 {
+		env.To = []string{"bob@example.com"}
+	}
+	id, err := ob.Add(env, strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func entry(t *testing.T, ob *Outbox, id string) Entry {
+	t.Helper()
+	list, err := ob.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range list {
+		if e.ID == id {
+			return e
+		}
+	}
+	t.Fatalf("no entry %s", id)
+	return Entry{}
+}
+
+func TestFailedUpdateKeepsIndex(t *testing.T) {
+	ob := testOutbox(t)
+	id := add(t, ob, mailer.Envelope{})
+	before, _ := os.ReadFile(filepath.Join(ob.Dir(), "index.json"))
+
+	err := ob.update(func(entries map[string]*Entry) error {
+		entries[id].Attempts = 5
+		delete(entries, id)
+		return errors.New("failed halfway")
+	})
+	if err == nil {
+		t.Fatal("update returned no error")
+	}
+	if err := ob.Retry("no-such-id"); err == nil {
+		t.Error("Retry of a missing ID succeeded")
+	}
+	if err := ob.Reschedule("no-such-id", time.Now()); err == nil {
+		t.Error("Reschedule of a missing ID succeeded")
+	}
+	after, _ := os.ReadFile(filepath.Join(ob.Dir(), "index.json"))
+	if !bytes.Equal(before, after) {
+		t.Errorf("failed operations changed the index:\n%s\nwant\n%s", after, before)
+	}
+}
+
+func TestRetryRestoresAllOrNothing(t *testing.T) {
+	ob := testOutbox(t)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, add(t, ob, mailer.Envelope{}))
+	}
+	// Move every message to the dead-letter folder, then lose one file
+	err := ob.update(func(entries map[string]*Entry) error {
+		for _, e := range entries {
+			if err := os.Rename(ob.messagePath(e.ID, StatusPending), ob.messagePath(e.ID, StatusDead)); err != nil {
+				return err
+			}
+			e.Status = StatusDead
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(ob.messagePath(ids[1], StatusDead))
+
+	if err := ob.Retry(""); err == nil {
+		t.Fatal("Retry succeeded with a missing file")
+	}
+	for _, id := range []string{ids[0], ids[2]} {
+		if e := entry(t, ob, id); e.Status != StatusDead {
+			t.Errorf("%s is %s, want dead", id, e.Status)
+		}
+		if _, err := os.Stat(ob.messagePath(id, StatusDead)); err != nil {
+			t.Errorf("%s was not put back: %v", id, err)
+		}
+	}
+}
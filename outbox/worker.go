@@ -0,0 +1,230 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+const (
+	// pollInterval bounds how long the worker sleeps, so messages queued
+	// by other processes are picked up promptly
+	pollInterval = 30 * time.Second
+	// staleClaim is how long a message may stay claimed by a sender before
+	// it is assumed that the process delivering it died
+	staleClaim = 30 * time.Minute
+)
+
+// Run delivers due messages through t until ctx is cancelled
+func (o *Outbox) Run(ctx context.Context, t mailer.Transport) {
+	for {
+		delivered, failed, err := o.ProcessDue(ctx, t)
+		if err != nil {
+			log.Printf("Outbox error: %v", err)
+		}
+		if delivered > 0 || failed > 0 {
+			log.Printf("Outbox: %d delivered, %d failed", delivered, failed)
+		}
+
+		wait := pollInterval
+		if next, ok := o.nextDue(); ok {
+			if d := time.Until(next); d < wait {
+				wait = d
+			}
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-o.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// ProcessDue makes one delivery attempt for every pending message that is
+// due and returns how many were delivered and how many failed
+func (o *Outbox) ProcessDue(ctx context.Context, t mailer.Transport) (int, int, error) {
+	list, err := o.List()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	delivered, failed := 0, 0
+	now := time.Now()
+	for _, e := range list {
+		if ctx.Err() != nil {
+			break
+		}
+		if !e.waiting() || e.NextAttempt.After(now) {
+			continue
+		}
+		result, err := o.deliver(ctx, t, e)
+		if err != nil {
+			return delivered, failed, err
+		}
+		switch result {
+		case resultDelivered:
+			delivered++
+		case resultFailed:
+			failed++
+		case resultDeferred:
+			// Rate limited: leave the rest for the next pass
+			return delivered, failed, nil
+		}
+	}
+	return delivered, failed, nil
+}
+
+// Outcomes of a single delivery attempt
+const (
+	resultSkipped = iota
+	resultDelivered
+	resultFailed
+	resultDeferred
+)
+
+// deliver attempts one entry and records the outcome in the index
+func (o *Outbox) deliver(ctx context.Context, t mailer.Transport, e Entry) (int, error) {
+	claimed, err := o.claim(e.ID)
+	if err != nil || claimed == "" {
+		return resultSkipped, err
+	}
+
+	file, err := os.Open(claimed)
+	if err != nil {
+		return resultSkipped, fmt.Errorf("error opening %s: %v", e.ID, err)
+	}
+	sendErr := t.Send(ctx, e.From, e.To, file)
+	file.Close()
+
+	if sendErr == nil {
+		os.Remove(claimed)
+		return resultDelivered, o.update(func(entries map[string]*Entry) error {
+			delete(entries, e.ID)
+			return nil
+		})
+	}
+
+	var rlErr *mailer.RateLimitError
+	if errors.As(sendErr, &rlErr) {
+		// Not the message's fault, so it does not count as an attempt
+		return resultDeferred, o.update(func(entries map[string]*Entry) error {
+			entry, ok := entries[e.ID]
+			if !ok {
+				os.Remove(claimed)
+				return nil
+			}
+			entry.NextAttempt = time.Now().Add(rlErr.RetryAfter + time.Second)
+			return o.unclaim(claimed, e.ID)
+		})
+	}
+
+	return resultFailed, o.update(func(entries map[string]*Entry) error {
+		entry, ok := entries[e.ID]
+		if !ok {
+			// Purged while the delivery was in progress
+			os.Remove(claimed)
+			return nil
+		}
+		entry.Attempts++
+		entry.LastError = sendErr.Error()
+		entry.Status = StatusPending
+
+		if !mailer.IsTemporary(sendErr) || entry.Attempts >= o.MaxAttempts {
+			entry.Status = StatusDead
+			if err := os.Rename(claimed, o.messagePath(e.ID, StatusDead)); err != nil {
+				return fmt.Errorf("error moving %s to dead letters: %v", e.ID, err)
+			}
+			return nil
+		}
+		entry.NextAttempt = time.Now().Add(o.backoff(entry.Attempts))
+		return o.unclaim(claimed, e.ID)
+	})
+}
+
+// unclaim returns a claimed message to the queue
+func (o *Outbox) unclaim(claimed, id string) error {
+	if err := os.Rename(claimed, o.messagePath(id, StatusPending)); err != nil {
+		return fmt.Errorf("error requeueing %s: %v", id, err)
+	}
+	return nil
+}
+
+// claim marks a message as being delivered by renaming its file, so two
+// processes sharing the outbox never send the same message. It returns the
+// claimed path, or "" when another sender holds the message.
+func (o *Outbox) claim(id string) (string, error) {
+	path := o.messagePath(id, StatusPending)
+	claimed := path + ".sending"
+
+	err := os.Rename(path, claimed)
+	if err == nil {
+		return claimed, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("error claiming %s: %v", id, err)
+	}
+
+	info, statErr := os.Stat(claimed)
+	if statErr != nil {
+		return "", o.update(func(entries map[string]*Entry) error {
+			if entry, ok := entries[id]; ok && entry.waiting() {
+				entry.Status = StatusDead
+				entry.LastError = "message file is missing"
+			}
+			return nil
+		})
+	}
+	if time.Since(info.ModTime()) < staleClaim {
+		return "", nil
+	}
+	now := time.Now()
+	if err := os.Chtimes(claimed, now, now); err != nil {
+		return "", fmt.Errorf("error claiming %s: %v", id, err)
+	}
+	return claimed, nil
+}
+
+// backoff returns the wait after the given number of failed attempts
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.BaseDelay
+	for i := 1; i < attempts && delay < o.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > o.MaxDelay {
+		delay = o.MaxDelay
+	}
+	return delay
+}
+
+// nextDue returns the earliest retry time of the pending messages
+func (o *Outbox) nextDue() (time.Time, bool) {
+	list, err := o.List()
+	if err != nil {
+		return time.Time{}, false
+	}
+	var next time.Time
+	for _, e := range list {
+		if e.waiting() && (next.IsZero() || e.NextAttempt.Before(next)) {
+			next = e.NextAttempt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// waiting reports whether the entry still awaits a delivery attempt
+func (e Entry) waiting() bool {
+	return e.Status == StatusPending || e.Status == StatusScheduled
+}
@@ -0,0 +1,354 @@
+package outbox
+
+import (
+	"context"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pranavKharche24/mail/mailer"
+	"github.com/pranavKharche24/mail/mailtest"
+)
+
+// deliverVia returns the transport the outbox worker uses for srv
+func deliverVia(srv *mailtest.Server) mailer.Transport {
+	return mailer.TransportFunc(srv.Mailer().Deliver)
+}
+
+func processDue(t *testing.T, ob *Outbox, tr mailer.Transport) (int, int) {
+	t.Helper()
+	delivered, failed, err := ob.ProcessDue(context.Background(), tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return delivered, failed
+}
+
+func TestBackoff(t *testing.T) {
+	ob := &Outbox{BaseDelay: time.Minute, MaxDelay: time.Hour}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour},
+		{50, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := ob.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestTemporaryFailureIsRetried(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	ob := testOutbox(t)
+	id := add(t, ob, mailer.Envelope{})
+
+	srv.Fail(mailtest.Failure{Command: "RCPT", Code: 451, Message: "4.3.0 Try again later", Times: 2})
+	for attempt := 1; attempt <= 2; attempt++ {
+		before := time.Now()
+		if delivered, failed := processDue(t, ob, deliverVia(srv)); delivered != 0 || failed != 1 {
+			t.Fatalf("attempt %d: %d delivered, %d failed", attempt, delivered, failed)
+		}
+		e := entry(t, ob, id)
+		if e.Status != StatusPending || e.Attempts != attempt {
+			t.Fatalf("attempt %d: entry is %s after %d attempts", attempt, e.Status, e.Attempts)
+		}
+		// The wait doubles with every failed attempt
+		wait := ob.backoff(attempt)
+		if e.NextAttempt.Before(before.Add(wait)) || e.NextAttempt.After(time.Now().Add(wait)) {
+			t.Errorf("attempt %d: next attempt at %v, want %v from now", attempt, e.NextAttempt, wait)
+		}
+		if !containsAll(e.LastError, "451", "Try again later") {
+			t.Errorf("last error %q", e.LastError)
+		}
+
+		// Not due yet, so nothing is sent
+		if delivered, failed := processDue(t, ob, deliverVia(srv)); delivered+failed != 0 {
+			t.Fatalf("message retried before its next attempt")
+		}
+		if err := ob.Retry(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if delivered, _ := processDue(t, ob, deliverVia(srv)); delivered != 1 {
+		t.Fatalf("%d delivered after the failures cleared, want 1", delivered)
+	}
+	srv.AssertCount(t, 1)
+	if list, _ := ob.List(); len(list) != 0 {
+		t.Errorf("delivered message left in the index: %+v", list)
+	}
+	if _, err := os.Stat(ob.messagePath(id, StatusPending)); !os.IsNotExist(err) {
+		t.Errorf("delivered message file left behind")
+	}
+}
+
+func TestPermanentFailureIsDeadLettered(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	ob := testOutbox(t)
+	id := add(t, ob, mailer.Envelope{})
+
+	srv.Fail(mailtest.Failure{Command: "EOM", Code: 554, Message: "5.7.1 Rejected"})
+	if _, failed := processDue(t, ob, deliverVia(srv)); failed != 1 {
+		t.Fatalf("%d failed, want 1", failed)
+	}
+	e := entry(t, ob, id)
+	if e.Status != StatusDead || e.Attempts != 1 || !containsAll(e.LastError, "554") {
+		t.Errorf("entry after a 554: %+v", e)
+	}
+	if _, err := os.Stat(ob.messagePath(id, StatusDead)); err != nil {
+		t.Errorf("message not in the dead-letter folder: %v", err)
+	}
+
+	// Dead messages are not retried until asked to
+	srv.Reset()
+	processDue(t, ob, deliverVia(srv))
+	srv.AssertCount(t, 0)
+	if err := ob.Retry(id); err != nil {
+		t.Fatal(err)
+	}
+	if e := entry(t, ob, id); e.Status != StatusPending || e.Attempts != 0 {
+		t.Errorf("entry after Retry: %+v", e)
+	}
+	if delivered, _ := processDue(t, ob, deliverVia(srv)); delivered != 1 {
+		t.Errorf("retried message was not delivered")
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	ob := testOutbox(t)
+	ob.MaxAttempts = 3
+	id := add(t, ob, mailer.Envelope{})
+
+	srv.Fail(mailtest.Failure{Command: "MAIL", Code: 421, Message: "4.7.0 Too many connections"})
+	for i := 0; i < 3; i++ {
+		if err := ob.Retry(id); err != nil {
+			t.Fatal(err)
+		}
+		processDue(t, ob, deliverVia(srv))
+	}
+	if e := entry(t, ob, id); e.Status != StatusDead || e.Attempts != 3 {
+		t.Errorf("entry after 3 temporary failures: %+v", e)
+	}
+}
+
+func TestConcurrentWorkersDeliverOnce(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	// Slow deliveries make the workers overlap
+	srv.Delay("EOM", 20*time.Millisecond)
+
+	dir := t.TempDir()
+	first, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 10
+	for i := 0; i < n; i++ {
+		add(t, first, mailer.Envelope{})
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	total := 0
+	for i := 0; i < 3; i++ {
+		ob, err := Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			delivered, _, err := ob.ProcessDue(context.Background(), deliverVia(srv))
+			if err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			total += delivered
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if total != n {
+		t.Errorf("workers report %d deliveries, want %d", total, n)
+	}
+	srv.AssertCount(t, n)
+}
+
+func TestClaim(t *testing.T) {
+	ob := testOutbox(t)
+	id := add(t, ob, mailer.Envelope{})
+
+	claimed, err := ob.claim(id)
+	if err != nil || claimed == "" {
+		t.Fatalf("claim: %q, %v", claimed, err)
+	}
+	// A second sender must leave a fresh claim alone
+	other, err := Open(ob.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := other.claim(id); err != nil || again != "" {
+		t.Errorf("claimed twice: %q, %v", again, err)
+	}
+
+	// A claim older than staleClaim was left by a sender that died
+	old := time.Now().Add(-staleClaim - time.Minute)
+	if err := os.Chtimes(claimed, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := other.claim(id); err != nil || again != claimed {
+		t.Errorf("stale claim not taken over: %q, %v", again, err)
+	}
+}
+
+func TestStaleClaimIsDelivered(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	ob := testOutbox(t)
+	id := add(t, ob, mailer.Envelope{})
+
+	// A sender claimed the message and crashed
+	claimed, err := ob.claim(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processDue(t, ob, deliverVia(srv))
+	srv.AssertCount(t, 0)
+
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(claimed, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if delivered, _ := processDue(t, ob, deliverVia(srv)); delivered != 1 {
+		t.Fatalf("stale claim was not delivered")
+	}
+	srv.AssertCount(t, 1)
+	if _, err := os.Stat(claimed); !os.IsNotExist(err) {
+		t.Errorf("claimed file left behind")
+	}
+}
+
+func TestMissingFileIsDeadLettered(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	ob := testOutbox(t)
+	id := add(t, ob, mailer.Envelope{})
+	os.Remove(ob.messagePath(id, StatusPending))
+
+	processDue(t, ob, deliverVia(srv))
+	if e := entry(t, ob, id); e.Status != StatusDead || e.LastError != "message file is missing" {
+		t.Errorf("entry without a file: %+v", e)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	ob := testOutbox(t)
+	pending := add(t, ob, mailer.Envelope{})
+	dead := add(t, ob, mailer.Envelope{})
+	other := add(t, ob, mailer.Envelope{})
+	err := ob.update(func(entries map[string]*Entry) error {
+		entries[dead].Status = StatusDead
+		return os.Rename(ob.messagePath(dead, StatusPending), ob.messagePath(dead, StatusDead))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ob.Purge("no-such-id", ""); err == nil {
+		t.Error("Purge of a missing ID succeeded")
+	}
+	if n, err := ob.Purge("", StatusDead); err != nil || n != 1 {
+		t.Errorf("Purge of dead messages removed %d (%v), want 1", n, err)
+	}
+	if _, err := os.Stat(ob.messagePath(dead, StatusDead)); !os.IsNotExist(err) {
+		t.Errorf("dead message file left behind")
+	}
+	if n, err := ob.Purge(pending, ""); err != nil || n != 1 {
+		t.Errorf("Purge(%s) removed %d (%v), want 1", pending, n, err)
+	}
+	list, _ := ob.List()
+	if len(list) != 1 || list[0].ID != other {
+		t.Errorf("index after purging: %+v", list)
+	}
+	if n, err := ob.Purge("", ""); err != nil || n != 1 {
+		t.Errorf("Purge of everything removed %d (%v), want 1", n, err)
+	}
+}
+
+func TestScheduledNotSentEarly(t *testing.T) {
+	srv := mailtest.NewServer()
+	defer srv.Close()
+	ob := testOutbox(t)
+	m := srv.Mailer()
+	m.SetSpooler(ob)
+
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	msg := &mailer.Message{To: []string{"bob@example.com"}, Subject: "Later", Text: "x"}
+	if _, err := m.Schedule(msg, at); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := ob.List()
+	if len(list) != 1 || list[0].Status != StatusScheduled || !list[0].NextAttempt.Equal(at) {
+		t.Fatalf("index after scheduling: %+v", list)
+	}
+	id := list[0].ID
+
+	if delivered, failed := processDue(t, ob, deliverVia(srv)); delivered+failed != 0 {
+		t.Fatalf("scheduled message sent an hour early")
+	}
+	srv.AssertCount(t, 0)
+	if next, ok := ob.nextDue(); !ok || !next.Equal(at) {
+		t.Errorf("worker wakes at %v, want %v", next, at)
+	}
+
+	// Moving the time forward makes it due
+	if err := ob.Reschedule(id, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if delivered, _ := processDue(t, ob, deliverVia(srv)); delivered != 1 {
+		t.Fatalf("rescheduled message was not sent")
+	}
+	sent := srv.LastMessage(t)
+	if date, err := mail.ParseDate(sent.Header("Date")); err != nil || !date.Equal(at) {
+		t.Errorf("Date header %v (%v), want the scheduled time %v", date, err, at)
+	}
+}
+
+func TestRescheduleDead(t *testing.T) {
+	ob := testOutbox(t)
+	id := add(t, ob, mailer.Envelope{})
+	err := ob.update(func(entries map[string]*Entry) error {
+		entries[id].Status = StatusDead
+		return os.Rename(ob.messagePath(id, StatusPending), ob.messagePath(id, StatusDead))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.Reschedule(id, time.Now().Add(time.Hour)); err == nil {
+		t.Error("Reschedule of a dead message succeeded")
+	}
+}
+
+func containsAll(s string, substrs ...string) bool {
+	for _, sub := range substrs {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+// Queue stores a message for delivery and returns its queue ID.
+// *outbox.Outbox implements it.
+type Queue interface {
+	Add(env mailer.Envelope, msg io.Reader) (string, error)
+}
+
+// RelayHandler returns a Handler that prepares accepted messages with m
+// and hands them to q, whose worker sends them on. Delivery happens after
+// the client got its reply, so a slow upstream server or a rate limit can
+// never make the client time out and submit the message again. Every
+// message is sent with the configured sender as envelope sender, whatever
+// the client gave as MAIL FROM.
+func RelayHandler(m *mailer.Mailer, q Queue) Handler {
+	return func(env Envelope, data []byte) error {
+		msg, err := mailer.ReadRawMessage(bytes.NewReader(data))
+		if err != nil {
+			return &Error{Code: 554, Message: "5.6.0 " + err.Error()}
+		}
+		queued, err := m.PrepareRaw("", env.To, msg)
+		if err != nil {
+			return &Error{Code: 554, Message: "5.0.0 " + err.Error()}
+		}
+
+		var buf bytes.Buffer
+		if _, err := msg.WriteTo(&buf); err != nil {
+			return err
+		}
+		id, err := q.Add(queued, &buf)
+		if err != nil {
+			log.Printf("Relay error for message from %s: %v", client(env), err)
+			return &Error{Code: 451, Message: "4.3.0 Cannot queue message, try again later"}
+		}
+		log.Printf("Queued %s from %s to %s", id, client(env), strings.Join(queued.To, ", "))
+		return &Error{Code: 250, Message: "2.0.0 OK: queued as " + id}
+	}
+}
+
+// client describes the sender of a message for the log
+func client(env Envelope) string {
+	host, _, _ := net.SplitHostPort(env.RemoteAddr.String())
+	if env.User != "" {
+		return env.User + "@" + host
+	}
+	return host
+}
+
+// Users maps usernames to passwords for AUTH
+type Users map[string]string
+
+// ParseUsers parses a comma-separated list of user:password pairs
+func ParseUsers(s string) (Users, error) {
+	users := make(Users)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, password, ok := strings.Cut(pair, ":")
+		if !ok || name == "" || password == "" {
+			return nil, fmt.Errorf("invalid user %q (want name:password)", pair)
+		}
+		users[name] = password
+	}
+	return users, nil
+}
+
+// Check reports whether password is correct for username. It can be used
+// as Server.Auth.
+func (u Users) Check(username, password string) bool {
+	want, ok := u[username]
+	if !ok {
+		// Compare anyway so unknown users take as long as wrong passwords
+		want = "\x00"
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1 && ok
+}
+
+// ParseNetworks parses a comma-separated list of networks in CIDR notation
+// or single IP addresses
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", item)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,99 @@
+package smtpd
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/pranavKharche24/mail/mailer"
+)
+
+// memoryQueue records queued messages
+type memoryQueue struct {
+	envelopes []mailer.Envelope
+	messages  [][]byte
+}
+
+func (q *memoryQueue) Add(env mailer.Envelope, msg io.Reader) (string, error) {
+	data, err := io.ReadAll(msg)
+	if err != nil {
+		return "", err
+	}
+	q.envelopes = append(q.envelopes, env)
+	q.messages = append(q.messages, data)
+	return "20260101-000000-abcd", nil
+}
+
+// dial connects to a server listening on the loopback interface
+func dial(t *testing.T, srv *Server) *textproto.Conn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	c, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	expect(t, c, 220)
+	return c
+}
+
+func command(t *testing.T, c *textproto.Conn, code int, format string, args ...interface{}) string {
+	t.Helper()
+	if err := c.PrintfLine(format, args...); err != nil {
+		t.Fatal(err)
+	}
+	return expect(t, c, code)
+}
+
+func expect(t *testing.T, c *textproto.Conn, code int) string {
+	t.Helper()
+	got, msg, err := c.ReadResponse(0)
+	if got != code {
+		t.Fatalf("got %d %s (%v), want %d", got, msg, err, code)
+	}
+	return msg
+}
+
+func TestRelayQueuesWithConfiguredSender(t *testing.T) {
+	m := mailer.New()
+	m.SetCredentials("sender@example.com", "secret")
+	q := &memoryQueue{}
+	c := dial(t, &Server{Handler: RelayHandler(m, q)})
+
+	command(t, c, 250, "EHLO client.example")
+	command(t, c, 250, "MAIL FROM:<ceo@other.example>")
+	command(t, c, 250, "RCPT TO:<bob@example.com>")
+	command(t, c, 354, "DATA")
+	reply := command(t, c, 250, "Subject: Hi\r\nBcc: hidden@example.com\r\n\r\nHello\r\n.")
+	if !strings.Contains(reply, "queued as 20260101-000000-abcd") {
+		t.Errorf("reply %q does not name the queue ID", reply)
+	}
+
+	if len(q.envelopes) != 1 {
+		t.Fatalf("%d messages queued, want 1", len(q.envelopes))
+	}
+	env := q.envelopes[0]
+	if env.From != "sender@example.com" {
+		t.Errorf("envelope sender %q, want the configured sender", env.From)
+	}
+	if len(env.To) != 1 || env.To[0] != "bob@example.com" || env.Subject != "Hi" || env.MessageID == "" {
+		t.Errorf("envelope %+v", env)
+	}
+	msg := q.messages[0]
+	for _, want := range []string{"Received: from client.example", "From: sender@example.com", "Message-ID: " + env.MessageID, "Hello"} {
+		if !bytes.Contains(msg, []byte(want)) {
+			t.Errorf("queued message lacks %q:\n%s", want, msg)
+		}
+	}
+	if bytes.Contains(msg, []byte("hidden@")) {
+		t.Errorf("Bcc left in the queued message:\n%s", msg)
+	}
+}
@@ -0,0 +1,236 @@
+// Package smtpd is a small SMTP server (RFC 5321) for accepting mail from
+// programs on the local network. It supports EHLO, STARTTLS, AUTH PLAIN and
+// LOGIN, SIZE and 8BITMIME, and hands every accepted message to a Handler.
+package smtpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Envelope describes a message received by the server
+type Envelope struct {
+	RemoteAddr net.Addr
+	// Helo is the name the client gave in HELO or EHLO
+	Helo string
+	// User is the authenticated user, if any
+	User string
+	// TLS reports whether the message was received over TLS
+	TLS  bool
+	From string
+	To   []string
+}
+
+// Handler processes a received message. Returning an *Error sends its
+// reply to the client; any other error is reported as a permanent failure.
+type Handler func(env Envelope, data []byte) error
+
+// Error is an SMTP reply returned from a Handler. A 2xx code accepts the
+// message with that reply, for example to name the queue ID.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("smtpd: server closed")
+
+// Server is an SMTP server. The zero value accepts mail from anyone without
+// authentication, so callers normally set Networks or Auth.
+type Server struct {
+	// Addr is the TCP address to listen on, ":2525" if empty
+	Addr string
+	// Hostname is announced in the greeting and EHLO reply
+	Hostname string
+	Handler  Handler
+
+	// TLSConfig enables STARTTLS
+	TLSConfig *tls.Config
+	// Auth checks a username and password. When it is set, clients must
+	// authenticate before sending. AUTH is offered over TLS, and in the
+	// clear only to clients on the loopback interface, whether or not
+	// TLSConfig is set.
+	Auth func(username, password string) bool
+
+	// MaxSize limits the size of a message in bytes (default 25 MiB)
+	MaxSize int64
+	// MaxRecipients limits the recipients of a message (default 100)
+	MaxRecipients int
+	// Networks lists the client networks allowed to connect; empty allows
+	// every client
+	Networks []*net.IPNet
+	// Timeout limits how long a client may take for each command (default
+	// five minutes)
+	Timeout time.Duration
+
+	// ErrorLog receives connection errors; nil uses the log package
+	ErrorLog *log.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+// ListenAndServe listens on s.Addr and serves connections until Close is
+// called
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":2525"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.conns = make(map[net.Conn]bool)
+	s.mu.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+// Listener returns the listener passed to Serve, so callers listening on
+// port 0 can find out the address
+func (s *Server) Listener() net.Listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listener
+}
+
+// Close stops the listener and closes all open connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return err
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		c.Close()
+		return
+	}
+	s.conns[c] = true
+	s.mu.Unlock()
+
+	defer func() {
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+
+	conn := &timeoutConn{Conn: c, timeout: s.timeout()}
+	sess := &session{
+		server: s,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+	if !s.allowed(c.RemoteAddr()) {
+		sess.reply(554, "5.7.1 Access denied")
+		return
+	}
+	sess.serve()
+}
+
+// allowed reports whether a client may connect according to Networks
+func (s *Server) allowed(addr net.Addr) bool {
+	if len(s.Networks) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range s.Networks {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	return "localhost"
+}
+
+func (s *Server) maxSize() int64 {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return 25 << 20
+}
+
+func (s *Server) maxRecipients() int {
+	if s.MaxRecipients > 0 {
+		return s.MaxRecipients
+	}
+	return 100
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return 5 * time.Minute
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
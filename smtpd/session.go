@@ -0,0 +1,475 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLineLength bounds command lines; RFC 5321 allows 512 bytes, but AUTH
+// responses can be longer
+const maxLineLength = 4096
+
+// maxAuthFailures is the number of failed logins after which the client is
+// disconnected
+const maxAuthFailures = 3
+
+var errLineTooLong = errors.New("line too long")
+
+// session is the state of one client connection
+type session struct {
+	server *Server
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// failed is set once the connection is unusable
+	failed bool
+
+	tls          bool
+	helo         string
+	user         string
+	authFailures int
+
+	// the current mail transaction
+	hasFrom bool
+	from    string
+	to      []string
+}
+
+// timeoutConn refreshes the deadline before every read and write, so the
+// timeout applies to each step instead of the whole session
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+func (s *session) serve() {
+	s.reply(220, s.server.hostname()+" ESMTP gomail")
+	for !s.failed {
+		line, err := s.readLine()
+		if err == errLineTooLong {
+			s.reply(500, "5.5.2 Line too long")
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			s.handleHelo(arg, false)
+		case "EHLO":
+			s.handleHelo(arg, true)
+		case "STARTTLS":
+			s.handleStartTLS()
+		case "AUTH":
+			s.handleAuth(arg)
+		case "MAIL":
+			s.handleMail(arg)
+		case "RCPT":
+			s.handleRcpt(arg)
+		case "DATA":
+			s.handleData()
+		case "RSET":
+			s.reset()
+			s.reply(250, "2.0.0 OK")
+		case "NOOP":
+			s.reply(250, "2.0.0 OK")
+		case "VRFY":
+			s.reply(252, "2.5.0 Cannot verify user")
+		case "QUIT":
+			s.reply(221, "2.0.0 Bye")
+			return
+		default:
+			s.reply(502, "5.5.1 Command not implemented")
+		}
+	}
+}
+
+// readLine reads a command line without its line break
+func (s *session) readLine() (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := s.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineLength {
+			tooLong = true
+		} else {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// reply sends a possibly multi-line reply
+func (s *session) reply(code int, lines ...string) {
+	for i, line := range lines {
+		line = strings.NewReplacer("\r", " ", "\n", " ").Replace(line)
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(s.writer, "%d%s%s\r\n", code, sep, line)
+	}
+	if err := s.writer.Flush(); err != nil {
+		s.failed = true
+	}
+}
+
+// reset aborts the current mail transaction
+func (s *session) reset() {
+	s.hasFrom = false
+	s.from = ""
+	s.to = nil
+}
+
+// authOffered reports whether AUTH may be used on the connection as it is.
+// Passwords are only accepted over TLS, or in the clear from the local
+// machine.
+func (s *session) authOffered() bool {
+	return s.server.Auth != nil && (s.tls || isLoopback(s.conn.RemoteAddr()))
+}
+
+func isLoopback(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && tcp.IP.IsLoopback()
+}
+
+func (s *session) handleHelo(arg string, extended bool) {
+	if arg == "" {
+		s.reply(501, "5.5.4 Syntax: EHLO hostname")
+		return
+	}
+	s.reset()
+	s.helo = arg
+	if !extended {
+		s.reply(250, s.server.hostname())
+		return
+	}
+
+	lines := []string{
+		s.server.hostname() + " greets " + arg,
+		"PIPELINING",
+		"8BITMIME",
+		"ENHANCEDSTATUSCODES",
+		"SIZE " + strconv.FormatInt(s.server.maxSize(), 10),
+	}
+	if s.server.TLSConfig != nil && !s.tls {
+		lines = append(lines, "STARTTLS")
+	}
+	if s.authOffered() && s.user == "" {
+		lines = append(lines, "AUTH PLAIN LOGIN")
+	}
+	s.reply(250, lines...)
+}
+
+func (s *session) handleStartTLS() {
+	if s.server.TLSConfig == nil {
+		s.reply(502, "5.5.1 STARTTLS not supported")
+		return
+	}
+	if s.tls {
+		s.reply(503, "5.5.1 TLS already active")
+		return
+	}
+	s.reply(220, "2.0.0 Ready to start TLS")
+	if s.failed {
+		return
+	}
+
+	tlsConn := tls.Server(s.conn, s.server.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		s.server.logf("SMTP TLS handshake with %s failed: %v", s.conn.RemoteAddr(), err)
+		s.failed = true
+		return
+	}
+	// Anything the client sent before the handshake is discarded along
+	// with the old reader, and the session starts over (RFC 3207)
+	s.conn = tlsConn
+	s.reader = bufio.NewReader(tlsConn)
+	s.writer = bufio.NewWriter(tlsConn)
+	s.tls = true
+	s.helo = ""
+	s.reset()
+}
+
+func (s *session) handleAuth(arg string) {
+	switch {
+	case s.server.Auth == nil:
+		s.reply(502, "5.5.1 AUTH not supported")
+		return
+	case !s.authOffered() && s.server.TLSConfig == nil:
+		s.reply(538, "5.7.11 Encryption required, AUTH is only available to local clients")
+		return
+	case !s.authOffered():
+		s.reply(538, "5.7.11 Encryption required, use STARTTLS first")
+		return
+	case s.helo == "":
+		s.reply(503, "5.5.1 Send EHLO first")
+		return
+	case s.user != "":
+		s.reply(503, "5.5.1 Already authenticated")
+		return
+	case s.hasFrom:
+		s.reply(503, "5.5.1 AUTH not allowed during a mail transaction")
+		return
+	}
+
+	mech, initial, _ := strings.Cut(arg, " ")
+	var username, password string
+	var ok bool
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		var resp string
+		if resp, ok = s.authResponse(initial, ""); !ok {
+			return
+		}
+		parts := strings.Split(resp, "\x00")
+		if len(parts) != 3 {
+			s.reply(501, "5.5.2 Invalid PLAIN response")
+			return
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		if username, ok = s.authResponse(initial, "Username:"); !ok {
+			return
+		}
+		if password, ok = s.authResponse("", "Password:"); !ok {
+			return
+		}
+	default:
+		s.reply(504, "5.5.4 Unrecognized authentication type")
+		return
+	}
+
+	if s.server.Auth(username, password) {
+		s.user = username
+		s.reply(235, "2.7.0 Authentication successful")
+		return
+	}
+	s.authFailures++
+	time.Sleep(time.Second)
+	if s.authFailures >= maxAuthFailures {
+		s.reply(421, "4.7.0 Too many failed logins")
+		s.failed = true
+		return
+	}
+	s.reply(535, "5.7.8 Authentication credentials invalid")
+}
+
+// authResponse returns the decoded initial response, or prompts for one
+func (s *session) authResponse(initial, prompt string) (string, bool) {
+	if initial == "" {
+		s.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, err := s.readLine()
+		if err != nil {
+			s.failed = true
+			return "", false
+		}
+		initial = line
+	}
+	if initial == "*" {
+		s.reply(501, "5.0.0 Authentication cancelled")
+		return "", false
+	}
+	if initial == "=" {
+		return "", true
+	}
+	decoded, err := base64.StdEncoding.DecodeString(initial)
+	if err != nil {
+		s.reply(501, "5.5.2 Invalid base64 data")
+		return "", false
+	}
+	return string(decoded), true
+}
+
+func (s *session) handleMail(arg string) {
+	switch {
+	case s.helo == "":
+		s.reply(503, "5.5.1 Send HELO or EHLO first")
+		return
+	case s.server.Auth != nil && s.user == "":
+		s.reply(530, "5.7.0 Authentication required")
+		return
+	case s.hasFrom:
+		s.reply(503, "5.5.1 Sender already specified")
+		return
+	}
+	addr, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, param := range params {
+		key, value, _ := strings.Cut(param, "=")
+		switch strings.ToUpper(key) {
+		case "SIZE":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				s.reply(501, "5.5.4 Invalid SIZE parameter")
+				return
+			}
+			if size > s.server.maxSize() {
+				s.reply(552, "5.3.4 Message size exceeds fixed maximum message size")
+				return
+			}
+		case "BODY":
+		default:
+			s.reply(555, "5.5.4 Unsupported parameter "+key)
+			return
+		}
+	}
+	s.hasFrom = true
+	s.from = addr
+	s.reply(250, "2.1.0 OK")
+}
+
+func (s *session) handleRcpt(arg string) {
+	if !s.hasFrom {
+		s.reply(503, "5.5.1 Send MAIL first")
+		return
+	}
+	if len(s.to) >= s.server.maxRecipients() {
+		s.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+	addr, _, ok := parsePath(arg, "TO:")
+	if !ok || !strings.Contains(addr, "@") {
+		s.reply(501, "5.1.3 Syntax: RCPT TO:<address>")
+		return
+	}
+	s.to = append(s.to, addr)
+	s.reply(250, "2.1.5 OK")
+}
+
+func (s *session) handleData() {
+	if len(s.to) == 0 {
+		s.reply(503, "5.5.1 Send RCPT first")
+		return
+	}
+	s.reply(354, "End data with <CR><LF>.<CR><LF>")
+	if s.failed {
+		return
+	}
+
+	max := s.server.maxSize()
+	dot := textproto.NewReader(s.reader).DotReader()
+	data, err := io.ReadAll(io.LimitReader(dot, max+1))
+	if err != nil {
+		s.failed = true
+		return
+	}
+	if int64(len(data)) > max {
+		if _, err := io.Copy(io.Discard, dot); err != nil {
+			s.failed = true
+			return
+		}
+		s.reset()
+		s.reply(552, "5.3.4 Message size exceeds fixed maximum message size")
+		return
+	}
+
+	// The dot reader turns line endings into LF; messages are passed on
+	// with CRLF as they were sent
+	data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+	data = append([]byte(s.received()), data...)
+
+	env := Envelope{
+		RemoteAddr: s.conn.RemoteAddr(),
+		Helo:       s.helo,
+		User:       s.user,
+		TLS:        s.tls,
+		From:       s.from,
+		To:         s.to,
+	}
+	s.reset()
+
+	if s.server.Handler == nil {
+		s.reply(250, "2.0.0 OK")
+		return
+	}
+	err = s.server.Handler(env, data)
+	var smtpErr *Error
+	switch {
+	case err == nil:
+		s.reply(250, "2.0.0 OK")
+	case errors.As(err, &smtpErr):
+		s.reply(smtpErr.Code, smtpErr.Message)
+	default:
+		s.reply(554, "5.3.0 "+err.Error())
+	}
+}
+
+// received returns the Received trace field added to every message, with
+// the protocol named as in RFC 3848
+func (s *session) received() string {
+	proto := "ESMTP"
+	if s.tls {
+		proto += "S"
+	}
+	if s.user != "" {
+		proto += "A"
+	}
+	host, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	return fmt.Sprintf("Received: from %s ([%s])\r\n\tby %s with %s;\r\n\t%s\r\n",
+		s.helo, host, s.server.hostname(), proto, time.Now().Format(time.RFC1123Z))
+}
+
+// parsePath parses the argument of MAIL or RCPT into the address between
+// angle brackets and any ESMTP parameters after it
+func parsePath(arg, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return "", nil, false
+		}
+		return fields[0], fields[1:], true
+	}
+	end := strings.Index(rest, ">")
+	if end < 0 {
+		return "", nil, false
+	}
+	addr := rest[1:end]
+	// Drop a source route such as <@relay.example:user@example.com>
+	if strings.HasPrefix(addr, "@") {
+		if i := strings.Index(addr, ":"); i >= 0 {
+			addr = addr[i+1:]
+		}
+	}
+	return addr, strings.Fields(rest[end+1:]), true
+}
@@ -0,0 +1,43 @@
+package smtpd
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// pipe serves a session over an in-memory connection, which the server
+// sees as coming from a remote, non-loopback client
+func pipe(t *testing.T, srv *Server) *textproto.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	srv.conns = make(map[net.Conn]bool)
+	go srv.serveConn(server)
+	c := textproto.NewConn(client)
+	t.Cleanup(func() { c.Close() })
+	expect(t, c, 220)
+	return c
+}
+
+func TestAuthRequiresTLSForRemoteClients(t *testing.T) {
+	check := func(user, password string) bool { return user == "app" && password == "secret" }
+	login := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00app\x00secret"))
+
+	// Remote client without TLS: AUTH is neither offered nor accepted
+	c := pipe(t, &Server{Auth: check})
+	if ehlo := command(t, c, 250, "EHLO client.example"); strings.Contains(ehlo, "AUTH") {
+		t.Errorf("AUTH offered in the clear to a remote client:\n%s", ehlo)
+	}
+	command(t, c, 538, login)
+	command(t, c, 530, "MAIL FROM:<app@example.com>")
+
+	// The same server admits logins from the local machine
+	c = dial(t, &Server{Auth: check})
+	if ehlo := command(t, c, 250, "EHLO localhost"); !strings.Contains(ehlo, "AUTH PLAIN LOGIN") {
+		t.Errorf("AUTH not offered to a loopback client:\n%s", ehlo)
+	}
+	command(t, c, 235, login)
+	command(t, c, 250, "MAIL FROM:<app@example.com>")
+}
@@ -0,0 +1,189 @@
+package web
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/pranavKharche24/mail/catcher"
+)
+
+// untrustedCSP is sent with captured content, which comes from anyone able
+// to reach the catcher: scripts never run and the page cannot submit forms
+const untrustedCSP = "sandbox; default-src 'none'; img-src * data:; style-src * 'unsafe-inline'; font-src * data:"
+
+// cidRef matches cid: URLs in the HTML body of a message
+var cidRef = regexp.MustCompile(`(?i)cid:([^"'\s)>]+)`)
+
+// SetCatcher sets the store of captured mail shown on the inbox page
+func (s *Server) SetCatcher(store *catcher.Store) {
+	s.catcher = store
+}
+
+func (s *Server) handleInbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && s.catcher != nil {
+		var err error
+		switch r.FormValue("action") {
+		case "delete":
+			err = s.catcher.Delete(r.FormValue("id"))
+		case "clear":
+			err = s.catcher.Clear()
+		default:
+			err = fmt.Errorf("unknown action")
+		}
+		if err != nil {
+			http.Redirect(w, r, "/inbox?error="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/inbox", http.StatusSeeOther)
+		return
+	}
+
+	data := struct {
+		Enabled  bool
+		Messages []*catcher.Message
+		Selected *catcher.Message
+		Parsed   *catcher.Parsed
+		View     string
+		Error    string
+	}{
+		Enabled: s.catcher != nil,
+		Error:   r.URL.Query().Get("error"),
+	}
+	if s.catcher != nil {
+		data.Messages = s.catcher.List()
+		if id := r.URL.Query().Get("id"); id != "" {
+			data.Selected = s.catcher.Get(id)
+			if data.Selected == nil {
+				data.Error = "That message no longer exists."
+			}
+		}
+	}
+	if data.Selected != nil {
+		data.Parsed = data.Selected.Parse()
+		data.View = r.URL.Query().Get("view")
+		switch data.View {
+		case "html", "text", "headers", "raw":
+		default:
+			data.View = "text"
+			if data.Parsed.HTML != "" {
+				data.View = "html"
+			}
+		}
+	}
+
+	tmpl, err := template.ParseFiles("templates/inbox.html")
+	if err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+	tmpl.Execute(w, data)
+}
+
+// handleInboxHTML serves the HTML body of a captured message for the
+// sandboxed frame on the inbox page, pointing cid: images at their parts
+func (s *Server) handleInboxHTML(w http.ResponseWriter, r *http.Request) {
+	msg := s.capturedMessage(w, r)
+	if msg == nil {
+		return
+	}
+	parsed := msg.Parse()
+	contentIDs := make(map[string]int)
+	for _, part := range parsed.Parts {
+		if part.ContentID != "" {
+			contentIDs[part.ContentID] = part.Index
+		}
+	}
+	body := cidRef.ReplaceAllStringFunc(parsed.HTML, func(ref string) string {
+		cid, _ := url.PathUnescape(ref[len("cid:"):])
+		n, ok := contentIDs[cid]
+		if !ok {
+			return ref
+		}
+		return partURL(msg.ID, n)
+	})
+
+	w.Header().Set("Content-Security-Policy", untrustedCSP)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write([]byte(body))
+}
+
+// handleInboxRaw serves the source of a captured message
+func (s *Server) handleInboxRaw(w http.ResponseWriter, r *http.Request) {
+	msg := s.capturedMessage(w, r)
+	if msg == nil {
+		return
+	}
+	if r.URL.Query().Get("download") != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": msg.ID + ".eml"}))
+		w.Header().Set("Content-Type", "message/rfc822")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(msg.Raw)
+}
+
+// handleInboxPart serves an attachment or inline part of a captured
+// message. Images are shown inline; anything else is downloaded.
+func (s *Server) handleInboxPart(w http.ResponseWriter, r *http.Request) {
+	msg := s.capturedMessage(w, r)
+	if msg == nil {
+		return
+	}
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	part := msg.Parse().Part(n)
+	if part == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	filename := part.Filename
+	if filename == "" {
+		filename = fmt.Sprintf("part-%d", part.Index)
+	}
+	disposition := "attachment"
+	if isImage(part.ContentType) && r.URL.Query().Get("download") == "" {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	w.Header().Set("Content-Security-Policy", untrustedCSP)
+	w.Header().Set("Content-Type", part.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(part.Data)
+}
+
+// capturedMessage looks up the message named by the id parameter, replying
+// with an error if there is none
+func (s *Server) capturedMessage(w http.ResponseWriter, r *http.Request) *catcher.Message {
+	if s.catcher == nil {
+		http.Error(w, "The mail catcher is not running", http.StatusNotFound)
+		return nil
+	}
+	msg := s.catcher.Get(r.URL.Query().Get("id"))
+	if msg == nil {
+		http.NotFound(w, r)
+	}
+	return msg
+}
+
+func partURL(id string, n int) string {
+	return "/inbox/part?" + url.Values{"id": {id}, "n": {strconv.Itoa(n)}}.Encode()
+}
+
+// isImage reports whether a part can be shown by the browser as an image.
+// SVG is excluded since it may contain scripts.
+func isImage(contentType string) bool {
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif", "image/webp", "image/bmp":
+		return true
+	}
+	return false
+}
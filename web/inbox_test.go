@@ -0,0 +1,164 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/pranavKharche24/mail/catcher"
+)
+
+const capturedHTML = "From: alice@example.com\r\n" +
+	"Subject: Newsletter\r\n" +
+	"Content-Type: multipart/related; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<img src=\"cid:logo%40example\"><img src='cid:unknown'><script>alert(1)</script>\r\n" +
+	"--b\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-ID: <logo@example>\r\n" +
+	"\r\n" +
+	"PNG\r\n" +
+	"--b\r\n" +
+	"Content-Type: image/svg+xml\r\n" +
+	"Content-Disposition: inline; filename=\"icon.svg\"\r\n" +
+	"\r\n" +
+	"<svg onload=\"alert(1)\"/>\r\n" +
+	"--b--\r\n"
+
+func inboxServer(t *testing.T) (*Server, *catcher.Store, *catcher.Message) {
+	t.Helper()
+	s, _ := testServer(t)
+	store, err := catcher.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetCatcher(store)
+	msg, err := store.Add("alice@example.com", []string{"bob@example.com"}, []byte(capturedHTML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, store, msg
+}
+
+func get(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestInboxPage(t *testing.T) {
+	s, _, msg := inboxServer(t)
+
+	rec := get(s.handleInbox, "/inbox")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Newsletter") {
+		t.Errorf("inbox page %d:\n%s", rec.Code, rec.Body)
+	}
+	// The captured HTML is only shown in the sandboxed frame
+	rec = get(s.handleInbox, "/inbox?id="+msg.ID)
+	if strings.Contains(rec.Body.String(), "<script>alert(1)") {
+		t.Error("captured HTML embedded in the inbox page")
+	}
+	if rec = get(s.handleInbox, "/inbox?id=missing"); !strings.Contains(rec.Body.String(), "That message no longer exists.") {
+		t.Errorf("missing message not reported:\n%s", rec.Body)
+	}
+
+	s.SetCatcher(nil)
+	if rec = get(s.handleInbox, "/inbox"); rec.Code != http.StatusOK {
+		t.Errorf("inbox page without a catcher: %d", rec.Code)
+	}
+}
+
+func TestInboxActions(t *testing.T) {
+	s, store, msg := inboxServer(t)
+	store.Add("carol@example.com", []string{"bob@example.com"}, []byte("Subject: Second\r\n\r\nx\r\n"))
+
+	tests := []struct {
+		fields map[string]string
+		err    string
+		left   int
+	}{
+		{map[string]string{"action": "delete", "id": msg.ID}, "", 1},
+		{map[string]string{"action": "delete", "id": msg.ID}, "no captured message", 1},
+		{map[string]string{"action": "archive"}, "unknown action", 1},
+		{map[string]string{"action": "clear"}, "", 0},
+	}
+	for _, tt := range tests {
+		u := location(t, postForm(t, s.handleInbox, "/inbox", tt.fields))
+		if got := u.Query().Get("error"); u.Path != "/inbox" || (tt.err == "") != (got == "") || !strings.Contains(got, tt.err) {
+			t.Errorf("%v redirected to %s", tt.fields, u)
+		}
+		if left := len(store.List()); left != tt.left {
+			t.Errorf("%v: %d messages left, want %d", tt.fields, left, tt.left)
+		}
+	}
+}
+
+func TestInboxHTML(t *testing.T) {
+	s, _, msg := inboxServer(t)
+
+	rec := get(s.handleInboxHTML, "/inbox/html?id="+msg.ID)
+	if rec.Header().Get("Content-Security-Policy") != untrustedCSP || rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("captured HTML served with headers %v", rec.Header())
+	}
+	// cid: references point at the parts they name; unknown ones are kept
+	body := rec.Body.String()
+	if !strings.Contains(body, `src="`+partURL(msg.ID, 1)+`"`) || !strings.Contains(body, `src='cid:unknown'`) {
+		t.Errorf("body %s", body)
+	}
+
+	if rec = get(s.handleInboxHTML, "/inbox/html?id=missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("missing message: %d", rec.Code)
+	}
+	s.SetCatcher(nil)
+	if rec = get(s.handleInboxHTML, "/inbox/html?id="+msg.ID); rec.Code != http.StatusNotFound {
+		t.Errorf("no catcher: %d", rec.Code)
+	}
+}
+
+func TestInboxRaw(t *testing.T) {
+	s, _, msg := inboxServer(t)
+
+	rec := get(s.handleInboxRaw, "/inbox/raw?id="+msg.ID)
+	if rec.Body.String() != capturedHTML || rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("raw message served as %q", rec.Header().Get("Content-Type"))
+	}
+	rec = get(s.handleInboxRaw, "/inbox/raw?download=1&id="+msg.ID)
+	if rec.Header().Get("Content-Type") != "message/rfc822" || rec.Header().Get("Content-Disposition") != `attachment; filename=`+msg.ID+`.eml` {
+		t.Errorf("download served with headers %v", rec.Header())
+	}
+}
+
+func TestInboxPart(t *testing.T) {
+	s, _, msg := inboxServer(t)
+	part := func(n string, download bool) *httptest.ResponseRecorder {
+		query := url.Values{"id": {msg.ID}, "n": {n}}
+		if download {
+			query.Set("download", "1")
+		}
+		return get(s.handleInboxPart, "/inbox/part?"+query.Encode())
+	}
+
+	rec := part("1", false)
+	if rec.Body.String() != "PNG" || rec.Header().Get("Content-Type") != "image/png" || rec.Header().Get("Content-Disposition") != "inline; filename=part-1" {
+		t.Errorf("image served with headers %v", rec.Header())
+	}
+	if rec = part("1", true); rec.Header().Get("Content-Disposition") != "attachment; filename=part-1" {
+		t.Errorf("image download served with headers %v", rec.Header())
+	}
+	// SVG can carry scripts, so it is never shown inline
+	rec = part("2", false)
+	if rec.Header().Get("Content-Disposition") != "attachment; filename=icon.svg" || rec.Header().Get("Content-Security-Policy") != untrustedCSP {
+		t.Errorf("SVG served with headers %v", rec.Header())
+	}
+
+	for _, n := range []string{"0", "3", "x"} {
+		if rec := part(n, false); rec.Code != http.StatusNotFound {
+			t.Errorf("part %s: %d", n, rec.Code)
+		}
+	}
+}
@@ -1,22 +1,31 @@
 package web
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/pranavKharche24/mail/catcher"
+	"github.com/pranavKharche24/mail/config"
 	"github.com/pranavKharche24/mail/mailer"
+	"github.com/pranavKharche24/mail/outbox"
 )
 
 // Server handles the web interface
 type Server struct {
-	mailer *mailer.Mailer
-	port   string
+	mailer  *mailer.Mailer
+	outbox  *outbox.Outbox
+	catcher *catcher.Store
+	port    string
 }
 
 // New creates a new web server
@@ -27,12 +36,23 @@ func New(port string, m *mailer.Mailer) *Server {
 	}
 }
 
+// SetOutbox sets the outbox shown on the outbox page
+func (s *Server) SetOutbox(ob *outbox.Outbox) {
+	s.outbox = ob
+}
+
 // Start starts the web server
 func (s *Server) Start() error {
 	http.HandleFunc("/", s.handleHome)
 	http.HandleFunc("/send", s.handleSend)
 	http.HandleFunc("/admin", s.handleAdmin)
 	http.HandleFunc("/admin/save", s.handleAdminSave)
+	http.HandleFunc("/merge", s.handleMerge)
+	http.HandleFunc("/outbox", s.handleOutbox)
+	http.HandleFunc("/inbox", s.handleInbox)
+	http.HandleFunc("/inbox/html", s.handleInboxHTML)
+	http.HandleFunc("/inbox/raw", s.handleInboxRaw)
+	http.HandleFunc("/inbox/part", s.handleInboxPart)
 	http.HandleFunc("/api/status", s.handleAPIStatus)
 
 	addr := ":" + s.port
@@ -46,9 +66,11 @@ func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		IsConfigured bool
 		FromEmail    string
+		PGP          bool
 	}{
 		IsConfigured: s.mailer.IsConfigured(),
 		FromEmail:    email,
+		PGP:          s.mailer.Keyring() != nil,
 	}
 
 	tmpl, err := template.ParseFiles("templates/index.html")
@@ -62,13 +84,20 @@ func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleAdmin(w http.ResponseWriter, r *http.Request) {
 	email, password := s.mailer.GetCredentials()
+	host, port, tlsMode := s.mailer.GetServer()
 	data := struct {
 		FromEmail    string
 		FromPass     string
+		SMTPHost     string
+		SMTPPort     string
+		SMTPTLS      string
 		IsConfigured bool
 	}{
 		FromEmail:    email,
 		FromPass:     password,
+		SMTPHost:     host,
+		SMTPPort:     port,
+		SMTPTLS:      string(tlsMode),
 		IsConfigured: s.mailer.IsConfigured(),
 	}
 
@@ -93,12 +122,36 @@ func (s *Server) handleAdminSave(w http.ResponseWriter, r *http.Request) {
 
 	email := r.FormValue("fromEmail")
 	password := r.FormValue("fromPass")
+	host := strings.TrimSpace(r.FormValue("smtpHost"))
+	port := strings.TrimSpace(r.FormValue("smtpPort"))
+
+	tlsMode, err := mailer.ParseTLSMode(r.FormValue("smtpTLS"))
+	if err != nil {
+		http.Error(w, "Invalid TLS mode", http.StatusBadRequest)
+		return
+	}
+	if host == "" {
+		host = "smtp.gmail.com"
+	}
+	if port == "" {
+		port = config.DefaultSMTPPort(string(tlsMode))
+	}
 
 	s.mailer.SetCredentials(email, password)
+	s.mailer.SetServer(host, port, tlsMode)
 
 	// Save to .env
-	envContent := fmt.Sprintf("# Gomail Configuration\nEMAIL_FROM=%s\nEMAIL_PASSWORD=%s\nPORT=%s\n", email, password, s.port)
-	os.WriteFile(".env", []byte(envContent), 0600)
+	err = config.SaveEnv(".env", map[string]string{
+		"EMAIL_FROM":     email,
+		"EMAIL_PASSWORD": password,
+		"PORT":           s.port,
+		"SMTP_HOST":      host,
+		"SMTP_PORT":      port,
+		"SMTP_TLS":       string(tlsMode),
+	})
+	if err != nil {
+		log.Printf("Failed to save .env: %v", err)
+	}
 
 	http.Redirect(w, r, "/?saved=true", http.StatusSeeOther)
 }
@@ -120,38 +173,271 @@ func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
 	}
 
 	mailType := r.FormValue("mailType")
-	to := splitEmails(r.FormValue("to"))
-	cc := splitEmails(r.FormValue("cc"))
-	bcc := splitEmails(r.FormValue("bcc"))
-	subject := r.FormValue("subject")
-	message := r.FormValue("message")
+	to, errTo := mailer.ParseAddressList(r.FormValue("to"))
+	cc, errCc := mailer.ParseAddressList(r.FormValue("cc"))
+	bcc, errBcc := mailer.ParseAddressList(r.FormValue("bcc"))
+	replyTo, errReplyTo := mailer.ParseAddressList(r.FormValue("replyTo"))
+	if errTo != nil || errCc != nil || errBcc != nil || errReplyTo != nil || len(to) == 0 {
+		http.Redirect(w, r, "/?error=address", http.StatusSeeOther)
+		return
+	}
+
+	sendAt, err := mailer.ParseSendAt(r.FormValue("sendAt"), time.Now())
+	if err != nil {
+		log.Printf("Send time error: %v", err)
+		http.Redirect(w, r, "/?error=sendat", http.StatusSeeOther)
+		return
+	}
+
+	headers, err := parseHeaderLines(r.FormValue("headers"))
+	if err != nil {
+		log.Printf("Header error: %v", err)
+		http.Redirect(w, r, "/?error=header", http.StatusSeeOther)
+		return
+	}
+
+	msg := &mailer.Message{
+		To:         to,
+		Cc:         cc,
+		Bcc:        bcc,
+		ReplyTo:    replyTo,
+		Subject:    r.FormValue("subject"),
+		InReplyTo:  strings.TrimSpace(r.FormValue("inReplyTo")),
+		References: strings.Fields(r.FormValue("references")),
+		Headers:    headers,
+		Sign:       r.FormValue("pgpSign") != "",
+		Encrypt:    r.FormValue("pgpEncrypt") != "",
+	}
 
 	htmlFilePath, _ := s.saveUploadedFile(r, "htmlFile")
 	attachments, _ := s.saveUploadedFiles(r, "attachments")
+	for _, path := range attachments {
+		msg.Attach(path)
+	}
 
-	var sendErr error
 	if mailType == "html" && htmlFilePath != "" {
-		sendErr = s.mailer.SendHTML(to, subject, htmlFilePath, cc, bcc, attachments)
+		data, err := templateFields(r.FormValue("fields"))
+		if err != nil {
+			log.Printf("Template field error: %v", err)
+			http.Redirect(w, r, "/?error=fields", http.StatusSeeOther)
+			return
+		}
+		if err := msg.LoadHTMLTemplate(htmlFilePath, data); err != nil {
+			log.Printf("Template error: %v", err)
+			http.Redirect(w, r, "/?error=send", http.StatusSeeOther)
+			return
+		}
 	} else {
-		sendErr = s.mailer.SendPlain(to, subject, message, cc, bcc, attachments)
+		msg.Text = r.FormValue("message")
+	}
+
+	if !sendAt.IsZero() {
+		id, err := s.mailer.Schedule(msg, sendAt)
+		if redirectMissingKey(w, r, err) {
+			return
+		}
+		if err != nil {
+			log.Printf("Schedule error: %v", err)
+			http.Redirect(w, r, "/?error=send", http.StatusSeeOther)
+			return
+		}
+		query := url.Values{"scheduled": {"true"}, "id": {id}, "at": {sendAt.Format(time.RFC3339)}}
+		http.Redirect(w, r, "/?"+query.Encode(), http.StatusSeeOther)
+		return
 	}
 
+	id, sendErr := s.mailer.Send(r.Context(), msg)
+	if errors.Is(sendErr, mailer.ErrQueued) {
+		log.Printf("Send deferred: %v", sendErr)
+		http.Redirect(w, r, "/?queued=true&id="+url.QueryEscape(id), http.StatusSeeOther)
+		return
+	}
+	if mailer.IsRateLimited(sendErr) {
+		log.Printf("Send rejected: %v", sendErr)
+		http.Redirect(w, r, "/?error=ratelimit", http.StatusSeeOther)
+		return
+	}
+	if redirectMissingKey(w, r, sendErr) {
+		return
+	}
 	if sendErr != nil {
 		log.Printf("Send error: %v", sendErr)
 		http.Redirect(w, r, "/?error=send", http.StatusSeeOther)
 		return
 	}
 
-	http.Redirect(w, r, "/?success=true", http.StatusSeeOther)
+	http.Redirect(w, r, "/?success=true&id="+url.QueryEscape(id), http.StatusSeeOther)
+}
+
+// redirectMissingKey reports an encrypted send refused for lack of
+// recipient keys and returns true if err was such a refusal
+func redirectMissingKey(w http.ResponseWriter, r *http.Request, err error) bool {
+	var keyErr *mailer.MissingKeyError
+	if !errors.As(err, &keyErr) {
+		return false
+	}
+	log.Printf("Send refused: %v", err)
+	query := url.Values{"error": {"pgpkey"}, "missing": {strings.Join(keyErr.Addresses, ", ")}}
+	http.Redirect(w, r, "/?"+query.Encode(), http.StatusSeeOther)
+	return true
+}
+
+func (s *Server) handleMerge(w http.ResponseWriter, r *http.Request) {
+	email, _ := s.mailer.GetCredentials()
+	data := struct {
+		IsConfigured bool
+		FromEmail    string
+		Error        string
+		DryRun       bool
+		Results      []mailer.MergeResult
+		Succeeded    int
+		Queued       int
+		Failed       int
+	}{
+		IsConfigured: s.mailer.IsConfigured(),
+		FromEmail:    email,
+	}
+
+	if r.Method == http.MethodPost {
+		data.DryRun = r.FormValue("dryRun") == "true"
+		results, err := s.runMerge(r, data.DryRun)
+		if err != nil {
+			data.Error = err.Error()
+		}
+		data.Results = results
+		for _, result := range results {
+			switch {
+			case result.Err != nil:
+				data.Failed++
+			case result.Queued:
+				data.Queued++
+			default:
+				data.Succeeded++
+			}
+		}
+	}
+
+	tmpl, err := template.ParseFiles("templates/merge.html")
+	if err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+	tmpl.Execute(w, data)
+}
+
+// runMerge performs the mail merge submitted from the merge page
+func (s *Server) runMerge(r *http.Request, dryRun bool) ([]mailer.MergeResult, error) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		return nil, fmt.Errorf("form error: %v", err)
+	}
+	if email, _ := s.mailer.GetCredentials(); dryRun && email == "" {
+		return nil, fmt.Errorf("sender address not configured")
+	}
+	if !dryRun && !s.mailer.IsConfigured() {
+		return nil, fmt.Errorf("credentials not configured")
+	}
+
+	templatePath, err := s.saveUploadedFile(r, "template")
+	if err != nil || templatePath == "" {
+		return nil, fmt.Errorf("a template file is required")
+	}
+	dataPath, err := s.saveUploadedFile(r, "data")
+	if err != nil || dataPath == "" {
+		return nil, fmt.Errorf("a CSV or JSON recipients file is required")
+	}
+
+	rows, err := mailer.LoadMergeData(dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	job := mailer.MergeJob{
+		Template: templatePath,
+		Subject:  r.FormValue("subject"),
+		ToField:  strings.TrimSpace(r.FormValue("toField")),
+	}
+	dir := ""
+	if dryRun {
+		dir = "merge-output"
+	}
+	return s.mailer.Merge(r.Context(), job, rows, dir), nil
+}
+
+func (s *Server) handleOutbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && s.outbox != nil {
+		if err := s.updateOutbox(r); err != nil {
+			http.Redirect(w, r, "/outbox?error="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/outbox", http.StatusSeeOther)
+		return
+	}
+
+	data := struct {
+		Enabled bool
+		Entries []outbox.Entry
+		Error   string
+	}{
+		Enabled: s.outbox != nil,
+		Error:   r.URL.Query().Get("error"),
+	}
+	if s.outbox != nil {
+		entries, err := s.outbox.List()
+		if err != nil {
+			data.Error = err.Error()
+		}
+		data.Entries = entries
+	}
+
+	tmpl, err := template.ParseFiles("templates/outbox.html")
+	if err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+	tmpl.Execute(w, data)
+}
+
+// updateOutbox applies a cancel, reschedule or retry from the outbox page
+func (s *Server) updateOutbox(r *http.Request) error {
+	id := r.FormValue("id")
+	switch r.FormValue("action") {
+	case "cancel":
+		_, err := s.outbox.Purge(id, "")
+		return err
+	case "retry":
+		return s.outbox.Retry(id)
+	case "reschedule":
+		at, err := mailer.ParseSendAt(r.FormValue("sendAt"), time.Now())
+		if err != nil {
+			return err
+		}
+		if at.IsZero() {
+			return fmt.Errorf("choose a new send time")
+		}
+		return s.outbox.Reschedule(id, at)
+	default:
+		return fmt.Errorf("unknown action")
+	}
 }
 
 func (s *Server) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	if s.mailer.IsConfigured() {
-		w.Write([]byte(`{"status":"configured","ready":true}`))
-	} else {
-		w.Write([]byte(`{"status":"not_configured","ready":false}`))
+	status := struct {
+		Status string           `json:"status"`
+		Ready  bool             `json:"ready"`
+		Rate   mailer.RateStats `json:"rate"`
+	}{
+		Status: "not_configured",
+		Ready:  s.mailer.IsConfigured(),
+		Rate:   s.mailer.RateStats(),
 	}
+	if status.Ready {
+		status.Status = "configured"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
 }
 
 func (s *Server) saveUploadedFile(r *http.Request, name string) (string, error) {
@@ -195,15 +481,29 @@ func (s *Server) saveUploadedFiles(r *http.Request, name string) ([]string, erro
 	return paths, nil
 }
 
-func splitEmails(s string) []string {
-	if s == "" {
-		return []string{}
-	}
-	var result []string
-	for _, p := range strings.Split(s, ",") {
-		if trimmed := strings.TrimSpace(p); trimmed != "" {
-			result = append(result, trimmed)
+// parseHeaderLines parses one "Name: value" header per line
+func parseHeaderLines(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value, err := mailer.ParseHeaderField(line)
+		if err != nil {
+			return nil, err
 		}
+		headers[name] = value
+	}
+	return headers, nil
+}
+
+// templateFields parses one "key=value" template field per line, returning
+// nil data when no fields are given
+func templateFields(s string) (interface{}, error) {
+	data, err := mailer.ParseTemplateFields(strings.Split(s, "\n"))
+	if err != nil || len(data) == 0 {
+		return nil, err
 	}
-	return result
+	return data, nil
 }
@@ -0,0 +1,408 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pranavKharche24/mail/mailer"
+	"github.com/pranavKharche24/mail/mailtest"
+	"github.com/pranavKharche24/mail/outbox"
+)
+
+// testServer returns a server sending to a fake SMTP server. It runs in a
+// temporary directory, where uploads and .env are written, with the real
+// templates linked in.
+func testServer(t *testing.T) (*Server, *mailtest.Server) {
+	t.Helper()
+	templates, err := filepath.Abs("../templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Symlink(templates, filepath.Join(dir, "templates")); err != nil {
+		t.Skipf("cannot link the templates: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	srv := mailtest.NewServer()
+	t.Cleanup(srv.Close)
+	return New("8080", srv.Mailer()), srv
+}
+
+// postForm submits a URL-encoded form, as the pages without uploads do
+func postForm(t *testing.T, handler http.HandlerFunc, path string, fields map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	values := url.Values{}
+	for name, value := range fields {
+		values.Set(name, value)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// post submits a multipart form with the given fields and files, named by
+// field, to handler
+func post(t *testing.T, handler http.HandlerFunc, path string, fields, files map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	return postContext(t, context.Background(), handler, path, fields, files)
+}
+
+func postContext(t *testing.T, ctx context.Context, handler http.HandlerFunc, path string, fields, files map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	for name, content := range files {
+		fw, err := mw.CreateFormFile(name, name+".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, &body).WithContext(ctx)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// location returns the redirect target of a response, failing the test if
+// it is not a redirect
+func location(t *testing.T, rec *httptest.ResponseRecorder) *url.URL {
+	t.Helper()
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status %d, want a redirect; body:\n%s", rec.Code, rec.Body)
+	}
+	u, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestHandleSend(t *testing.T) {
+	keyring, err := mailer.LoadKeyring("../mailer/testdata/pgp/bob.pub.asc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, srv := testServer(t)
+	form := func(extra ...string) map[string]string {
+		fields := map[string]string{"to": "bob@example.com", "subject": "Hi", "message": "Hello Bob"}
+		for i := 0; i+1 < len(extra); i += 2 {
+			fields[extra[i]] = extra[i+1]
+		}
+		return fields
+	}
+
+	tests := []struct {
+		name    string
+		fields  map[string]string
+		failure *mailtest.Failure
+		want    string
+		sent    int
+	}{
+		{name: "sent", fields: form("cc", "carol@example.com", "bcc", "dave@example.com", "headers", "X-Campaign: spring"), want: "success", sent: 1},
+		{name: "no recipients", fields: form("to", ""), want: "error=address"},
+		{name: "invalid address", fields: form("cc", "carol@"), want: "error=address"},
+		{name: "invalid send time", fields: form("sendAt", "tomorrow"), want: "error=sendat"},
+		{name: "invalid header", fields: form("headers", "X-Campaign spring"), want: "error=header"},
+		{name: "invalid template fields", fields: form("mailType", "html", "fields", "no equals sign"), want: "error=fields"},
+		{name: "schedule without outbox", fields: form("sendAt", "+1h"), want: "error=send"},
+		{name: "rejected", fields: form(), failure: &mailtest.Failure{Command: "EOM", Code: 554, Message: "5.7.1 Rejected"}, want: "error=send"},
+		{name: "temporary failure", fields: form(), failure: &mailtest.Failure{Command: "RCPT", Code: 450, Message: "4.2.1 Busy"}, want: "error=send"},
+		{name: "missing key", fields: form("pgpEncrypt", "on", "to", "bob@example.com, carol@example.com"), want: "error=pgpkey&missing=carol%40example.com"},
+	}
+	s.mailer.SetKeyring(keyring)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv.Reset()
+			if tt.failure != nil {
+				srv.Fail(*tt.failure)
+			}
+			var files map[string]string
+			if tt.fields["mailType"] == "html" {
+				files = map[string]string{"htmlFile": "<p>Hello {{.Name}}</p>"}
+			}
+			u := location(t, post(t, s.handleSend, "/send", tt.fields, files))
+			if u.Path != "/" || !strings.Contains(u.RawQuery, tt.want) {
+				t.Errorf("redirected to %s, want %s", u, tt.want)
+			}
+			srv.AssertCount(t, tt.sent)
+		})
+	}
+
+	msg := func() *mailtest.Message {
+		srv.Reset()
+		u := location(t, post(t, s.handleSend, "/send", form("cc", "carol@example.com", "bcc", "dave@example.com", "headers", "X-Campaign: spring"), map[string]string{"attachments": "notes"}))
+		if u.Query().Get("success") != "true" || u.Query().Get("id") == "" {
+			t.Fatalf("redirected to %s", u)
+		}
+		return srv.LastMessage(t)
+	}()
+	msg.AssertRecipients(t, "bob@example.com", "carol@example.com", "dave@example.com")
+	msg.AssertNoHeader(t, "Bcc")
+	msg.AssertHeader(t, "X-Campaign", "spring")
+	msg.AssertTextContains(t, "Hello Bob")
+	msg.AssertAttachment(t, "attachments.txt", []byte("notes"))
+
+	// HTML templates are filled in from the fields
+	srv.Reset()
+	location(t, post(t, s.handleSend, "/send", form("mailType", "html", "fields", "Name=Bob"), map[string]string{"htmlFile": "<p>Hello {{.Name}}</p>"}))
+	srv.LastMessage(t).AssertHTMLContains(t, "<p>Hello Bob</p>")
+}
+
+func TestHandleSendQueued(t *testing.T) {
+	s, srv := testServer(t)
+	ob, err := outbox.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mailer.SetSpooler(ob)
+	fields := map[string]string{"to": "bob@example.com", "subject": "Hi", "message": "x"}
+
+	srv.Fail(mailtest.Failure{Command: "RCPT", Code: 450, Message: "4.2.1 Busy", Times: 1})
+	if u := location(t, post(t, s.handleSend, "/send", fields, nil)); u.Query().Get("queued") != "true" || u.Query().Get("id") == "" {
+		t.Errorf("temporary failure redirected to %s", u)
+	}
+
+	fields["sendAt"] = "+2h"
+	u := location(t, post(t, s.handleSend, "/send", fields, nil))
+	at, err := time.Parse(time.RFC3339, u.Query().Get("at"))
+	if u.Query().Get("scheduled") != "true" || err != nil || time.Until(at) < time.Hour {
+		t.Errorf("scheduled send redirected to %s", u)
+	}
+	if entries, _ := ob.List(); len(entries) != 2 {
+		t.Errorf("%d messages in the outbox, want 2", len(entries))
+	}
+	srv.AssertCount(t, 0)
+
+	s.mailer.SetRateLimit(mailer.RateLimit{PerDay: 1})
+	delete(fields, "sendAt")
+	location(t, post(t, s.handleSend, "/send", fields, nil))
+	if u := location(t, post(t, s.handleSend, "/send", fields, nil)); u.Query().Get("error") != "ratelimit" {
+		t.Errorf("rate limited send redirected to %s", u)
+	}
+}
+
+func TestHandleSendCancelled(t *testing.T) {
+	s, srv := testServer(t)
+	srv.Delay("EOM", time.Second)
+
+	// The send stops when the browser goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	rec := postContext(t, ctx, s.handleSend, "/send", map[string]string{"to": "bob@example.com", "subject": "Hi", "message": "x"}, nil)
+	if waited := time.Since(start); waited > 900*time.Millisecond {
+		t.Errorf("handler returned %v after the request was cancelled", waited)
+	}
+	if u := location(t, rec); u.Query().Get("error") != "send" {
+		t.Errorf("redirected to %s", u)
+	}
+}
+
+func TestHandleSendNotConfigured(t *testing.T) {
+	s, srv := testServer(t)
+	s.mailer.SetCredentials("", "")
+	if u := location(t, post(t, s.handleSend, "/send", map[string]string{"to": "bob@example.com"}, nil)); u.String() != "/admin?error=credentials" {
+		t.Errorf("redirected to %s", u)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleSend(rec, httptest.NewRequest(http.MethodGet, "/send", nil))
+	if u := location(t, rec); u.String() != "/" {
+		t.Errorf("GET redirected to %s", u)
+	}
+	srv.AssertCount(t, 0)
+}
+
+func TestHandleMerge(t *testing.T) {
+	s, srv := testServer(t)
+	ob, err := outbox.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mailer.SetSpooler(ob)
+
+	files := map[string]string{
+		"template": "Hello {{.name}}",
+		"data":     "email,name\nbob@example.com,Bob\ncarol@example.com,Carol\nnot an address,Nobody\n",
+	}
+	fields := map[string]string{"subject": "Hi {{.name}}", "toField": "email"}
+	srv.Fail(mailtest.Failure{Command: "RCPT", Code: 450, Message: "4.2.1 Busy", Times: 1})
+	rec := post(t, s.handleMerge, "/merge", fields, files)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+
+	// The queued row is neither sent nor failed
+	body := rec.Body.String()
+	if !strings.Contains(body, "1 sent, 1 queued for retry, 1 failed.") {
+		t.Errorf("summary missing from the page:\n%s", body)
+	}
+	srv.AssertCount(t, 1)
+	srv.LastMessage(t).AssertHeader(t, "Subject", "Hi Carol")
+
+	fields["dryRun"] = "true"
+	rec = post(t, s.handleMerge, "/merge", fields, files)
+	if !strings.Contains(rec.Body.String(), "2 written to disk, 1 failed.") {
+		t.Errorf("dry run summary missing from the page:\n%s", rec.Body)
+	}
+	if written, _ := filepath.Glob("merge-output/*.eml"); len(written) != 2 {
+		t.Errorf("%d files written, want 2", len(written))
+	}
+	srv.AssertCount(t, 1)
+
+	delete(files, "data")
+	rec = post(t, s.handleMerge, "/merge", fields, files)
+	if !strings.Contains(rec.Body.String(), "a CSV or JSON recipients file is required") {
+		t.Errorf("missing data file not reported:\n%s", rec.Body)
+	}
+}
+
+func TestHandleOutbox(t *testing.T) {
+	s, _ := testServer(t)
+	ob, err := outbox.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetOutbox(ob)
+	s.mailer.SetSpooler(ob)
+	msg := &mailer.Message{To: []string{"bob@example.com"}, Subject: "Later", Text: "x"}
+	if _, err := s.mailer.Schedule(msg, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := ob.List()
+	id := entries[0].ID
+
+	rec := httptest.NewRecorder()
+	s.handleOutbox(rec, httptest.NewRequest(http.MethodGet, "/outbox", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Later") {
+		t.Errorf("outbox page %d:\n%s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		fields map[string]string
+		err    string
+	}{
+		{map[string]string{"action": "reschedule", "id": id, "sendAt": "+3h"}, ""},
+		{map[string]string{"action": "reschedule", "id": id}, "choose a new send time"},
+		{map[string]string{"action": "reschedule", "id": id, "sendAt": "yesterday"}, "send time"},
+		{map[string]string{"action": "archive", "id": id}, "unknown action"},
+		{map[string]string{"action": "cancel", "id": id}, ""},
+	}
+	for _, tt := range tests {
+		u := location(t, postForm(t, s.handleOutbox, "/outbox", tt.fields))
+		if got := u.Query().Get("error"); u.Path != "/outbox" || (tt.err == "") != (got == "") || !strings.Contains(got, tt.err) {
+			t.Errorf("%v redirected to %s", tt.fields, u)
+		}
+		if tt.fields["sendAt"] == "+3h" {
+			if entries, _ := ob.List(); time.Until(entries[0].NextAttempt) < 2*time.Hour {
+				t.Errorf("send time %v after rescheduling", entries[0].NextAttempt)
+			}
+		}
+	}
+	if entries, _ := ob.List(); len(entries) != 0 {
+		t.Errorf("%d entries left after cancelling", len(entries))
+	}
+}
+
+func TestHandleAdminSave(t *testing.T) {
+	s, _ := testServer(t)
+	tests := []struct {
+		tls, port, wantPort string
+	}{
+		{"implicit", "", "465"},
+		{"none", " 2525 ", "2525"},
+		{"starttls", "", "587"},
+	}
+	for _, tt := range tests {
+		fields := map[string]string{"fromEmail": "alice@example.com", "fromPass": "secret", "smtpTLS": tt.tls, "smtpPort": tt.port}
+		if u := location(t, postForm(t, s.handleAdminSave, "/admin/save", fields)); u.String() != "/?saved=true" {
+			t.Errorf("redirected to %s", u)
+		}
+		host, port, mode := s.mailer.GetServer()
+		if host != "smtp.gmail.com" || port != tt.wantPort || string(mode) != tt.tls {
+			t.Errorf("server %s:%s (%s), want port %s with %s", host, port, mode, tt.wantPort, tt.tls)
+		}
+		env, _ := os.ReadFile(".env")
+		if !strings.Contains(string(env), "SMTP_PORT="+tt.wantPort+"\n") || !strings.Contains(string(env), "EMAIL_FROM=alice@example.com\n") {
+			t.Errorf(".env:\n%s", env)
+		}
+	}
+
+	rec := postForm(t, s.handleAdminSave, "/admin/save", map[string]string{"smtpTLS": "ssl3"})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid TLS mode: status %d", rec.Code)
+	}
+}
+
+func TestHandleAPIStatus(t *testing.T) {
+	s, _ := testServer(t)
+	s.mailer.SetRateLimit(mailer.RateLimit{PerMinute: 10})
+
+	for _, configured := range []bool{true, false} {
+		if !configured {
+			s.mailer.SetCredentials("", "")
+		}
+		rec := httptest.NewRecorder()
+		s.handleAPIStatus(rec, httptest.NewRequest(http.MethodGet, "/api/status", nil))
+		var status struct {
+			Status string           `json:"status"`
+			Ready  bool             `json:"ready"`
+			Rate   mailer.RateStats `json:"rate"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatalf("%v:\n%s", err, rec.Body)
+		}
+		want := "configured"
+		if !configured {
+			want = "not_configured"
+		}
+		if status.Status != want || status.Ready != configured || rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("status %+v", status)
+		}
+	}
+}
+
+func TestParseFormFields(t *testing.T) {
+	headers, err := parseHeaderLines("X-Campaign: spring\r\n\r\n  X-Priority: 1  \n")
+	if err != nil || len(headers) != 2 || headers["X-Campaign"] != "spring" || headers["X-Priority"] != "1" {
+		t.Errorf("headers %v, %v", headers, err)
+	}
+	if _, err := parseHeaderLines("no colon"); err == nil {
+		t.Error("malformed header accepted")
+	}
+
+	if data, err := templateFields("\n"); data != nil || err != nil {
+		t.Errorf("empty fields gave %v, %v", data, err)
+	}
+	data, err := templateFields("Name=Bob\nCompany=Acme")
+	if fields, ok := data.(map[string]interface{}); err != nil || !ok || fields["Name"] != "Bob" || fields["Company"] != "Acme" {
+		t.Errorf("fields %#v, %v", data, err)
+	}
+}